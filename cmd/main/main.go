@@ -2,11 +2,22 @@ package main
 
 import (
 	"log"
+	"os"
+	// Final image has no zoneinfo, export needs it for 'tz' parameter
+	_ "time/tzdata"
 
 	"github.com/ineverbee/paymulator/internal/app"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		err := app.RunReconcile(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	err := app.StartServer()
 	if err != nil {
 		log.Fatal(err)
@@ -4,15 +4,281 @@ CREATE DATABASE test_db;
 
 \c test_db; 
 
-CREATE TYPE choice AS ENUM ('НОВЫЙ', 'УСПЕХ', 'НЕУСПЕХ', 'ОШИБКА', 'ОТМЕНЕН');
+CREATE TABLE card_vault (
+    token VARCHAR PRIMARY KEY,
+    ciphertext BYTEA NOT NULL,
+    brand VARCHAR NOT NULL,
+    last4 VARCHAR NOT NULL,
+    exp_month INT NOT NULL,
+    exp_year INT NOT NULL,
+    fingerprint VARCHAR NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TYPE choice AS ENUM ('НОВЫЙ', 'УСПЕХ', 'НЕУСПЕХ', 'ОШИБКА', 'ОТМЕНЕН', 'ТРЕБУЕТ_ДЕЙСТВИЯ');
+
+CREATE TABLE customers (
+    id SERIAL NOT NULL PRIMARY KEY,
+    user_id INT NOT NULL UNIQUE,
+    email VARCHAR NOT NULL,
+    name VARCHAR NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX customers_email_idx ON customers (email);
+
+CREATE TABLE payment_methods (
+    id SERIAL NOT NULL PRIMARY KEY,
+    customer_id INT REFERENCES customers (id) ON DELETE SET NULL,
+    type VARCHAR NOT NULL,
+    brand VARCHAR NOT NULL DEFAULT '',
+    last4 VARCHAR NOT NULL DEFAULT '',
+    exp_month INT NOT NULL DEFAULT 0,
+    exp_year INT NOT NULL DEFAULT 0,
+    fingerprint VARCHAR NOT NULL DEFAULT '',
+    wallet_provider VARCHAR NOT NULL DEFAULT '',
+    bank_code VARCHAR NOT NULL DEFAULT '',
+    outcome VARCHAR NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
 
 CREATE TABLE transactions (
     id SERIAL NOT NULL PRIMARY KEY,
+    customer_id INT REFERENCES customers (id),
     user_id INT,
     email VARCHAR,
     amount FLOAT,
     currency VARCHAR,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    transaction_status choice
-);
\ No newline at end of file
+    transaction_status choice,
+    merchant_id INT NOT NULL DEFAULT 0,
+    fee FLOAT,
+    net_amount FLOAT,
+    payment_method_id INT REFERENCES payment_methods (id),
+    payment_method VARCHAR NOT NULL DEFAULT '',
+    decline_code VARCHAR NOT NULL DEFAULT '',
+    return_url VARCHAR NOT NULL DEFAULT '',
+    challenge_token VARCHAR UNIQUE,
+    metadata JSONB NOT NULL DEFAULT '{}',
+    merchant_reference VARCHAR(100),
+    CONSTRAINT transactions_merchant_reference_key UNIQUE (merchant_id, merchant_reference)
+);
+CREATE INDEX transactions_metadata_idx ON transactions USING GIN (metadata);
+CREATE INDEX transactions_customer_id_idx ON transactions (customer_id);
+
+CREATE TABLE fee_schedules (
+    id SERIAL NOT NULL PRIMARY KEY,
+    merchant_id INT NOT NULL,
+    currency VARCHAR NOT NULL DEFAULT '',
+    payment_method VARCHAR NOT NULL DEFAULT '',
+    percent FLOAT NOT NULL DEFAULT 0,
+    fixed FLOAT NOT NULL DEFAULT 0,
+    min_fee FLOAT NOT NULL DEFAULT 0,
+    max_fee FLOAT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE settlements (
+    id SERIAL NOT NULL PRIMARY KEY,
+    merchant_id INT NOT NULL,
+    currency VARCHAR NOT NULL,
+    business_date DATE NOT NULL,
+    success_count INT NOT NULL DEFAULT 0,
+    success_amount FLOAT NOT NULL DEFAULT 0,
+    failed_count INT NOT NULL DEFAULT 0,
+    failed_amount FLOAT NOT NULL DEFAULT 0,
+    cancelled_count INT NOT NULL DEFAULT 0,
+    cancelled_amount FLOAT NOT NULL DEFAULT 0,
+    refunded_count INT NOT NULL DEFAULT 0,
+    refunded_amount FLOAT NOT NULL DEFAULT 0,
+    fee_amount FLOAT NOT NULL DEFAULT 0,
+    net_amount FLOAT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE settlement_lines (
+    id SERIAL NOT NULL PRIMARY KEY,
+    settlement_id INT NOT NULL REFERENCES settlements (id),
+    type VARCHAR NOT NULL DEFAULT 'payment',
+    transaction_id INT NOT NULL REFERENCES transactions (id),
+    dispute_id INT UNIQUE,
+    transaction_status choice,
+    amount FLOAT,
+    fee FLOAT NOT NULL DEFAULT 0,
+    net_amount FLOAT NOT NULL DEFAULT 0
+);
+-- A transaction is settled once, its refund once more
+CREATE UNIQUE INDEX settlement_lines_transaction_id_key ON settlement_lines (transaction_id) WHERE dispute_id IS NULL;
+
+CREATE TYPE dispute_status AS ENUM ('needs_response', 'under_review', 'won', 'lost');
+
+CREATE TABLE disputes (
+    id SERIAL NOT NULL PRIMARY KEY,
+    transaction_id INT NOT NULL UNIQUE REFERENCES transactions (id),
+    merchant_id INT NOT NULL,
+    amount FLOAT NOT NULL,
+    currency VARCHAR NOT NULL,
+    reason_code VARCHAR NOT NULL,
+    status dispute_status NOT NULL DEFAULT 'needs_response',
+    evidence VARCHAR NOT NULL DEFAULT '',
+    evidence_due_by TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Refunds of lost disputes are settled by their own lines
+ALTER TABLE settlement_lines ADD CONSTRAINT settlement_lines_dispute_id_fkey FOREIGN KEY (dispute_id) REFERENCES disputes (id);
+
+CREATE TABLE plans (
+    id SERIAL NOT NULL PRIMARY KEY,
+    name VARCHAR NOT NULL,
+    merchant_id INT NOT NULL DEFAULT 0,
+    amount FLOAT NOT NULL,
+    currency VARCHAR NOT NULL,
+    billing_interval VARCHAR NOT NULL,
+    interval_count INT NOT NULL DEFAULT 1,
+    trial_days INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TYPE subscription_status AS ENUM ('trialing', 'active', 'past_due', 'unpaid', 'canceled');
+
+CREATE TABLE subscriptions (
+    id SERIAL NOT NULL PRIMARY KEY,
+    plan_id INT NOT NULL REFERENCES plans (id),
+    user_id INT NOT NULL,
+    email VARCHAR NOT NULL,
+    payment_method_id INT REFERENCES payment_methods (id),
+    status subscription_status NOT NULL,
+    current_period_start TIMESTAMP NOT NULL,
+    current_period_end TIMESTAMP NOT NULL,
+    next_billing_at TIMESTAMP,
+    cancel_at_period_end BOOLEAN NOT NULL DEFAULT false,
+    canceled_at TIMESTAMP,
+    failed_attempts INT NOT NULL DEFAULT 0,
+    proration_balance FLOAT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX subscriptions_next_billing_at_idx ON subscriptions (next_billing_at);
+
+CREATE TABLE subscription_charges (
+    id SERIAL NOT NULL PRIMARY KEY,
+    subscription_id INT NOT NULL REFERENCES subscriptions (id),
+    transaction_id INT REFERENCES transactions (id),
+    amount FLOAT NOT NULL,
+    period_start TIMESTAMP NOT NULL,
+    period_end TIMESTAMP NOT NULL,
+    status VARCHAR NOT NULL,
+    decline_code VARCHAR NOT NULL DEFAULT '',
+    proration FLOAT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX subscription_charges_transaction_id_idx ON subscription_charges (transaction_id);
+
+CREATE TABLE scenarios (
+    name VARCHAR(100) NOT NULL PRIMARY KEY,
+    description VARCHAR NOT NULL DEFAULT '',
+    steps JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TYPE scenario_status AS ENUM ('running', 'completed', 'failed');
+
+-- Steps are copied from scenario, so its run isn't affected by later definitions
+CREATE TABLE scenario_runs (
+    transaction_id INT NOT NULL PRIMARY KEY REFERENCES transactions (id),
+    scenario VARCHAR(100) NOT NULL REFERENCES scenarios (name),
+    status scenario_status NOT NULL,
+    steps JSONB NOT NULL,
+    next_step INT NOT NULL DEFAULT 0,
+    next_at TIMESTAMP,
+    results JSONB NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX scenario_runs_next_at_idx ON scenario_runs (next_at);
+
+-- Step attempted by a run, kept until the step result is stored
+CREATE TABLE scenario_attempts (
+    transaction_id INT NOT NULL REFERENCES transactions (id),
+    step INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (transaction_id, step)
+);
+
+CREATE TABLE request_journal (
+    id SERIAL NOT NULL PRIMARY KEY,
+    request_id VARCHAR(100) NOT NULL,
+    method VARCHAR NOT NULL,
+    path VARCHAR NOT NULL,
+    route VARCHAR NOT NULL,
+    query VARCHAR NOT NULL DEFAULT '',
+    merchant_id INT,
+    request_header JSONB NOT NULL,
+    request_body VARCHAR NOT NULL DEFAULT '',
+    status INT NOT NULL,
+    response_header JSONB NOT NULL,
+    response_body VARCHAR NOT NULL DEFAULT '',
+    latency_ms FLOAT NOT NULL,
+    error VARCHAR NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX request_journal_request_id_idx ON request_journal (request_id);
+CREATE INDEX request_journal_created_at_idx ON request_journal (created_at);
+
+CREATE TYPE direction AS ENUM ('debit', 'credit');
+
+CREATE TYPE payout_status AS ENUM ('pending', 'in_transit', 'paid', 'failed');
+
+CREATE TABLE payouts (
+    id SERIAL NOT NULL PRIMARY KEY,
+    merchant_id INT NOT NULL,
+    currency VARCHAR NOT NULL,
+    amount FLOAT NOT NULL CHECK (amount > 0),
+    bank_account VARCHAR NOT NULL DEFAULT '',
+    status payout_status NOT NULL DEFAULT 'pending',
+    failure_reason VARCHAR NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE ledger_postings (
+    id SERIAL NOT NULL PRIMARY KEY,
+    transaction_id INT REFERENCES transactions (id),
+    payout_id INT REFERENCES payouts (id),
+    merchant_id INT NOT NULL,
+    event VARCHAR NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE ledger_entries (
+    id SERIAL NOT NULL PRIMARY KEY,
+    posting_id INT NOT NULL REFERENCES ledger_postings (id),
+    account VARCHAR NOT NULL,
+    currency VARCHAR NOT NULL,
+    direction direction NOT NULL,
+    amount FLOAT NOT NULL CHECK (amount >= 0)
+);
+
+CREATE INDEX ledger_entries_account ON ledger_entries (account, currency);
+
+-- Every posting should have debits equal to credits by the end of database transaction
+CREATE FUNCTION check_posting_balanced() RETURNS trigger AS $$
+BEGIN
+    IF abs((SELECT sum(CASE WHEN direction = 'debit' THEN amount ELSE -amount END)
+            FROM ledger_entries WHERE posting_id = NEW.posting_id)) > 0.000001 THEN
+        RAISE EXCEPTION 'posting % is unbalanced', NEW.posting_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE CONSTRAINT TRIGGER ledger_entries_balanced
+    AFTER INSERT OR UPDATE ON ledger_entries
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION check_posting_balanced();
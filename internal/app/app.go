@@ -2,16 +2,21 @@ package app
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/georgysavva/scany/pgxscan"
 	"github.com/gorilla/mux"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
@@ -19,12 +24,85 @@ import (
 type Server interface {
 	AuthUsername() string
 	AuthPassword() string
+	AuthToken() string
 
-	CreateTransaction(*Transaction) error
-	GetTransactionStatus(int) (string, error)
-	GetUserTransactionsByID(int) ([]Transaction, error)
-	GetUserTransactionsByEmail(string) ([]Transaction, error)
-	ChangeTransactionStatus(int, string) error
+	CreateTransaction(context.Context, *Transaction) error
+	CreateTransactions(context.Context, []*Transaction) error
+	ExportTransactions(context.Context, ExportFilter, func(*Transaction) error) error
+	GetTransaction(context.Context, int) (*Transaction, error)
+	GetTransactionStatus(context.Context, int) (string, error)
+	GetUserTransactionsByID(context.Context, int) ([]Transaction, error)
+	GetUserTransactionsByEmail(context.Context, string) ([]Transaction, error)
+	ChangeTransactionStatus(context.Context, int, string) error
+	UpdateTransaction(context.Context, int, TransactionUpdate) (*Transaction, error)
+	ChangeTransactionStatuses(context.Context, []Transaction, bool) ([]error, error)
+
+	CloseSettlements(context.Context, time.Time) ([]Settlement, error)
+	GetSettlements(context.Context, SettlementFilter) ([]Settlement, error)
+	GetSettlementLines(context.Context, int) ([]SettlementLine, error)
+
+	GetBalances(context.Context, LedgerFilter) ([]Balance, error)
+	GetLedgerEntries(context.Context, LedgerFilter) ([]LedgerEntry, error)
+
+	CreateFeeSchedule(context.Context, *FeeSchedule) error
+	GetFeeSchedules(context.Context, *int) ([]FeeSchedule, error)
+	DeleteFeeSchedule(context.Context, int) error
+
+	CreatePayout(context.Context, *Payout) error
+	PayoutBalances(context.Context) ([]Payout, error)
+	AdvancePayouts(context.Context) ([]Payout, error)
+	GetPayout(context.Context, int) (*Payout, error)
+	GetPayouts(context.Context, PayoutFilter) ([]Payout, error)
+
+	OpenDispute(context.Context, int, string) (*Dispute, error)
+	SubmitDisputeEvidence(context.Context, int, string) (*Dispute, error)
+	ResolveDispute(context.Context, int, string) (*Dispute, error)
+	ExpireDisputes(context.Context) ([]Dispute, error)
+	GetDispute(context.Context, int) (*Dispute, error)
+	GetDisputes(context.Context, DisputeFilter) ([]Dispute, error)
+
+	CreatePaymentMethod(context.Context, *PaymentMethod) error
+	GetPaymentMethod(context.Context, int) (*PaymentMethod, error)
+
+	CreateCustomer(context.Context, *Customer) error
+	GetCustomer(context.Context, int) (*Customer, error)
+	GetCustomers(context.Context, CustomerFilter) ([]Customer, error)
+	UpdateCustomer(context.Context, int, CustomerUpdate) (*Customer, error)
+	DeleteCustomer(context.Context, int) error
+	SavePaymentMethod(context.Context, int, *PaymentMethod) error
+	GetCustomerPaymentMethods(context.Context, int) ([]PaymentMethod, error)
+	DetachPaymentMethod(context.Context, int, int) error
+
+	GetChallenge(context.Context, string) (*Transaction, error)
+	CompleteChallenge(context.Context, string, bool) (*Transaction, error)
+
+	TokenizeCard(context.Context, *CardToken, *CardData) error
+	GetCardToken(context.Context, string) (*CardToken, error)
+	DetokenizeCard(context.Context, string) (*CardData, error)
+
+	CreatePlan(context.Context, *Plan) error
+	GetPlans(context.Context) ([]Plan, error)
+	CreateSubscription(context.Context, *Subscription) error
+	UpdateSubscription(context.Context, int, SubscriptionUpdate) (*Subscription, error)
+	CancelSubscription(context.Context, int) (*Subscription, error)
+	GetSubscription(context.Context, int) (*Subscription, error)
+	GetSubscriptions(context.Context, SubscriptionFilter) ([]Subscription, error)
+	GetSubscriptionCharges(context.Context, int) ([]SubscriptionCharge, error)
+	BillSubscriptions(context.Context) ([]SubscriptionCharge, error)
+
+	CreateScenario(context.Context, *Scenario) error
+	GetScenarios(context.Context) ([]Scenario, error)
+	GetScenarioRun(context.Context, int) (*ScenarioRun, error)
+	AdvanceScenarios(context.Context) ([]ScenarioStepResult, error)
+
+	ProxyRequest(context.Context, *ProxiedRequest) (*ProxiedResponse, error)
+
+	RecordRequest(*JournalEntry)
+	GetJournal(context.Context, JournalFilter) ([]JournalEntry, error)
+
+	RunScheduledJobs(context.Context) (*JobsReport, error)
+
+	PoolStats() *PoolStats
 }
 
 type ApiServer struct {
@@ -33,7 +111,21 @@ type ApiServer struct {
 	auth     struct {
 		username string
 		password string
+		token    string
 	}
+	webhooks    *webhookSender
+	payoutRules []payoutRule
+	// Base of links to pages served by paymulator
+	publicURL string
+	vault     *vault
+	// Record/replay proxy of a real provider
+	proxy *cassette
+	// Journal of API calls, nil if disabled
+	journal *journal
+
+	// Last business day closed by scheduler
+	settlementMu   sync.Mutex
+	settledThrough time.Time
 }
 
 var api Server
@@ -46,8 +138,12 @@ func StartServer() error {
 
 	router := mux.NewRouter()
 
+	// Export transactions, registered before "/transactions/{id}" to take precedence
+	router.Handle("/transactions/export", loggingHandler(limit(errorHandler(ExportTransactionsHandler())))).Methods("GET")
 	// Check transaction status
 	router.Handle("/transactions/{id}", loggingHandler(limit(errorHandler(GetTransactionStatusHandler())))).Methods("GET")
+	// Change metadata and merchant reference of transaction
+	router.Handle("/transactions/{id}", loggingHandler(limit(errorHandler(UpdateTransactionHandler())))).Methods("PATCH")
 	// Get Uset transactions by ID or email
 	router.Handle("/transactions", loggingHandler(limit(errorHandler(GetUserTransactionsHandler())))).Methods("GET")
 	// Create transaction
@@ -56,7 +152,144 @@ func StartServer() error {
 	router.Handle("/transaction", loggingHandler(limit(basicAuth(errorHandler(ChangeTransactionStatusHandler()))))).Methods("PUT")
 	// Cancel transaction
 	router.Handle("/transaction/{id}", loggingHandler(limit(errorHandler(CancelTransactionHandler())))).Methods("PUT")
+	// Create transactions in bulk
+	router.Handle("/transactions/batch", loggingHandler(limit(errorHandler(CreateTransactionsBatchHandler())))).Methods("POST")
+	// Change transaction statuses in bulk
+	router.Handle("/transactions/batch", loggingHandler(limit(basicAuth(errorHandler(ChangeTransactionStatusesBatchHandler()))))).Methods("PUT")
+	// Close business day
+	router.Handle("/settlements", loggingHandler(limit(basicAuth(errorHandler(CloseSettlementsHandler()))))).Methods("POST")
+	// List settlements
+	router.Handle("/settlements", loggingHandler(limit(errorHandler(GetSettlementsHandler())))).Methods("GET")
+	// List transactions of settlement
+	router.Handle("/settlements/{id}/lines", loggingHandler(limit(errorHandler(GetSettlementLinesHandler())))).Methods("GET")
+	// Account balances
+	router.Handle("/balances", loggingHandler(limit(errorHandler(GetBalancesHandler())))).Methods("GET")
+	// Ledger entries
+	router.Handle("/ledger/entries", loggingHandler(limit(errorHandler(GetLedgerEntriesHandler())))).Methods("GET")
+	// Fee schedules
+	router.Handle("/fee-schedules", loggingHandler(limit(basicAuth(errorHandler(CreateFeeScheduleHandler()))))).Methods("POST")
+	router.Handle("/fee-schedules", loggingHandler(limit(errorHandler(GetFeeSchedulesHandler())))).Methods("GET")
+	router.Handle("/fee-schedules/{id}", loggingHandler(limit(basicAuth(errorHandler(DeleteFeeScheduleHandler()))))).Methods("DELETE")
+	// Create payout
+	router.Handle("/payouts", loggingHandler(limit(basicAuth(errorHandler(CreatePayoutHandler()))))).Methods("POST")
+	// List payouts
+	router.Handle("/payouts", loggingHandler(limit(errorHandler(GetPayoutsHandler())))).Methods("GET")
+	// Get payout
+	router.Handle("/payouts/{id}", loggingHandler(limit(errorHandler(GetPayoutHandler())))).Methods("GET")
+	// Open dispute
+	router.Handle("/disputes", loggingHandler(limit(basicAuth(errorHandler(OpenDisputeHandler()))))).Methods("POST")
+	// List disputes
+	router.Handle("/disputes", loggingHandler(limit(errorHandler(GetDisputesHandler())))).Methods("GET")
+	// Get dispute
+	router.Handle("/disputes/{id}", loggingHandler(limit(errorHandler(GetDisputeHandler())))).Methods("GET")
+	// Resolve dispute
+	router.Handle("/disputes/{id}", loggingHandler(limit(basicAuth(errorHandler(ResolveDisputeHandler()))))).Methods("PUT")
+	// Submit dispute evidence
+	router.Handle("/disputes/{id}/evidence", loggingHandler(limit(errorHandler(SubmitDisputeEvidenceHandler())))).Methods("POST")
+	// Create payment method
+	router.Handle("/payment-methods", loggingHandler(limit(errorHandler(CreatePaymentMethodHandler())))).Methods("POST")
+	// Get payment method
+	router.Handle("/payment-methods/{id}", loggingHandler(limit(errorHandler(GetPaymentMethodHandler())))).Methods("GET")
+	// Customers and their saved payment methods, changed by payment system only
+	router.Handle("/customers", loggingHandler(limit(basicAuth(errorHandler(CreateCustomerHandler()))))).Methods("POST")
+	router.Handle("/customers", loggingHandler(limit(errorHandler(GetCustomersHandler())))).Methods("GET")
+	router.Handle("/customers/{id}", loggingHandler(limit(errorHandler(GetCustomerHandler())))).Methods("GET")
+	router.Handle("/customers/{id}", loggingHandler(limit(basicAuth(errorHandler(UpdateCustomerHandler()))))).Methods("PATCH")
+	router.Handle("/customers/{id}", loggingHandler(limit(basicAuth(errorHandler(DeleteCustomerHandler()))))).Methods("DELETE")
+	router.Handle("/customers/{id}/transactions", loggingHandler(limit(errorHandler(GetCustomerTransactionsHandler())))).Methods("GET")
+	router.Handle("/customers/{id}/payment-methods", loggingHandler(limit(basicAuth(errorHandler(SavePaymentMethodHandler()))))).Methods("POST")
+	router.Handle("/customers/{id}/payment-methods", loggingHandler(limit(errorHandler(GetCustomerPaymentMethodsHandler())))).Methods("GET")
+	router.Handle("/customers/{id}/payment-methods/{pm_id}", loggingHandler(limit(basicAuth(errorHandler(DetachPaymentMethodHandler()))))).Methods("DELETE")
+	// 3-D Secure challenge page
+	router.Handle("/3ds/{token}", loggingHandler(limit(errorHandler(ChallengePageHandler())))).Methods("GET")
+	router.Handle("/3ds/{token}", loggingHandler(limit(errorHandler(CompleteChallengeHandler())))).Methods("POST")
+	// Card vault
+	router.Handle("/vault/tokens", loggingHandler(limit(errorHandler(TokenizeCardHandler())))).Methods("POST")
+	router.Handle("/vault/tokens/{token}", loggingHandler(limit(errorHandler(GetCardTokenHandler())))).Methods("GET")
+	router.Handle("/vault/tokens/{token}/detokenize", loggingHandler(limit(basicAuth(errorHandler(DetokenizeCardHandler()))))).Methods("POST")
+	// Subscription plans
+	router.Handle("/plans", loggingHandler(limit(basicAuth(errorHandler(CreatePlanHandler()))))).Methods("POST")
+	router.Handle("/plans", loggingHandler(limit(errorHandler(GetPlansHandler())))).Methods("GET")
+	// Subscriptions
+	router.Handle("/subscriptions", loggingHandler(limit(errorHandler(CreateSubscriptionHandler())))).Methods("POST")
+	router.Handle("/subscriptions", loggingHandler(limit(errorHandler(GetSubscriptionsHandler())))).Methods("GET")
+	router.Handle("/subscriptions/{id}", loggingHandler(limit(errorHandler(GetSubscriptionHandler())))).Methods("GET")
+	router.Handle("/subscriptions/{id}", loggingHandler(limit(errorHandler(UpdateSubscriptionHandler())))).Methods("PUT")
+	router.Handle("/subscriptions/{id}", loggingHandler(limit(errorHandler(CancelSubscriptionHandler())))).Methods("DELETE")
+	router.Handle("/subscriptions/{id}/charges", loggingHandler(limit(errorHandler(GetSubscriptionChargesHandler())))).Methods("GET")
+	// Scenarios scripting transaction lifecycle
+	router.Handle("/scenarios", loggingHandler(limit(basicAuth(errorHandler(CreateScenarioHandler()))))).Methods("POST")
+	router.Handle("/scenarios", loggingHandler(limit(errorHandler(GetScenariosHandler())))).Methods("GET")
+	router.Handle("/transactions/{id}/scenario", loggingHandler(limit(errorHandler(GetScenarioRunHandler())))).Methods("GET")
+	// Virtual clock
+	router.Handle("/clock", loggingHandler(limit(errorHandler(GetClockHandler())))).Methods("GET")
+	router.Handle("/clock", loggingHandler(limit(basicAuth(errorHandler(ChangeClockHandler()))))).Methods("PUT")
+	// Import settlement file
+	router.Handle("/reconciliations", loggingHandler(limit(basicAuth(errorHandler(ImportReconciliationHandler()))))).Methods("POST")
+	// GraphQL queries and mutations
+	router.Handle("/graphql", loggingHandler(limit(errorHandler(GraphQLHandler())))).Methods("POST")
+	// Record or replay provider interactions
+	router.PathPrefix(proxyPrefix + "/").Handler(loggingHandler(limit(errorHandler(ProxyHandler()))))
+	// Subscribe to transaction status changes
+	router.Handle("/ws/transactions", loggingHandler(limit(errorHandler(SubscribeTransactionsHandler())))).Methods("GET")
+	// Journal of API calls
+	router.Handle("/admin/requests", loggingHandler(limit(basicAuth(errorHandler(GetJournalHandler()))))).Methods("GET")
+
+	// Inject latency and faults, applied to matched routes so rules can refer to their templates
+	chaosRules, err = parseChaosRules(os.Getenv("CHAOS_RULES"))
+	if err != nil {
+		return err
+	}
+	// Prometheus metrics
+	router.Handle("/metrics", loggingHandler(errorHandler(MetricsHandler()))).Methods("GET")
+
+	tracer, err = newTracer(
+		os.Getenv("OTEL_TRACES_EXPORTER"),
+		os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"),
+		os.Getenv("OTEL_SERVICE_NAME"),
+	)
+	if err != nil {
+		return err
+	}
+	if tracer != nil {
+		go tracer.run(ctx)
+	}
+
+	// Trace spans enclose everything else, injected faults included
+	router.Use(tracing)
+	router.Use(instrumenting)
+	// Journal every call including injected faults, so it's outside of chaos
+	router.Use(journaling)
+	router.Use(chaos)
+
+	srv, err := NewApiServer(ctx)
+	if err != nil {
+		return err
+	}
+	srv.server = http.Server{Addr: ":8080", Handler: router}
+	api = srv
+
+	go runScheduler(ctx)
 
+	lis, err := net.Listen("tcp", ":9090")
+	if err != nil {
+		return err
+	}
+	go func() {
+		log.Println("Staring gRPC server on Port 9090")
+		if err := NewGRPCServer().Serve(lis); err != nil {
+			log.Printf("gRPC server stopped - %s", err)
+		}
+	}()
+
+	log.Println("Staring server on Port 8080")
+	err = http.ListenAndServe(":8080", router)
+	return err
+}
+
+// NewApiServer connects to the database configured by environment
+func NewApiServer(ctx context.Context) (*ApiServer, error) {
 	connStr := fmt.Sprintf("postgresql://%s:%s@%s:%s/%s?connect_timeout=5",
 		os.Getenv("DB_USERNAME"),
 		os.Getenv("DB_PASSWORD"),
@@ -67,32 +300,59 @@ func StartServer() error {
 
 	dbConn, err := NewDB(ctx, connStr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	api = &ApiServer{
-		http.Server{Addr: ":8080", Handler: router},
-		dbConn,
-		struct {
-			username string
-			password string
-		}{
-			os.Getenv("PAYMENT_SYSTEM_USERNAME"),
-			os.Getenv("PAYMENT_SYSTEM_PASSWORD"),
-		},
+	s := &ApiServer{database: dbConn}
+	s.auth.username = os.Getenv("PAYMENT_SYSTEM_USERNAME")
+	s.auth.password = os.Getenv("PAYMENT_SYSTEM_PASSWORD")
+	s.auth.token = os.Getenv("WS_ACCESS_TOKEN")
+	s.publicURL = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	if s.publicURL == "" {
+		s.publicURL = "http://localhost:8080"
 	}
-
-	log.Println("Staring server on Port 8080")
-	err = http.ListenAndServe(":8080", router)
-	return err
+	s.webhooks = newWebhookSender(os.Getenv("WEBHOOK_URL"), os.Getenv("WEBHOOK_SECRET"))
+	s.payoutRules, err = parsePayoutRules(os.Getenv("PAYOUT_RULES"))
+	if err != nil {
+		return nil, err
+	}
+	// Days before start aren't closed by scheduler, like before
+	s.settledThrough = businessDay(clock.Now()).AddDate(0, 0, -1)
+	s.vault, err = newVault(os.Getenv("VAULT_KEY"))
+	if err != nil {
+		return nil, err
+	}
+	s.proxy, err = newCassette(
+		os.Getenv("PROXY_MODE"),
+		os.Getenv("PROXY_TARGET"),
+		os.Getenv("PROXY_CASSETTE"),
+		os.Getenv("PROXY_MATCH"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.journal, err = newJournal(os.Getenv("JOURNAL_RETENTION"))
+	if err != nil {
+		return nil, err
+	}
+	if s.journal != nil {
+		go s.runJournal(ctx)
+	}
+	return s, nil
 }
 
 func NewDB(ctx context.Context, connStr string) (*pgxpool.Pool, error) {
 	log.Printf("Trying to connect to %s\n", connStr)
-	var (
-		conn *pgxpool.Pool
-		err  error
-	)
+	config, err := pgxpool.ParseConfig(connStr)
+	if err != nil {
+		return nil, err
+	}
+	// Queries are traced through pgx logging, it's done on info level
+	if tracer != nil {
+		config.ConnConfig.Logger = queryTracer{}
+		config.ConnConfig.LogLevel = pgx.LogLevelInfo
+	}
+	var conn *pgxpool.Pool
 
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
@@ -105,7 +365,7 @@ LOOP:
 			return nil, fmt.Errorf("db connection failed after %s timeout", timeout)
 
 		case <-ticker.C:
-			conn, err = pgxpool.Connect(ctx, connStr)
+			conn, err = pgxpool.ConnectConfig(ctx, config)
 			if err == nil {
 				break LOOP
 			}
@@ -123,6 +383,35 @@ LOOP:
 	return conn, nil
 }
 
+// transactionColumns lists columns in the order scanTransaction expects them
+const transactionColumns = "id, coalesce(customer_id, 0), user_id, email, amount, currency, created_at, changed_at, transaction_status, merchant_id, fee, net_amount, " +
+	"coalesce(payment_method_id, 0), payment_method, decline_code, return_url, metadata, coalesce(merchant_reference, '')"
+
+func scanTransaction(row pgx.Row, t *Transaction) error {
+	// Decoded JSON is merged into existing map, rows are often scanned into the same transaction
+	t.Metadata = nil
+	return row.Scan(
+		&t.ID,
+		&t.CustomerID,
+		&t.UserID,
+		&t.Email,
+		&t.Amount,
+		&t.Currency,
+		&t.Created_at,
+		&t.Changed_at,
+		&t.Status,
+		&t.MerchantID,
+		&t.Fee,
+		&t.NetAmount,
+		&t.PaymentMethodID,
+		&t.PaymentMethodType,
+		&t.DeclineCode,
+		&t.ReturnURL,
+		&t.Metadata,
+		&t.MerchantReference,
+	)
+}
+
 func (s *ApiServer) AuthUsername() string {
 	return s.auth.username
 }
@@ -131,10 +420,29 @@ func (s *ApiServer) AuthPassword() string {
 	return s.auth.password
 }
 
-func (s *ApiServer) GetTransactionStatus(id int) (string, error) {
+func (s *ApiServer) AuthToken() string {
+	return s.auth.token
+}
+
+func (s *ApiServer) PoolStats() *PoolStats {
+	st := s.database.Stat()
+	return &PoolStats{
+		AcquiredConns:        st.AcquiredConns(),
+		IdleConns:            st.IdleConns(),
+		ConstructingConns:    st.ConstructingConns(),
+		TotalConns:           st.TotalConns(),
+		MaxConns:             st.MaxConns(),
+		AcquireCount:         st.AcquireCount(),
+		EmptyAcquireCount:    st.EmptyAcquireCount(),
+		CanceledAcquireCount: st.CanceledAcquireCount(),
+		AcquireDuration:      st.AcquireDuration(),
+	}
+}
+
+func (s *ApiServer) GetTransactionStatus(ctx context.Context, id int) (string, error) {
 	st := ""
 	q := "SELECT transaction_status FROM transactions WHERE id=" + fmt.Sprint(id)
-	err := pgxscan.Get(context.TODO(), s.database, &st, q)
+	err := pgxscan.Get(ctx, s.database, &st, q)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return "", &StatusError{http.StatusNotFound, fmt.Errorf("error: transaction not found")}
@@ -144,17 +452,34 @@ func (s *ApiServer) GetTransactionStatus(id int) (string, error) {
 	return st, nil
 }
 
-func (s *ApiServer) GetUserTransactionsByID(id int) ([]Transaction, error) {
+func (s *ApiServer) GetTransaction(ctx context.Context, id int) (*Transaction, error) {
+	t := new(Transaction)
+	err := scanTransaction(s.database.QueryRow(
+		ctx,
+		"select "+transactionColumns+" from transactions where id=$1",
+		id,
+	), t)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: transaction not found")}
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *ApiServer) GetUserTransactionsByID(ctx context.Context, id int) ([]Transaction, error) {
 	var l int
-	err := s.database.QueryRow(context.TODO(), "select count(*) from transactions where user_id="+fmt.Sprint(id)).Scan(&l)
+	err := s.database.QueryRow(ctx, "select count(*) from transactions where customer_id=(select id from customers where user_id=$1)", id).Scan(&l)
 	if err != nil {
 		return nil, err
 	}
 
 	ts := make([]Transaction, l)
 	rows, err := s.database.Query(
-		context.TODO(),
-		"select * from transactions where user_id="+fmt.Sprint(id),
+		ctx,
+		"select "+transactionColumns+" from transactions where customer_id=(select id from customers where user_id=$1)",
+		id,
 	)
 	if err != nil {
 		return nil, err
@@ -162,25 +487,17 @@ func (s *ApiServer) GetUserTransactionsByID(id int) ([]Transaction, error) {
 	defer rows.Close()
 
 	for i := 0; rows.Next(); i++ {
-		rows.Scan(
-			&ts[i].ID,
-			&ts[i].UserID,
-			&ts[i].Email,
-			&ts[i].Amount,
-			&ts[i].Currency,
-			&ts[i].Created_at,
-			&ts[i].Changed_at,
-			&ts[i].Status,
-		)
+		scanTransaction(rows, &ts[i])
 	}
 	return ts, nil
 }
 
-func (s *ApiServer) GetUserTransactionsByEmail(email string) ([]Transaction, error) {
+func (s *ApiServer) GetUserTransactionsByEmail(ctx context.Context, email string) ([]Transaction, error) {
 	var l int
 	err := s.database.QueryRow(
-		context.TODO(),
-		fmt.Sprintf("select count(*) from transactions where email='%s'", email),
+		ctx,
+		"select count(*) from transactions where customer_id in (select id from customers where email=$1)",
+		email,
 	).Scan(&l)
 	if err != nil {
 		return nil, err
@@ -188,8 +505,9 @@ func (s *ApiServer) GetUserTransactionsByEmail(email string) ([]Transaction, err
 
 	ts := make([]Transaction, l)
 	rows, err := s.database.Query(
-		context.TODO(),
-		fmt.Sprintf("select * from transactions where email='%s'", email),
+		ctx,
+		"select "+transactionColumns+" from transactions where customer_id in (select id from customers where email=$1)",
+		email,
 	)
 	if err != nil {
 		return nil, err
@@ -197,67 +515,441 @@ func (s *ApiServer) GetUserTransactionsByEmail(email string) ([]Transaction, err
 	defer rows.Close()
 
 	for i := 0; rows.Next(); i++ {
-		rows.Scan(
-			&ts[i].ID,
-			&ts[i].UserID,
-			&ts[i].Email,
-			&ts[i].Amount,
-			&ts[i].Currency,
-			&ts[i].Created_at,
-			&ts[i].Changed_at,
-			&ts[i].Status,
-		)
+		scanTransaction(rows, &ts[i])
 	}
 	return ts, nil
 }
 
-func (s *ApiServer) CreateTransaction(t *Transaction) error {
-	rand.Seed(time.Now().UTC().UnixNano())
-	switch rand.Intn(2) {
-	case 0:
-		t.Status = "НОВЫЙ"
-	case 1:
-		t.Status = "ОШИБКА"
+// randomStatus emulates payment system accepting or rejecting a new transaction
+func randomStatus() string {
+	if rand.Intn(2) == 0 {
+		return "НОВЫЙ"
 	}
-	err := s.database.QueryRow(
-		context.TODO(),
-		"insert into transactions (user_id, email, amount, currency, transaction_status) values ($1,$2,$3,$4,$5) returning id",
+	return "ОШИБКА"
+}
+
+// ExportTransactions streams transactions matching filter to fn row by row
+func (s *ApiServer) ExportTransactions(ctx context.Context, f ExportFilter, fn func(*Transaction) error) error {
+	q := "select " + transactionColumns + " from transactions where true"
+	args := make([]interface{}, 0, 2)
+	if f.CustomerID != 0 {
+		args = append(args, f.CustomerID)
+		q += fmt.Sprintf(" and customer_id=$%d", len(args))
+	}
+	if f.UserID != 0 {
+		args = append(args, f.UserID)
+		q += fmt.Sprintf(" and customer_id=(select id from customers where user_id=$%d)", len(args))
+	}
+	if f.Email != "" {
+		args = append(args, f.Email)
+		q += fmt.Sprintf(" and customer_id in (select id from customers where email=$%d)", len(args))
+	}
+	if len(f.Metadata) > 0 {
+		args = append(args, metadataJSON(f.Metadata))
+		q += fmt.Sprintf(" and metadata @> $%d", len(args))
+	}
+	if f.MerchantReference != "" {
+		args = append(args, f.MerchantReference)
+		q += fmt.Sprintf(" and merchant_reference=$%d", len(args))
+	}
+	if f.Sort == "amount" {
+		q += " order by amount"
+	} else {
+		q += " order by id"
+	}
+	if f.Order == "desc" {
+		q += " desc"
+	}
+
+	rows, err := s.database.Query(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	t := new(Transaction)
+	for rows.Next() {
+		err = scanTransaction(rows, t)
+		if err != nil {
+			return err
+		}
+		err = fn(t)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *ApiServer) CreateTransaction(ctx context.Context, t *Transaction) error {
+	tx, err := s.database.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = resolveCustomers(ctx, tx, []*Transaction{t})
+	if err != nil {
+		return err
+	}
+	err = s.redeemCardTokens(ctx, tx, []*Transaction{t})
+	if err != nil {
+		return err
+	}
+	err = authorizeTransactions(ctx, tx, []*Transaction{t}, s.publicURL)
+	if err != nil {
+		return err
+	}
+	t.Created_at = clock.Now()
+	t.Changed_at = t.Created_at
+	err = tx.QueryRow(ctx, insertTransactionQuery, insertTransactionArgs(t)...).Scan(&t.ID)
+	if err != nil {
+		return referenceConflict(err)
+	}
+	err = postLedger(ctx, tx, statusPosting(t, "", t.Status))
+	if err != nil {
+		return err
+	}
+	err = attachScenarios(ctx, tx, []*Transaction{t})
+	if err != nil {
+		return err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	transactionsCreated.Inc(t.Status, t.Currency)
+	return nil
+}
+
+const insertTransactionQuery = `insert into transactions
+	(user_id, email, amount, currency, transaction_status, merchant_id, payment_method_id, payment_method, decline_code,
+	return_url, challenge_token, created_at, changed_at, metadata, merchant_reference, customer_id)
+	values ($1,$2,$3,$4,$5,$6,nullif($7::int, 0),$8,$9,$10,nullif($11, ''),$12,$13,$14,nullif($15, ''),$16) returning id`
+
+func insertTransactionArgs(t *Transaction) []interface{} {
+	return []interface{}{
 		t.UserID,
 		t.Email,
 		t.Amount,
 		t.Currency,
 		t.Status,
-	).Scan(&t.ID)
+		t.MerchantID,
+		t.PaymentMethodID,
+		t.PaymentMethodType,
+		t.DeclineCode,
+		t.ReturnURL,
+		t.ChallengeToken,
+		t.Created_at,
+		t.Changed_at,
+		metadataJSON(t.Metadata),
+		t.MerchantReference,
+		t.CustomerID,
+	}
+}
+
+// metadataJSON encodes metadata for JSONB column, which is never null
+func metadataJSON(m map[string]string) []byte {
+	if m == nil {
+		return []byte("{}")
+	}
+	b, _ := json.Marshal(m)
+	return b
+}
+
+// referenceConflict reports duplicate merchant reference as conflict
+func referenceConflict(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "transactions_merchant_reference_key" {
+		return &StatusError{http.StatusConflict, fmt.Errorf("error: merchant_reference is already used by another transaction of the merchant")}
+	}
+	return err
+}
+
+// checkStatusTransition tells whether transaction in status can be moved to st
+func checkStatusTransition(status, st string) error {
+	switch status {
+	case "УСПЕХ", "НЕУСПЕХ":
+		return &StatusError{http.StatusConflict, fmt.Errorf("error: status '%s' can't be changed", status)}
+	case statusRequiresAction:
+		if st != "ОТМЕНЕН" {
+			return &StatusError{http.StatusConflict, fmt.Errorf("error: transaction requires 3-D Secure authentication")}
+		}
+	case "ОТМЕНЕН":
+		if st == "ОТМЕНЕН" {
+			return &StatusError{http.StatusConflict, fmt.Errorf("error: status already '%s'", status)}
+		}
+	}
+	return nil
+}
+
+// CreateTransactions inserts all transactions in a single database transaction
+// using batched statements, so either all of them are created or none
+func (s *ApiServer) CreateTransactions(ctx context.Context, ts []*Transaction) error {
+	tx, err := s.database.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = resolveCustomers(ctx, tx, ts)
+	if err != nil {
+		return err
+	}
+	err = s.redeemCardTokens(ctx, tx, ts)
+	if err != nil {
+		return err
+	}
+	err = authorizeTransactions(ctx, tx, ts, s.publicURL)
+	if err != nil {
+		return err
+	}
+	now := clock.Now()
+	batch := &pgx.Batch{}
+	for _, t := range ts {
+		t.Created_at, t.Changed_at = now, now
+		batch.Queue(insertTransactionQuery, insertTransactionArgs(t)...)
+	}
+	br := tx.SendBatch(ctx, batch)
+	for _, t := range ts {
+		err = br.QueryRow().Scan(&t.ID)
+		if err != nil {
+			br.Close()
+			return referenceConflict(err)
+		}
+	}
+	err = br.Close()
+	if err != nil {
+		return err
+	}
+
+	batch = &pgx.Batch{}
+	for _, t := range ts {
+		p := statusPosting(t, "", t.Status)
+		if p == nil {
+			continue
+		}
+		err = p.validate()
+		if err != nil {
+			return err
+		}
+		batch.Queue(postingQuery, p.args()...)
+	}
+	if batch.Len() > 0 {
+		err = tx.SendBatch(ctx, batch).Close()
+		if err != nil {
+			return err
+		}
+	}
+	err = attachScenarios(ctx, tx, ts)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit(ctx)
 	if err != nil {
 		return err
 	}
+	for _, t := range ts {
+		transactionsCreated.Inc(t.Status, t.Currency)
+	}
 	return nil
 }
 
-func (s *ApiServer) ChangeTransactionStatus(id int, st string) error {
-	status := ""
-	q := "SELECT transaction_status FROM transactions WHERE id=" + fmt.Sprint(id)
-	err := pgxscan.Get(context.TODO(), s.database, &status, q)
+func (s *ApiServer) ChangeTransactionStatus(ctx context.Context, id int, st string) error {
+	tx, err := s.database.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	t := new(Transaction)
+	err = scanTransaction(tx.QueryRow(
+		ctx,
+		"select "+transactionColumns+" from transactions where id=$1 for update",
+		id,
+	), t)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return &StatusError{http.StatusBadRequest, err}
 		}
 		return err
 	}
-	switch status {
-	case "УСПЕХ", "НЕУСПЕХ":
-		return &StatusError{http.StatusConflict, fmt.Errorf("error: status '%s' can't be changed", status)}
-	case "ОТМЕНЕН":
-		if st == "ОТМЕНЕН" {
-			return &StatusError{http.StatusConflict, fmt.Errorf("error: status already '%s'", status)}
-		}
+	err = checkStatusTransition(t.Status, st)
+	if err != nil {
+		return err
 	}
-	_, err = s.database.Exec(
-		context.TODO(),
-		fmt.Sprintf("update transactions set transaction_status='%s', changed_at=CURRENT_TIMESTAMP where id=%d", st, id),
-	)
+	c, err := applyStatus(ctx, tx, t, st)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit(ctx)
 	if err != nil {
 		return err
 	}
+	c.announce(ctx, s.webhooks)
 	return nil
 }
+
+// statusChange is what changing status of a transaction did, it's announced
+// once the database transaction is committed
+type statusChange struct {
+	event        StatusEvent
+	from         string
+	dispute      *Dispute
+	subscription *Subscription
+	// Webhook event of subscription renewal settled by the change
+	renewal string
+}
+
+// announce publishes committed status change, counts it by the status it's
+// changed from and sends its webhooks
+func (c *statusChange) announce(ctx context.Context, webhooks *webhookSender) {
+	hub.Publish(c.event)
+	statusTransitions.Inc(c.from, c.event.Status)
+	if c.dispute != nil {
+		webhooks.Send(ctx, "dispute.created", c.dispute)
+	}
+	if c.subscription != nil {
+		webhooks.Send(ctx, c.renewal, c.subscription)
+	}
+}
+
+// applyStatus moves transaction t locked by caller's database transaction to
+// status st checked by caller, and applies side effects of the new status
+func applyStatus(ctx context.Context, tx pgx.Tx, t *Transaction, st string) (*statusChange, error) {
+	c := &statusChange{event: StatusEvent{ID: t.ID, Status: st}, from: t.Status}
+	err := tx.QueryRow(
+		ctx,
+		"update transactions set transaction_status=$1, changed_at=$2 where id=$3 returning changed_at",
+		st,
+		clock.Now(),
+		t.ID,
+	).Scan(&c.event.ChangedAt)
+	if err != nil {
+		return nil, err
+	}
+	err = postLedger(ctx, tx, statusPosting(t, c.from, st))
+	if err != nil {
+		return nil, err
+	}
+	if st == "УСПЕХ" {
+		c.dispute, err = captureTransaction(ctx, tx, t)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.from == "НОВЫЙ" {
+		c.subscription, c.renewal, err = settleCharge(ctx, tx, t, st)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// UpdateTransaction changes metadata and merchant reference of transaction
+func (s *ApiServer) UpdateTransaction(ctx context.Context, id int, u TransactionUpdate) (*Transaction, error) {
+	set := make(map[string]string)
+	removed := make([]string, 0)
+	for key, val := range u.Metadata {
+		if val == "" {
+			removed = append(removed, key)
+		} else {
+			set[key] = val
+		}
+	}
+	tx, err := s.database.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// changed_at follows status, settlements pick transactions by it
+	t := new(Transaction)
+	err = scanTransaction(tx.QueryRow(
+		ctx,
+		`update transactions set metadata=(metadata || $2) - $3::text[],
+		merchant_reference=case when $4::boolean then nullif($5, '') else merchant_reference end
+		where id=$1 returning `+transactionColumns,
+		id,
+		metadataJSON(set),
+		removed,
+		u.MerchantReference != nil,
+		stringValue(u.MerchantReference),
+	), t)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: transaction not found")}
+		}
+		return nil, referenceConflict(err)
+	}
+	if len(t.Metadata) > maxMetadataKeys {
+		return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: metadata can't have more than %d keys", maxMetadataKeys)}
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// ChangeTransactionStatuses applies status changes in a single database transaction.
+// Changes breaking status rules are reported per item and skipped, unless atomic
+// is set, in which case nothing is applied.
+func (s *ApiServer) ChangeTransactionStatuses(ctx context.Context, changes []Transaction, atomic bool) ([]error, error) {
+	tx, err := s.database.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	errs := make([]error, len(changes))
+	done := make([]*statusChange, 0, len(changes))
+	failed := false
+	for i, c := range changes {
+		t := new(Transaction)
+		err = scanTransaction(tx.QueryRow(
+			ctx,
+			"select "+transactionColumns+" from transactions where id=$1 for update",
+			c.ID,
+		), t)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				errs[i] = &StatusError{http.StatusNotFound, fmt.Errorf("error: transaction not found")}
+				failed = true
+				continue
+			}
+			return nil, err
+		}
+		err = checkStatusTransition(t.Status, c.Status)
+		if err != nil {
+			errs[i] = err
+			failed = true
+			continue
+		}
+		change, err := applyStatus(ctx, tx, t, c.Status)
+		if err != nil {
+			return nil, err
+		}
+		done = append(done, change)
+	}
+	if atomic && failed {
+		return errs, nil
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range done {
+		c.announce(ctx, s.webhooks)
+	}
+	return errs, nil
+}
@@ -1,18 +1,104 @@
 package app
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/stretchr/testify/require"
 )
 
-type MockServer struct{}
+// fakeTx answers queries of a database transaction with rows keyed by a
+// fragment of their SQL, other queries find no rows. Executed SQL is recorded.
+type fakeTx struct {
+	pgx.Tx
+	rows    map[string][]interface{}
+	queries []string
+	args    [][]interface{}
+}
+
+func (tx *fakeTx) record(sql string, args []interface{}) {
+	tx.queries = append(tx.queries, sql)
+	tx.args = append(tx.args, args)
+}
+
+func (tx *fakeTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	tx.record(sql, args)
+	for fragment, values := range tx.rows {
+		if strings.Contains(sql, fragment) {
+			return fakeRow(values)
+		}
+	}
+	return fakeRow(nil)
+}
+
+func (tx *fakeTx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	tx.record(sql, args)
+	return &fakeRows{}, nil
+}
+
+func (tx *fakeTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	tx.record(sql, args)
+	return nil, nil
+}
+
+// argsOf are arguments of the first recorded query containing fragment
+func (tx *fakeTx) argsOf(fragment string) []interface{} {
+	for i, sql := range tx.queries {
+		if strings.Contains(sql, fragment) {
+			return tx.args[i]
+		}
+	}
+	return nil
+}
+
+// fakeRow scans its values by position, nil values leave destinations as they are
+type fakeRow []interface{}
+
+func (r fakeRow) Scan(dest ...interface{}) error {
+	if r == nil {
+		return pgx.ErrNoRows
+	}
+	for i, v := range r {
+		if v != nil {
+			reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(v))
+		}
+	}
+	return nil
+}
+
+// fakeRows is an empty result
+type fakeRows struct {
+	pgx.Rows
+}
+
+func (r *fakeRows) Next() bool { return false }
+func (r *fakeRows) Close()     {}
+func (r *fakeRows) Err() error { return nil }
+
+type MockServer struct {
+	// Entries recorded by journaling middleware
+	journal []*JournalEntry
+}
 
 func (ms *MockServer) AuthUsername() string {
 	return "username"
@@ -20,30 +106,469 @@ func (ms *MockServer) AuthUsername() string {
 func (ms *MockServer) AuthPassword() string {
 	return "password"
 }
+func (ms *MockServer) AuthToken() string {
+	return "token"
+}
+
+func (ms *MockServer) UpdateTransaction(ctx context.Context, id int, u TransactionUpdate) (*Transaction, error) {
+	t, err := ms.GetTransaction(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if u.MerchantReference != nil && *u.MerchantReference == "ref-2" {
+		return nil, &StatusError{http.StatusConflict, fmt.Errorf("error: merchant_reference is already used by another transaction of the merchant")}
+	}
+	t.Metadata = u.Metadata
+	return t, nil
+}
+
+func (ms *MockServer) GetTransaction(ctx context.Context, id int) (*Transaction, error) {
+	if id < 0 {
+		return nil, fmt.Errorf("Internal Server Error")
+	}
+	if id == 0 || id == 404 {
+		return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: transaction not found")}
+	}
+	if id == 9 {
+		return &Transaction{ID: id, Amount: 1.2, Currency: "USD", Status: "УСПЕХ"}, nil
+	}
+	if id == 1 {
+		return &Transaction{ID: id, Amount: 1.2, Currency: "USD", Status: "НОВЫЙ", Metadata: map[string]string{"order_id": "A-1"}}, nil
+	}
+	return &Transaction{ID: id, Amount: 1.2, Currency: "USD", Status: "НОВЫЙ"}, nil
+}
 
-func (ms *MockServer) GetTransactionStatus(id int) (string, error) {
+func (ms *MockServer) GetTransactionStatus(ctx context.Context, id int) (string, error) {
 	if id < 0 {
 		return "", fmt.Errorf("Internal Server Error")
 	}
 	return "", nil
 }
 
-func (ms *MockServer) GetUserTransactionsByID(id int) ([]Transaction, error) {
+func (ms *MockServer) GetUserTransactionsByID(ctx context.Context, id int) ([]Transaction, error) {
 	return []Transaction{{ID: 1, Amount: 1.2}, {ID: 2, Amount: 11.2}}, nil
 }
 
-func (ms *MockServer) GetUserTransactionsByEmail(email string) ([]Transaction, error) {
+func (ms *MockServer) GetUserTransactionsByEmail(ctx context.Context, email string) ([]Transaction, error) {
 	return []Transaction{{ID: 1, Amount: 1.2}, {ID: 2, Amount: 11.2}}, nil
 }
 
-func (ms *MockServer) CreateTransaction(t *Transaction) error {
+func (ms *MockServer) CreateTransaction(ctx context.Context, t *Transaction) error {
+	if t.Scenario != "" && t.Scenario != "chargeback" {
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: scenario '%s' not found", t.Scenario)}
+	}
+	return nil
+}
+
+func (ms *MockServer) CreateTransactions(ctx context.Context, ts []*Transaction) error {
+	for i, t := range ts {
+		t.ID = i + 1
+		t.Status = "НОВЫЙ"
+	}
+	return nil
+}
+
+func (ms *MockServer) ExportTransactions(ctx context.Context, f ExportFilter, fn func(*Transaction) error) error {
+	if f.Email == "down@m.com" {
+		return fmt.Errorf("error: database is down")
+	}
+	created := time.Date(2022, 6, 20, 12, 0, 0, 0, time.UTC)
+	for _, t := range []Transaction{
+		{ID: 1, CustomerID: 1, UserID: 1, Email: "exmpl@m.com", Amount: 1.2, Currency: "USD", Created_at: created, Status: "НОВЫЙ", Metadata: map[string]string{"order_id": "A-1"}},
+		{ID: 2, CustomerID: 2, UserID: 1, Email: "<exmpl>@m.com", Amount: 11.2, Currency: "RUB", Created_at: created, Status: "УСПЕХ", MerchantReference: "ref-2"},
+	} {
+		matches := (f.MerchantReference == "" || f.MerchantReference == t.MerchantReference) &&
+			(f.CustomerID == 0 || f.CustomerID == t.CustomerID)
+		for key, val := range f.Metadata {
+			matches = matches && t.Metadata[key] == val
+		}
+		if !matches {
+			continue
+		}
+		if err := fn(&t); err != nil {
+			return err
+		}
+		if f.Email == "reset@m.com" {
+			return fmt.Errorf("error: connection reset")
+		}
+	}
+	return nil
+}
+
+func (ms *MockServer) ChangeTransactionStatus(ctx context.Context, id int, st string) error {
+	return nil
+}
+
+func (ms *MockServer) ChangeTransactionStatuses(ctx context.Context, changes []Transaction, atomic bool) ([]error, error) {
+	errs := make([]error, len(changes))
+	for i, c := range changes {
+		if c.ID == 2 {
+			errs[i] = &StatusError{http.StatusConflict, fmt.Errorf("error: status 'УСПЕХ' can't be changed")}
+		}
+	}
+	return errs, nil
+}
+
+func (ms *MockServer) CloseSettlements(ctx context.Context, day time.Time) ([]Settlement, error) {
+	return []Settlement{{ID: 1, BusinessDate: day.Format(businessDateLayout), SuccessCount: 1, SuccessAmount: 1.2}}, nil
+}
+
+func (ms *MockServer) GetSettlements(ctx context.Context, f SettlementFilter) ([]Settlement, error) {
+	return []Settlement{{ID: 1, Currency: "USD"}, {ID: 2, Currency: "RUB"}}, nil
+}
+
+func (ms *MockServer) GetSettlementLines(ctx context.Context, id int) ([]SettlementLine, error) {
+	if id != 1 {
+		return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: settlement not found")}
+	}
+	return []SettlementLine{{ID: 1, SettlementID: 1, TransactionID: 1, Status: "УСПЕХ", Amount: 1.2}}, nil
+}
+
+func (ms *MockServer) GetBalances(ctx context.Context, f LedgerFilter) ([]Balance, error) {
+	return []Balance{
+		{Account: "customer:1", Currency: "USD", Balance: -1.2},
+		{Account: "merchant:1:pending", Currency: "USD", Balance: 1.2},
+	}, nil
+}
+
+func (ms *MockServer) GetLedgerEntries(ctx context.Context, f LedgerFilter) ([]LedgerEntry, error) {
+	p := transfer(&Transaction{ID: 1, UserID: 1, MerchantID: 1, Currency: "USD"}, "authorize", "customer:1", "merchant:1:pending", 1.2)
+	entries := make([]LedgerEntry, len(p.lines))
+	for i, l := range p.lines {
+		entries[i] = LedgerEntry{ID: i + 1, PostingID: 1, TransactionID: p.transactionID, MerchantID: p.merchantID,
+			Event: p.event, Account: l.account, Currency: p.currency, Direction: l.direction, Amount: l.amount}
+	}
+	return entries, nil
+}
+
+func (ms *MockServer) CreateFeeSchedule(ctx context.Context, fs *FeeSchedule) error {
+	fs.ID = 1
+	return nil
+}
+
+func (ms *MockServer) GetFeeSchedules(ctx context.Context, merchantID *int) ([]FeeSchedule, error) {
+	return []FeeSchedule{{ID: 1, MerchantID: 1, Percent: 2.5, Fixed: 0.3}}, nil
+}
+
+func (ms *MockServer) DeleteFeeSchedule(ctx context.Context, id int) error {
+	if id != 1 {
+		return &StatusError{http.StatusNotFound, fmt.Errorf("error: fee schedule not found")}
+	}
+	return nil
+}
+
+func (ms *MockServer) CreatePayout(ctx context.Context, p *Payout) error {
+	if p.Amount > 100 {
+		return &StatusError{http.StatusConflict, fmt.Errorf("error: available balance is 100 %s", p.Currency)}
+	}
+	p.ID, p.Status = 1, payoutPending
+	return nil
+}
+
+func (ms *MockServer) PayoutBalances(ctx context.Context) ([]Payout, error) {
+	return []Payout{}, nil
+}
+
+func (ms *MockServer) AdvancePayouts(ctx context.Context) ([]Payout, error) {
+	return []Payout{}, nil
+}
+
+func (ms *MockServer) GetPayout(ctx context.Context, id int) (*Payout, error) {
+	if id != 1 {
+		return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: payout not found")}
+	}
+	return &Payout{ID: 1, MerchantID: 1, Currency: "USD", Amount: 100, Status: payoutPaid}, nil
+}
+
+func (ms *MockServer) GetPayouts(ctx context.Context, f PayoutFilter) ([]Payout, error) {
+	return []Payout{{ID: 1, MerchantID: 1, Currency: "USD", Amount: 100, Status: payoutPaid}}, nil
+}
+
+func (ms *MockServer) OpenDispute(ctx context.Context, transactionID int, reason string) (*Dispute, error) {
+	t, err := ms.GetTransaction(ctx, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	if t.Status != "УСПЕХ" {
+		return nil, &StatusError{http.StatusConflict, fmt.Errorf("error: only successful transactions can be disputed")}
+	}
+	return &Dispute{ID: 1, TransactionID: t.ID, ReasonCode: reason, Status: disputeNeedsResponse}, nil
+}
+
+func (ms *MockServer) SubmitDisputeEvidence(ctx context.Context, id int, evidence string) (*Dispute, error) {
+	d, err := ms.GetDispute(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	d.Status, d.Evidence = disputeUnderReview, evidence
+	return d, nil
+}
+
+func (ms *MockServer) ResolveDispute(ctx context.Context, id int, status string) (*Dispute, error) {
+	d, err := ms.GetDispute(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	d.Status = status
+	return d, nil
+}
+
+func (ms *MockServer) ExpireDisputes(ctx context.Context) ([]Dispute, error) {
+	return []Dispute{}, nil
+}
+
+func (ms *MockServer) GetDispute(ctx context.Context, id int) (*Dispute, error) {
+	switch id {
+	case 1:
+		return &Dispute{ID: 1, TransactionID: 9, ReasonCode: "fraudulent", Status: disputeNeedsResponse}, nil
+	case 2:
+		return nil, &StatusError{http.StatusConflict, fmt.Errorf("error: dispute is already lost")}
+	}
+	return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: dispute not found")}
+}
+
+func (ms *MockServer) GetDisputes(ctx context.Context, f DisputeFilter) ([]Dispute, error) {
+	switch f.TransactionID {
+	case 0:
+	case 1:
+		return []Dispute{{ID: 2, TransactionID: 1, Amount: 1.2, Currency: "USD", ReasonCode: "fraudulent", Status: disputeLost}}, nil
+	default:
+		return []Dispute{}, nil
+	}
+	return []Dispute{{ID: 1, TransactionID: 9, ReasonCode: "fraudulent", Status: disputeNeedsResponse}}, nil
+}
+
+func (ms *MockServer) CreatePaymentMethod(ctx context.Context, pm *PaymentMethod) error {
+	pm.ID = 1
+	return nil
+}
+
+func (ms *MockServer) GetPaymentMethod(ctx context.Context, id int) (*PaymentMethod, error) {
+	if id != 1 {
+		return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: payment method not found")}
+	}
+	return &PaymentMethod{ID: 1, Type: methodWallet, Wallet: &WalletDetails{Provider: "paypal"}}, nil
+}
+
+func (ms *MockServer) CreateCustomer(ctx context.Context, c *Customer) error {
+	if c.UserID == 1 {
+		return &StatusError{http.StatusConflict, fmt.Errorf("error: customer with this user_id already exists")}
+	}
+	c.ID = 2
+	return nil
+}
+
+func (ms *MockServer) GetCustomer(ctx context.Context, id int) (*Customer, error) {
+	if id != 1 && id != 2 {
+		return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: customer not found")}
+	}
+	return &Customer{ID: id, UserID: id, Email: "exmpl@m.com"}, nil
+}
+
+func (ms *MockServer) GetCustomers(ctx context.Context, f CustomerFilter) ([]Customer, error) {
+	c, _ := ms.GetCustomer(ctx, 1)
+	return []Customer{*c}, nil
+}
+
+func (ms *MockServer) UpdateCustomer(ctx context.Context, id int, u CustomerUpdate) (*Customer, error) {
+	c, err := ms.GetCustomer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if u.Email != nil {
+		c.Email = *u.Email
+	}
+	if u.Name != nil {
+		c.Name = *u.Name
+	}
+	return c, nil
+}
+
+func (ms *MockServer) DeleteCustomer(ctx context.Context, id int) error {
+	if id == 1 {
+		return &StatusError{http.StatusConflict, fmt.Errorf("error: customer has transactions or subscriptions and can't be deleted")}
+	}
+	_, err := ms.GetCustomer(ctx, id)
+	return err
+}
+
+func (ms *MockServer) SavePaymentMethod(ctx context.Context, customerID int, pm *PaymentMethod) error {
+	_, err := ms.GetCustomer(ctx, customerID)
+	if err != nil {
+		return err
+	}
+	pm.ID, pm.CustomerID = 2, customerID
+	return nil
+}
+
+func (ms *MockServer) GetCustomerPaymentMethods(ctx context.Context, customerID int) ([]PaymentMethod, error) {
+	_, err := ms.GetCustomer(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	return []PaymentMethod{{ID: 2, CustomerID: customerID, Type: methodWallet, Wallet: &WalletDetails{Provider: "paypal"}}}, nil
+}
+
+func (ms *MockServer) DetachPaymentMethod(ctx context.Context, customerID, id int) error {
+	if customerID != 1 || id != 2 {
+		return &StatusError{http.StatusNotFound, fmt.Errorf("error: payment method not found")}
+	}
+	return nil
+}
+
+func (ms *MockServer) GetChallenge(ctx context.Context, token string) (*Transaction, error) {
+	if token != "token" {
+		return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: challenge not found")}
+	}
+	return &Transaction{ID: 5, Amount: 10, Currency: "RUB", Status: statusRequiresAction}, nil
+}
+
+func (ms *MockServer) CompleteChallenge(ctx context.Context, token string, approve bool) (*Transaction, error) {
+	t, err := ms.GetChallenge(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	// Only approved one has somewhere to return
+	if approve {
+		t.Status, t.ReturnURL = "НОВЫЙ", "https://shop.example/return?order=1"
+	} else {
+		t.Status, t.DeclineCode = "ОШИБКА", declineAuthenticationFailed
+	}
+	return t, nil
+}
+
+func (ms *MockServer) TokenizeCard(ctx context.Context, ct *CardToken, data *CardData) error {
+	ct.Token = "tok_1"
+	return nil
+}
+
+func (ms *MockServer) GetCardToken(ctx context.Context, token string) (*CardToken, error) {
+	if token != "tok_1" {
+		return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: card token not found")}
+	}
+	return &CardToken{Token: token, Card: CardDetails{Brand: "visa", Last4: "4242", ExpMonth: 12, ExpYear: 2030}}, nil
+}
+
+func (ms *MockServer) DetokenizeCard(ctx context.Context, token string) (*CardData, error) {
+	if _, err := ms.GetCardToken(ctx, token); err != nil {
+		return nil, err
+	}
+	return &CardData{Number: "4242424242424242", ExpMonth: 12, ExpYear: 2030}, nil
+}
+
+func (ms *MockServer) CreatePlan(ctx context.Context, p *Plan) error {
+	p.ID = 1
+	return nil
+}
+
+func (ms *MockServer) GetPlans(ctx context.Context) ([]Plan, error) {
+	return []Plan{{ID: 1, Name: "basic", Amount: 10, Currency: "RUB", Interval: "month", IntervalCount: 1}}, nil
+}
+
+func (ms *MockServer) CreateSubscription(ctx context.Context, sub *Subscription) error {
+	if sub.PlanID != 1 {
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: plan %d not found", sub.PlanID)}
+	}
+	sub.ID, sub.Status = 1, subscriptionActive
 	return nil
 }
 
-func (ms *MockServer) ChangeTransactionStatus(id int, st string) error {
+func (ms *MockServer) UpdateSubscription(ctx context.Context, id int, u SubscriptionUpdate) (*Subscription, error) {
+	sub, err := ms.GetSubscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if u.PlanID != nil {
+		sub.PlanID = *u.PlanID
+	}
+	if u.CancelAtPeriodEnd != nil {
+		sub.CancelAtPeriodEnd = *u.CancelAtPeriodEnd
+	}
+	return sub, nil
+}
+
+func (ms *MockServer) CancelSubscription(ctx context.Context, id int) (*Subscription, error) {
+	sub, err := ms.GetSubscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	sub.Status = subscriptionCanceled
+	return sub, nil
+}
+
+func (ms *MockServer) GetSubscription(ctx context.Context, id int) (*Subscription, error) {
+	if id != 1 {
+		return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: subscription not found")}
+	}
+	return &Subscription{ID: 1, PlanID: 1, UserID: 1, Email: "a@b.c", Status: subscriptionActive}, nil
+}
+
+func (ms *MockServer) GetSubscriptions(ctx context.Context, f SubscriptionFilter) ([]Subscription, error) {
+	return []Subscription{}, nil
+}
+
+func (ms *MockServer) GetSubscriptionCharges(ctx context.Context, id int) ([]SubscriptionCharge, error) {
+	if _, err := ms.GetSubscription(ctx, id); err != nil {
+		return nil, err
+	}
+	return []SubscriptionCharge{{ID: 1, SubscriptionID: id, Amount: 10, Status: chargePaid}}, nil
+}
+
+func (ms *MockServer) BillSubscriptions(ctx context.Context) ([]SubscriptionCharge, error) {
+	return []SubscriptionCharge{}, nil
+}
+
+func (ms *MockServer) CreateScenario(ctx context.Context, sc *Scenario) error {
+	if sc.Name == "chargeback" {
+		return &StatusError{http.StatusConflict, fmt.Errorf("error: scenario '%s' already exists", sc.Name)}
+	}
 	return nil
 }
 
+func (ms *MockServer) GetScenarios(ctx context.Context) ([]Scenario, error) {
+	return []Scenario{{Name: "chargeback", Steps: []ScenarioStep{{After: "2s", Status: "УСПЕХ"}, {After: "10s", Dispute: "fraudulent"}}}}, nil
+}
+
+func (ms *MockServer) GetScenarioRun(ctx context.Context, id int) (*ScenarioRun, error) {
+	if id != 1 {
+		return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: transaction has no scenario")}
+	}
+	return &ScenarioRun{TransactionID: 1, Scenario: "chargeback", Status: scenarioRunning, NextStep: 1}, nil
+}
+
+func (ms *MockServer) AdvanceScenarios(ctx context.Context) ([]ScenarioStepResult, error) {
+	return []ScenarioStepResult{}, nil
+}
+
+func (ms *MockServer) ProxyRequest(ctx context.Context, r *ProxiedRequest) (*ProxiedResponse, error) {
+	if r.Path != "/v1/charges" {
+		return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: no recorded interaction matches %s %s", r.Method, r.Path)}
+	}
+	return &ProxiedResponse{Status: http.StatusPaymentRequired, Header: http.Header{"X-Provider": {"sandbox"}}, Body: `{"error": "card_declined"}`}, nil
+}
+
+func (ms *MockServer) RecordRequest(e *JournalEntry) {
+	ms.journal = append(ms.journal, e)
+}
+
+func (ms *MockServer) GetJournal(ctx context.Context, f JournalFilter) ([]JournalEntry, error) {
+	entries := make([]JournalEntry, 0)
+	for i := len(ms.journal) - 1; i >= 0; i-- {
+		if f.RequestID == "" || ms.journal[i].RequestID == f.RequestID {
+			entries = append(entries, *ms.journal[i])
+		}
+	}
+	return entries, nil
+}
+
+func (ms *MockServer) PoolStats() *PoolStats {
+	return &PoolStats{AcquiredConns: 1, IdleConns: 3, TotalConns: 4, MaxConns: 10, AcquireCount: 42, AcquireDuration: 1500 * time.Millisecond}
+}
+
+func (ms *MockServer) RunScheduledJobs(ctx context.Context) (*JobsReport, error) {
+	return &JobsReport{}, nil
+}
+
 func TestHandlers(t *testing.T) {
 	api = &MockServer{}
 	router := mux.NewRouter()
@@ -79,10 +604,12 @@ func TestHandlers(t *testing.T) {
 		{"GET", "/transactions?user_id=1&order=badinput", nil, http.StatusBadRequest},
 		{"GET", "/transactions?user_id=1&sort=amount&order=asc&page=100", nil, http.StatusFound},
 		{"GET", "/transactions?email=example@mail.com&sort=amount&order=desc&page=NaN", nil, http.StatusBadRequest},
+		{"GET", "/transactions?email=example@mail.com&page=-1", nil, http.StatusBadRequest},
 		{"POST", "/transaction", strings.NewReader("{\"user_id\": 1, \"email\": \"exmpl@m.com\", \"amount\": 1.5, \"currency\": \"USD\"}"), http.StatusCreated},
 		{"POST", "/transaction", strings.NewReader(fmt.Sprintf("{\"user_id\": 1, \"email\": \"%s\", \"amount\": 1.5, \"currency\": \"USD\"}", strings.Repeat("a", 51))), http.StatusBadRequest},
 		{"POST", "/transaction", strings.NewReader(fmt.Sprintf("{\"user_id\": 1, \"email\": \"exmpl@m.com\", \"amount\": 1.5, \"currency\": \"%s\"}", strings.Repeat("a", 21))), http.StatusBadRequest},
 		{"POST", "/transaction", strings.NewReader("{\"user_id\": 1, \"email\": \"exmpl@m.com\", \"amount\": 1.5}"), http.StatusBadRequest},
+		{"POST", "/transaction", strings.NewReader("{\"user_id\": 1, \"email\": \"exmpl@m.com\", \"amount\": -1.5, \"currency\": \"USD\"}"), http.StatusBadRequest},
 		{"POST", "/transaction", strings.NewReader("no]/:fie;OeFM"), http.StatusBadRequest},
 		{"PUT", "/transaction", strings.NewReader("{\"id\": 1, \"transaction_status\": \"УСПЕХ\"}"), http.StatusUnauthorized},
 		{"PUT", "/transaction/1", nil, http.StatusOK},
@@ -126,3 +653,1620 @@ func request(t *testing.T, handler http.Handler, method, target string, body io.
 	handler.ServeHTTP(rr, req)
 	require.Equal(t, code, rr.Code)
 }
+
+func TestWebSocket(t *testing.T) {
+	api = &MockServer{}
+	srv := httptest.NewServer(errorHandler(SubscribeTransactionsHandler()))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?token=token", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	msg := wsResponse{}
+	require.NoError(t, conn.WriteJSON(wsRequest{Action: "subscribe", IDs: []int{7}}))
+	require.NoError(t, conn.ReadJSON(&msg))
+	require.Equal(t, "subscribed", msg.Type)
+
+	require.NoError(t, conn.WriteJSON(wsRequest{Action: "smth"}))
+	require.NoError(t, conn.ReadJSON(&msg))
+	require.Equal(t, "error", msg.Type)
+
+	hub.Publish(StatusEvent{ID: 8, Status: "УСПЕХ"})
+	hub.Publish(StatusEvent{ID: 7, Status: "НЕУСПЕХ"})
+	msg = wsResponse{}
+	require.NoError(t, conn.ReadJSON(&msg))
+	require.Equal(t, "status", msg.Type)
+	require.Equal(t, 7, msg.Event.ID)
+	require.Equal(t, "НЕУСПЕХ", msg.Event.Status)
+}
+
+func TestHubSlowConsumer(t *testing.T) {
+	h := NewHub()
+	sub := newSubscriber(1)
+	h.Subscribe(1, sub)
+	h.Publish(StatusEvent{ID: 1})
+	h.Publish(StatusEvent{ID: 1})
+	select {
+	case <-sub.done:
+	default:
+		t.Fatal("slow subscriber wasn't dropped")
+	}
+	h.UnsubscribeAll(sub)
+	require.Empty(t, h.subs)
+}
+
+func TestCreateTransactionsBatch(t *testing.T) {
+	api = &MockServer{}
+	item := "{\"user_id\": 1, \"email\": \"exmpl@m.com\", \"amount\": 1.5, \"currency\": \"USD\"}"
+	bad := "{\"user_id\": 1, \"email\": \"exmpl@m.com\", \"amount\": 1.5}"
+	wrongType := "{\"user_id\": \"one\", \"email\": \"exmpl@m.com\", \"amount\": 1.5, \"currency\": \"USD\"}"
+	negative := "{\"user_id\": 1, \"email\": \"exmpl@m.com\", \"amount\": -1.5, \"currency\": \"USD\"}"
+
+	tc := []struct {
+		target, contentType, body string
+		code, created             int
+	}{
+		{"/transactions/batch", "application/json", "[" + item + "," + item + "]", http.StatusCreated, 2},
+		{"/transactions/batch", "application/json", "[" + item + "," + bad + "," + wrongType + "]", http.StatusMultiStatus, 1},
+		{"/transactions/batch?atomic=true", "application/json", "[" + item + "," + bad + "]", http.StatusBadRequest, 0},
+		{"/transactions/batch", "application/x-ndjson", item + "\n" + item + "\n" + item + "\n", http.StatusCreated, 3},
+		{"/transactions/batch", "application/json", "[" + bad + "]", http.StatusBadRequest, 0},
+		{"/transactions/batch", "application/json", "[" + item + "," + negative + "]", http.StatusMultiStatus, 1},
+		{"/transactions/batch", "application/json", "[]", http.StatusBadRequest, -1},
+		{"/transactions/batch", "application/json", item, http.StatusBadRequest, -1},
+		{"/transactions/batch", "application/x-ndjson", item + "\nno]/:fie;OeFM", http.StatusBadRequest, -1},
+	}
+	for _, c := range tc {
+		req := httptest.NewRequest("POST", c.target, strings.NewReader(c.body))
+		req.Header.Set("Content-Type", c.contentType)
+		rr := httptest.NewRecorder()
+		errorHandler(CreateTransactionsBatchHandler()).ServeHTTP(rr, req)
+		require.Equal(t, c.code, rr.Code, c.body)
+		if c.created < 0 {
+			continue
+		}
+		resp := struct {
+			Created int           `json:"created"`
+			Results []batchResult `json:"results"`
+		}{}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		require.Equal(t, c.created, resp.Created)
+	}
+}
+
+func TestChangeTransactionStatusesBatch(t *testing.T) {
+	api = &MockServer{}
+	handler := basicAuth(errorHandler(ChangeTransactionStatusesBatchHandler()))
+
+	tc := []struct {
+		body          string
+		code, changed int
+	}{
+		{`{"items": [{"id": 1, "transaction_status": "УСПЕХ"}, {"id": 3, "transaction_status": "НЕУСПЕХ"}]}`, http.StatusOK, 2},
+		{`{"items": [{"id": 1, "transaction_status": "УСПЕХ"}, {"id": 2, "transaction_status": "УСПЕХ"}]}`, http.StatusMultiStatus, 1},
+		{`{"items": [{"id": 1, "transaction_status": "УСПЕХ"}, {"id": 2, "transaction_status": "УСПЕХ"}], "atomic": true}`, http.StatusConflict, 0},
+		{`{"items": [{"id": 1, "transaction_status": "УСПЕХ"}, {"id": 3, "transaction_status": "SUCCESS"}], "atomic": true}`, http.StatusConflict, 0},
+		{`{"items": [{"id": 1, "transaction_status": "УСПЕХ"}, {"id": 3, "transaction_status": "SUCCESS"}]}`, http.StatusMultiStatus, 1},
+		{`{"filter": {"user_id": 1}, "transaction_status": "УСПЕХ"}`, http.StatusMultiStatus, 1},
+		{`{"filter": {"email": "exmpl@m.com", "transaction_status": "НОВЫЙ"}, "transaction_status": "УСПЕХ"}`, http.StatusBadRequest, -1},
+		{`{"filter": {}, "transaction_status": "УСПЕХ"}`, http.StatusBadRequest, -1},
+		{`{"items": []}`, http.StatusBadRequest, -1},
+		{`BadIn*p|ut`, http.StatusBadRequest, -1},
+	}
+	for _, c := range tc {
+		req := httptest.NewRequest("PUT", "/transactions/batch", strings.NewReader(c.body))
+		req.SetBasicAuth("username", "password")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		require.Equal(t, c.code, rr.Code, c.body)
+		if c.changed < 0 {
+			continue
+		}
+		resp := struct {
+			Changed int `json:"changed"`
+		}{}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		require.Equal(t, c.changed, resp.Changed, c.body)
+	}
+
+	request(t, handler, "PUT", "/transactions/batch", strings.NewReader(tc[0].body), http.StatusUnauthorized)
+}
+
+func TestExportTransactions(t *testing.T) {
+	api = &MockServer{}
+	handler := errorHandler(ExportTransactionsHandler())
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/transactions/export?user_id=1&columns=id,amount,created_at&tz=Europe/Moscow", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "id,amount,created_at\n1,1.2,2022-06-20T15:00:00+03:00\n2,11.2,2022-06-20T15:00:00+03:00\n", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/transactions/export?format=ndjson&columns=id,transaction_status", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "{\"id\":1,\"transaction_status\":\"НОВЫЙ\"}\n{\"id\":2,\"transaction_status\":\"УСПЕХ\"}\n", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/transactions/export?format=xlsx", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	require.NoError(t, err)
+	require.Len(t, zr.File, 5)
+	f, err := zr.Open("xl/worksheets/sheet1.xml")
+	require.NoError(t, err)
+	sheet, _ := io.ReadAll(f)
+	require.Contains(t, string(sheet), "<c><v>11.2</v></c>")
+	require.Contains(t, string(sheet), "&lt;exmpl&gt;@m.com")
+
+	for _, target := range []string{
+		"/transactions/export?user_id=NaN",
+		"/transactions/export?format=pdf",
+		"/transactions/export?columns=id,password",
+		"/transactions/export?tz=Mars/Olympus",
+		"/transactions/export?sort=user",
+		"/transactions/export?order=wrong",
+	} {
+		request(t, handler, "GET", target, nil, http.StatusBadRequest)
+	}
+
+	// Failure before anything is sent is replied with an error
+	for _, target := range []string{
+		"/transactions/export?email=down@m.com",
+		"/transactions/export?email=down@m.com&format=xlsx",
+		"/transactions/export?email=reset@m.com",
+	} {
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		require.Equal(t, http.StatusInternalServerError, rr.Code, target)
+		require.Empty(t, rr.Header().Get("content-disposition"), target)
+	}
+	// Failure after the first row breaks connection
+	require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/transactions/export?email=reset@m.com&format=ndjson", nil))
+	})
+}
+
+func TestSettlements(t *testing.T) {
+	api = &MockServer{}
+	router := mux.NewRouter()
+	router.Handle("/settlements", basicAuth(errorHandler(CloseSettlementsHandler()))).Methods("POST")
+	router.Handle("/settlements", errorHandler(GetSettlementsHandler())).Methods("GET")
+	router.Handle("/settlements/{id}/lines", errorHandler(GetSettlementLinesHandler())).Methods("GET")
+
+	tc := []struct {
+		method, target, body string
+		code                 int
+	}{
+		{"POST", "/settlements", `{"business_date": "2022-06-20"}`, http.StatusCreated},
+		{"POST", "/settlements", `{"business_date": "20.06.2022"}`, http.StatusBadRequest},
+		{"POST", "/settlements", `{}`, http.StatusBadRequest},
+		{"GET", "/settlements", "", http.StatusFound},
+		{"GET", "/settlements?merchant_id=1&currency=USD&business_date=2022-06-20&page=1", "", http.StatusFound},
+		{"GET", "/settlements?merchant_id=NaN", "", http.StatusBadRequest},
+		{"GET", "/settlements?business_date=yesterday", "", http.StatusBadRequest},
+		{"GET", "/settlements/1/lines", "", http.StatusFound},
+		{"GET", "/settlements/2/lines", "", http.StatusNotFound},
+		{"GET", "/settlements/smth/lines", "", http.StatusBadRequest},
+	}
+	for _, c := range tc {
+		req := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+		req.SetBasicAuth("username", "password")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, c.code, rr.Code, c.target)
+	}
+
+	request(t, router, "POST", "/settlements", strings.NewReader(`{"business_date": "2022-06-20"}`), http.StatusUnauthorized)
+
+	// Transaction 1 is captured and lost in dispute the same day, its fee is reversed
+	st := Settlement{}
+	for _, l := range []SettlementLine{
+		{Type: linePayment, Status: "УСПЕХ", Amount: 100, Fee: 3.2},
+		{Type: linePayment, Status: "УСПЕХ", Amount: 50, Fee: 1.75},
+		{Type: linePayment, Status: "НЕУСПЕХ", Amount: 20, Fee: 0.5},
+		{Type: linePayment, Status: "ОТМЕНЕН", Amount: 10},
+		{Type: lineRefund, Status: "УСПЕХ", Amount: 100, Fee: 3.2},
+	} {
+		l.settle()
+		st.add(l)
+	}
+	require.Equal(t, Settlement{
+		SuccessCount: 2, SuccessAmount: 150,
+		FailedCount: 1, FailedAmount: 20,
+		CancelledCount: 1, CancelledAmount: 10,
+		RefundedCount: 1, RefundedAmount: 100,
+		FeeAmount: 1.75, NetAmount: 48.25,
+	}, st)
+}
+
+func TestStatusPosting(t *testing.T) {
+	tr := &Transaction{ID: 1, UserID: 2, MerchantID: 3, Amount: 1.5, Currency: "USD"}
+
+	for _, c := range []struct {
+		from, to, event, debit, credit string
+	}{
+		{"", "НОВЫЙ", "authorize", "customer:2", "merchant:3:pending"},
+		{"НОВЫЙ", "УСПЕХ", "capture", "merchant:3:pending", "merchant:3:available"},
+		{"НОВЫЙ", "НЕУСПЕХ", "void", "merchant:3:pending", "customer:2"},
+		{"НОВЫЙ", "ОТМЕНЕН", "void", "merchant:3:pending", "customer:2"},
+		{"ОШИБКА", "УСПЕХ", "capture", "customer:2", "merchant:3:available"},
+	} {
+		p := statusPosting(tr, c.from, c.to)
+		require.NotNil(t, p, c.to)
+		require.NoError(t, p.validate())
+		require.Equal(t, c.event, p.event)
+		require.Equal(t, []ledgerLine{{c.debit, debit, 1.5}, {c.credit, credit, 1.5}}, p.lines)
+	}
+
+	require.Nil(t, statusPosting(tr, "", "ОШИБКА"))
+	require.Nil(t, statusPosting(tr, "ОШИБКА", "ОТМЕНЕН"))
+
+	p := statusPosting(tr, "", "НОВЫЙ")
+	p.lines[1].amount = 1
+	require.Error(t, p.validate())
+}
+
+func TestLedger(t *testing.T) {
+	api = &MockServer{}
+	router := mux.NewRouter()
+	router.Handle("/balances", errorHandler(GetBalancesHandler())).Methods("GET")
+	router.Handle("/ledger/entries", errorHandler(GetLedgerEntriesHandler())).Methods("GET")
+
+	for _, c := range []struct {
+		target string
+		code   int
+	}{
+		{"/balances", http.StatusFound},
+		{"/balances?merchant_id=1&currency=USD", http.StatusFound},
+		{"/balances?merchant_id=NaN", http.StatusBadRequest},
+		{"/ledger/entries?transaction_id=1&page=1", http.StatusFound},
+		{"/ledger/entries?transaction_id=NaN", http.StatusBadRequest},
+		{"/ledger/entries?page=-1", http.StatusBadRequest},
+	} {
+		request(t, router, "GET", c.target, nil, c.code)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/ledger/entries", nil))
+	entries := make([]LedgerEntry, 0)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &entries))
+	require.Len(t, entries, 2)
+	require.Equal(t, "debit", entries[0].Direction)
+	require.Equal(t, entries[0].Amount, entries[1].Amount)
+}
+
+func TestFeeSchedule(t *testing.T) {
+	maxFee := 5.0
+	fs := FeeSchedule{Percent: 2.9, Fixed: 0.3, MinFee: 0.5, MaxFee: &maxFee}
+	require.Equal(t, 3.2, fs.Fee(100))
+	require.Equal(t, 0.5, fs.Fee(1))
+	require.Equal(t, 0.2, fs.Fee(0.2))
+	require.Equal(t, 5.0, fs.Fee(1000))
+
+	schedules := []FeeSchedule{
+		{ID: 1, Percent: 1},
+		{ID: 2, Currency: "EUR", Percent: 2},
+		{ID: 3, PaymentMethod: "card", Percent: 3},
+		{ID: 4, Currency: "EUR", PaymentMethod: "card", Percent: 4},
+	}
+	for _, c := range []struct {
+		currency, method string
+		id               int
+	}{
+		{"USD", "", 1},
+		{"EUR", "", 2},
+		{"USD", "card", 3},
+		{"EUR", "card", 4},
+		{"EUR", "wallet", 2},
+	} {
+		require.Equal(t, c.id, pickFeeSchedule(schedules, &Transaction{Currency: c.currency}, c.method).ID, c)
+	}
+	require.Nil(t, pickFeeSchedule(schedules[1:2], &Transaction{Currency: "USD"}, ""))
+
+	fee := 3.2
+	tr := &Transaction{Amount: 100, Fee: &fee}
+	require.Equal(t, 1.6, refundFee(tr, 50))
+	require.Equal(t, 3.2, refundFee(tr, 200))
+	require.Equal(t, 0.0, refundFee(&Transaction{Amount: 100}, 50))
+}
+
+func TestFeeSchedulesHandlers(t *testing.T) {
+	api = &MockServer{}
+	router := mux.NewRouter()
+	router.Handle("/fee-schedules", basicAuth(errorHandler(CreateFeeScheduleHandler()))).Methods("POST")
+	router.Handle("/fee-schedules", errorHandler(GetFeeSchedulesHandler())).Methods("GET")
+	router.Handle("/fee-schedules/{id}", basicAuth(errorHandler(DeleteFeeScheduleHandler()))).Methods("DELETE")
+
+	tc := []struct {
+		method, target, body string
+		code                 int
+	}{
+		{"POST", "/fee-schedules", `{"merchant_id": 1, "currency": "USD", "percent": 2.9, "fixed": 0.3, "max_fee": 10}`, http.StatusCreated},
+		{"POST", "/fee-schedules", `{"merchant_id": 1, "percent": 120}`, http.StatusBadRequest},
+		{"POST", "/fee-schedules", `{"merchant_id": 1, "fixed": -1}`, http.StatusBadRequest},
+		{"POST", "/fee-schedules", `{"merchant_id": 1, "min_fee": 2, "max_fee": 1}`, http.StatusBadRequest},
+		{"POST", "/fee-schedules", `{"merchant_id": -1}`, http.StatusBadRequest},
+		{"POST", "/fee-schedules", `smth`, http.StatusBadRequest},
+		{"GET", "/fee-schedules", "", http.StatusFound},
+		{"GET", "/fee-schedules?merchant_id=1", "", http.StatusFound},
+		{"GET", "/fee-schedules?merchant_id=NaN", "", http.StatusBadRequest},
+		{"DELETE", "/fee-schedules/1", "", http.StatusOK},
+		{"DELETE", "/fee-schedules/2", "", http.StatusNotFound},
+		{"DELETE", "/fee-schedules/smth", "", http.StatusBadRequest},
+	}
+	for _, c := range tc {
+		req := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+		req.SetBasicAuth("username", "password")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, c.code, rr.Code, c.target+" "+c.body)
+	}
+
+	request(t, router, "DELETE", "/fee-schedules/1", nil, http.StatusUnauthorized)
+}
+
+func TestPayouts(t *testing.T) {
+	api = &MockServer{}
+	router := mux.NewRouter()
+	router.Handle("/payouts", basicAuth(errorHandler(CreatePayoutHandler()))).Methods("POST")
+	router.Handle("/payouts", errorHandler(GetPayoutsHandler())).Methods("GET")
+	router.Handle("/payouts/{id}", errorHandler(GetPayoutHandler())).Methods("GET")
+
+	tc := []struct {
+		method, target, body string
+		code                 int
+	}{
+		{"POST", "/payouts", `{"merchant_id": 1, "currency": "USD", "amount": 50, "bank_account": "DE89370400440532013000"}`, http.StatusCreated},
+		{"POST", "/payouts", `{"merchant_id": 1, "currency": "USD"}`, http.StatusCreated},
+		{"POST", "/payouts", `{"merchant_id": 1, "currency": "USD", "amount": 500}`, http.StatusConflict},
+		{"POST", "/payouts", `{"merchant_id": 1, "amount": 50}`, http.StatusBadRequest},
+		{"POST", "/payouts", `{"merchant_id": 1, "currency": "USD", "amount": -1}`, http.StatusBadRequest},
+		{"POST", "/payouts", `smth`, http.StatusBadRequest},
+		{"GET", "/payouts", "", http.StatusFound},
+		{"GET", "/payouts?merchant_id=1&status=paid&page=1", "", http.StatusFound},
+		{"GET", "/payouts?status=lost", "", http.StatusBadRequest},
+		{"GET", "/payouts?merchant_id=NaN", "", http.StatusBadRequest},
+		{"GET", "/payouts/1", "", http.StatusFound},
+		{"GET", "/payouts/2", "", http.StatusNotFound},
+		{"GET", "/payouts/smth", "", http.StatusBadRequest},
+	}
+	for _, c := range tc {
+		req := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+		req.SetBasicAuth("username", "password")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, c.code, rr.Code, c.target+" "+c.body)
+	}
+
+	request(t, router, "POST", "/payouts", strings.NewReader(`{"merchant_id": 1, "currency": "USD"}`), http.StatusUnauthorized)
+}
+
+func TestPayoutRules(t *testing.T) {
+	rules, err := parsePayoutRules(`[
+		{"bank_account": "000999", "outcome": "failed", "failure_reason": "account_closed"},
+		{"merchant_id": 2, "min_amount": 1000, "outcome": "failed"},
+		{"merchant_id": 2, "outcome": "paid"}
+	]`)
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		p              Payout
+		status, reason string
+	}{
+		{Payout{MerchantID: 1, BankAccount: "000999", Amount: 1}, payoutFailed, "account_closed"},
+		{Payout{MerchantID: 2, Amount: 5000}, payoutFailed, "declined"},
+		{Payout{MerchantID: 2, Amount: 50}, payoutPaid, ""},
+		{Payout{MerchantID: 3, Amount: 5000}, payoutPaid, ""},
+	} {
+		status, reason := payoutOutcome(rules, &c.p)
+		require.Equal(t, c.status, status, c.p)
+		require.Equal(t, c.reason, reason, c.p)
+	}
+
+	_, err = parsePayoutRules(`[{"outcome": "lost"}]`)
+	require.Error(t, err)
+	_, err = parsePayoutRules(`{}`)
+	require.Error(t, err)
+	rules, err = parsePayoutRules("")
+	require.NoError(t, err)
+	require.Empty(t, rules)
+}
+
+func TestWebhooks(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer srv.Close()
+
+	ws := newWebhookSender(srv.URL, "secret")
+	ws.backoff = time.Millisecond
+	ws.Send(context.Background(), "payout.paid", Payout{ID: 1, Status: payoutPaid})
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		require.Equal(t, ws.sign(body), r.Header.Get("X-Paymulator-Signature"))
+		ev := struct {
+			Type string `json:"type"`
+			Data Payout `json:"data"`
+		}{}
+		require.NoError(t, json.Unmarshal(body, &ev))
+		require.Equal(t, "payout.paid", ev.Type)
+		require.Equal(t, 1, ev.Data.ID)
+	case <-time.After(time.Second):
+		t.Fatal("webhook wasn't delivered")
+	}
+
+	require.Nil(t, newWebhookSender("", ""))
+	(*webhookSender)(nil).Send(context.Background(), "payout.paid", nil)
+}
+
+func TestDisputes(t *testing.T) {
+	api = &MockServer{}
+	router := mux.NewRouter()
+	router.Handle("/disputes", basicAuth(errorHandler(OpenDisputeHandler()))).Methods("POST")
+	router.Handle("/disputes", errorHandler(GetDisputesHandler())).Methods("GET")
+	router.Handle("/disputes/{id}", errorHandler(GetDisputeHandler())).Methods("GET")
+	router.Handle("/disputes/{id}", basicAuth(errorHandler(ResolveDisputeHandler()))).Methods("PUT")
+	router.Handle("/disputes/{id}/evidence", errorHandler(SubmitDisputeEvidenceHandler())).Methods("POST")
+
+	tc := []struct {
+		method, target, body string
+		code                 int
+	}{
+		{"POST", "/disputes", `{"transaction_id": 9, "reason_code": "fraudulent"}`, http.StatusCreated},
+		{"POST", "/disputes", `{"transaction_id": 1, "reason_code": "fraudulent"}`, http.StatusConflict},
+		{"POST", "/disputes", `{"transaction_id": 404, "reason_code": "fraudulent"}`, http.StatusNotFound},
+		{"POST", "/disputes", `{"transaction_id": 9, "reason_code": "bored"}`, http.StatusBadRequest},
+		{"POST", "/disputes", `{"transaction_id": 9}`, http.StatusBadRequest},
+		{"GET", "/disputes", "", http.StatusFound},
+		{"GET", "/disputes?merchant_id=1&transaction_id=9&status=won&page=1", "", http.StatusFound},
+		{"GET", "/disputes?status=open", "", http.StatusBadRequest},
+		{"GET", "/disputes?transaction_id=NaN", "", http.StatusBadRequest},
+		{"GET", "/disputes/1", "", http.StatusFound},
+		{"GET", "/disputes/3", "", http.StatusNotFound},
+		{"POST", "/disputes/1/evidence", `{"evidence": "delivery receipt"}`, http.StatusOK},
+		{"POST", "/disputes/1/evidence", `{}`, http.StatusBadRequest},
+		{"POST", "/disputes/2/evidence", `{"evidence": "delivery receipt"}`, http.StatusConflict},
+		{"PUT", "/disputes/1", `{"status": "won"}`, http.StatusOK},
+		{"PUT", "/disputes/1", `{"status": "draw"}`, http.StatusBadRequest},
+		{"PUT", "/disputes/2", `{"status": "lost"}`, http.StatusConflict},
+		{"PUT", "/disputes/smth", `{"status": "lost"}`, http.StatusBadRequest},
+	}
+	for _, c := range tc {
+		req := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+		req.SetBasicAuth("username", "password")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, c.code, rr.Code, c.method+" "+c.target+" "+c.body)
+	}
+
+	request(t, router, "PUT", "/disputes/1", strings.NewReader(`{"status": "won"}`), http.StatusUnauthorized)
+
+	require.Equal(t, "fraudulent", magicDisputeReason(10.66))
+	require.Equal(t, "duplicate", magicDisputeReason(0.68))
+	require.Equal(t, "", magicDisputeReason(10.5))
+}
+
+func TestCardValidation(t *testing.T) {
+	for number, brand := range map[string]string{
+		"4242424242424242": "visa",
+		"5555555555554444": "mastercard",
+		"2223003122003222": "mastercard",
+		"378282246310005":  "amex",
+		"6011111111111117": "discover",
+		"3566002020360505": "jcb",
+		"2200000000000004": "mir",
+	} {
+		require.True(t, luhnValid(number), number)
+		require.Equal(t, brand, cardBrand(number), number)
+	}
+	for _, number := range []string{"4242424242424241", "42424242", "4242abcd42424242", ""} {
+		require.False(t, luhnValid(number), number)
+	}
+}
+
+func TestPaymentMethods(t *testing.T) {
+	now := time.Date(2022, 6, 20, 12, 0, 0, 0, time.UTC)
+	card := func(body string) (*PaymentMethod, error) {
+		req := new(PaymentMethodRequest)
+		require.NoError(t, json.Unmarshal([]byte(body), req))
+		return newPaymentMethod(req, now)
+	}
+
+	pm, err := card(`{"type": "card", "card": {"number": "4000 0000 0000 9995", "exp_month": 12, "exp_year": 2030, "cvc": "123"}}`)
+	require.NoError(t, err)
+	require.Equal(t, "visa", pm.Card.Brand)
+	require.Equal(t, "9995", pm.Card.Last4)
+	require.NotContains(t, pm.Card.Fingerprint, "4000")
+	data, _ := json.Marshal(pm)
+	require.NotContains(t, string(data), "4000000000009995")
+	status, code := authorizationResult(pm, now)
+	require.Equal(t, "ОШИБКА", status)
+	require.Equal(t, declineInsufficientFunds, code)
+
+	pm, err = card(`{"type": "card", "card": {"number": "4242424242424242", "exp_month": 6, "exp_year": 2022, "cvc": "123"}}`)
+	require.NoError(t, err)
+	status, code = authorizationResult(pm, now)
+	require.Equal(t, "НОВЫЙ", status)
+	require.Equal(t, "", code)
+	status, code = authorizationResult(pm, now.AddDate(0, 1, 0))
+	require.Equal(t, "ОШИБКА", status)
+	require.Equal(t, declineExpiredCard, code)
+
+	pm, err = card(`{"type": "card", "card": {"number": "4000002500003155", "exp_month": 1, "exp_year": 2030, "cvc": "123"}}`)
+	require.NoError(t, err)
+	status, code = authorizationResult(pm, now)
+	require.Equal(t, statusRequiresAction, status)
+	require.Equal(t, "", code)
+
+	for _, body := range []string{
+		`{"type": "card", "card": {"number": "4242424242424241", "exp_month": 12, "exp_year": 2030, "cvc": "123"}}`,
+		`{"type": "card", "card": {"number": "4242424242424242", "exp_month": 13, "exp_year": 2030, "cvc": "123"}}`,
+		`{"type": "card", "card": {"number": "4242424242424242", "exp_month": 5, "exp_year": 2022, "cvc": "123"}}`,
+		`{"type": "card", "card": {"number": "378282246310005", "exp_month": 12, "exp_year": 2030, "cvc": "123"}}`,
+		`{"type": "card"}`,
+		`{"type": "wallet", "wallet": {"provider": "piggy_bank"}}`,
+		`{"type": "bank_transfer", "bank_transfer": {"account_number": "40817810099910004312"}}`,
+		`{"type": "cash"}`,
+	} {
+		_, err = card(body)
+		require.Error(t, err, body)
+	}
+
+	api = &MockServer{}
+	router := mux.NewRouter()
+	router.Handle("/payment-methods", errorHandler(CreatePaymentMethodHandler())).Methods("POST")
+	router.Handle("/payment-methods/{id}", errorHandler(GetPaymentMethodHandler())).Methods("GET")
+	request(t, router, "POST", "/payment-methods", strings.NewReader(`{"type": "wallet", "wallet": {"provider": "apple_pay"}}`), http.StatusCreated)
+	request(t, router, "POST", "/payment-methods", strings.NewReader(`{"type": "bank_transfer", "bank_transfer": {"account_number": "40817810099910004312", "bank_code": "044525225"}}`), http.StatusCreated)
+	request(t, router, "POST", "/payment-methods", strings.NewReader(`{"type": "cash"}`), http.StatusBadRequest)
+	request(t, router, "GET", "/payment-methods/1", nil, http.StatusFound)
+	request(t, router, "GET", "/payment-methods/2", nil, http.StatusNotFound)
+	request(t, router, "GET", "/payment-methods/smth", nil, http.StatusBadRequest)
+}
+
+func TestImportReconciliation(t *testing.T) {
+	api = &MockServer{}
+	handler := basicAuth(errorHandler(ImportReconciliationHandler()))
+
+	csvFile := "id,transaction_status,amount,currency\n" +
+		"1,УСПЕХ,1.2,USD\n" +
+		"2,failed,,\n" +
+		"3,УСПЕХ,5,USD\n" +
+		"4,УСПЕХ,1.2,RUB\n" +
+		"404,УСПЕХ,,\n" +
+		"9,success,,\n" +
+		"NaN,УСПЕХ,,\n" +
+		"5,ОТМЕНЕН,,\n"
+	camtFile := `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:camt.053.001.02"><BkToCstmrStmt><Stmt>
+<Ntry><Amt Ccy="USD">1.20</Amt><Sts>BOOK</Sts><NtryDtls><TxDtls><Refs><EndToEndId>1</EndToEndId></Refs></TxDtls></NtryDtls></Ntry>
+<Ntry><Amt Ccy="USD">1.20</Amt><RvslInd>true</RvslInd><Sts>BOOK</Sts><NtryDtls><TxDtls><Refs><EndToEndId>2</EndToEndId></Refs></TxDtls></NtryDtls></Ntry>
+<Ntry><Amt Ccy="USD">1.20</Amt><Sts>PDNG</Sts><NtryDtls><TxDtls><Refs><EndToEndId>3</EndToEndId></Refs></TxDtls></NtryDtls></Ntry>
+<Ntry><Amt Ccy="USD">1.20</Amt><Sts><Cd>BOOK</Cd></Sts><NtryDtls><TxDtls><Refs><EndToEndId>404</EndToEndId></Refs></TxDtls></NtryDtls></Ntry>
+</Stmt></BkToCstmrStmt></Document>`
+
+	tc := []struct {
+		target, body string
+		want         ReconciliationReport
+	}{
+		{"/reconciliations", csvFile, ReconciliationReport{Total: 8, Matched: 2, Mismatched: 2, Unknown: 1, AlreadyFinal: 1, Invalid: 2}},
+		{"/reconciliations?format=camt053", camtFile, ReconciliationReport{Total: 4, Matched: 2, Unknown: 1, Invalid: 1}},
+		{"/reconciliations", camtFile, ReconciliationReport{Total: 4, Matched: 2, Unknown: 1, Invalid: 1}},
+	}
+	for _, c := range tc {
+		req := httptest.NewRequest("POST", c.target, strings.NewReader(c.body))
+		req.SetBasicAuth("username", "password")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+		rep := ReconciliationReport{}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &rep))
+		rep.Rows = nil
+		require.Equal(t, c.want, rep)
+	}
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile("file", "settlement.csv")
+	fw.Write([]byte(csvFile))
+	mw.Close()
+	req := httptest.NewRequest("POST", "/reconciliations", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.SetBasicAuth("username", "password")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	for _, c := range []struct{ target, body string }{
+		{"/reconciliations", "id,amount\n1,1.2\n"},
+		{"/reconciliations", ""},
+		{"/reconciliations?format=mt940", csvFile},
+		{"/reconciliations?format=camt053", "<Document>"},
+	} {
+		req := httptest.NewRequest("POST", c.target, strings.NewReader(c.body))
+		req.SetBasicAuth("username", "password")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusBadRequest, rr.Code, c.body)
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	require.Equal(t, "http://localhost:8080/3ds/abc", nextAction("http://localhost:8080", "abc").RedirectURL)
+	require.Len(t, newChallengeToken(), 32)
+	require.NotEqual(t, newChallengeToken(), newChallengeToken())
+
+	require.True(t, validReturnURL("https://shop.example/return"))
+	require.False(t, validReturnURL("/return"))
+	require.False(t, validReturnURL("javascript:alert(1)"))
+
+	require.Equal(t, "", challengeRedirect(&Transaction{ID: 1}))
+	require.Equal(t,
+		"https://shop.example/return?id=3&order=1&transaction_status=%D0%9D%D0%9E%D0%92%D0%AB%D0%99",
+		challengeRedirect(&Transaction{ID: 3, Status: "НОВЫЙ", ReturnURL: "https://shop.example/return?order=1"}),
+	)
+
+	require.Error(t, checkStatusTransition(statusRequiresAction, "УСПЕХ"))
+	require.NoError(t, checkStatusTransition(statusRequiresAction, "ОТМЕНЕН"))
+
+	api = &MockServer{}
+	router := mux.NewRouter()
+	router.Handle("/3ds/{token}", errorHandler(ChallengePageHandler())).Methods("GET")
+	router.Handle("/3ds/{token}", errorHandler(CompleteChallengeHandler())).Methods("POST")
+	request(t, router, "GET", "/3ds/token", nil, http.StatusOK)
+	request(t, router, "GET", "/3ds/smth", nil, http.StatusNotFound)
+
+	form := func(target, decision string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", target, strings.NewReader("decision="+decision))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	rr := form("/3ds/token", "approve")
+	require.Equal(t, http.StatusSeeOther, rr.Code)
+	require.Contains(t, rr.Header().Get("Location"), "https://shop.example/return?id=5")
+	rr = form("/3ds/token", "deny")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), "ОШИБКА")
+	require.Equal(t, http.StatusBadRequest, form("/3ds/token", "maybe").Code)
+	require.Equal(t, http.StatusNotFound, form("/3ds/smth", "deny").Code)
+}
+
+func TestVault(t *testing.T) {
+	v, err := newVault("")
+	require.NoError(t, err)
+	require.Nil(t, v)
+	_, err = newVault("secret")
+	require.Error(t, err)
+	_, err = newVault(strings.Repeat("ab", 16))
+	require.Error(t, err)
+
+	v, err = newVault(strings.Repeat("ab", 32))
+	require.NoError(t, err)
+	card := &CardData{Number: "4242424242424242", ExpMonth: 12, ExpYear: 2030, HolderName: "IVAN IVANOV"}
+	ciphertext, err := v.seal("tok_1", card)
+	require.NoError(t, err)
+	require.NotContains(t, string(ciphertext), card.Number)
+	got, err := v.open("tok_1", ciphertext)
+	require.NoError(t, err)
+	require.Equal(t, card, got)
+
+	// Ciphertext is bound to its token and key
+	_, err = v.open("tok_2", ciphertext)
+	require.Error(t, err)
+	other, _ := newVault(strings.Repeat("cd", 32))
+	_, err = other.open("tok_1", ciphertext)
+	require.Error(t, err)
+	_, err = v.open("tok_1", ciphertext[:5])
+	require.Error(t, err)
+
+	require.True(t, strings.HasPrefix(newCardToken(), "tok_"))
+	require.Error(t, (&ApiServer{}).checkVault())
+	require.Error(t, validateTransaction(&Transaction{UserID: 1, Email: "a@b.c", Amount: 1, Currency: "RUB", PaymentMethodID: 1, CardToken: "tok_1"}))
+
+	api = &MockServer{}
+	router := mux.NewRouter()
+	router.Handle("/vault/tokens", errorHandler(TokenizeCardHandler())).Methods("POST")
+	router.Handle("/vault/tokens/{token}", errorHandler(GetCardTokenHandler())).Methods("GET")
+	router.Handle("/vault/tokens/{token}/detokenize", errorHandler(DetokenizeCardHandler())).Methods("POST")
+	request(t, router, "POST", "/vault/tokens", strings.NewReader(`{"number": "4242 4242 4242 4242", "exp_month": 12, "exp_year": 2030}`), http.StatusCreated)
+	request(t, router, "POST", "/vault/tokens", strings.NewReader(`{"number": "4242424242424241", "exp_month": 12, "exp_year": 2030}`), http.StatusBadRequest)
+	request(t, router, "POST", "/vault/tokens", strings.NewReader(`{"number": "4242424242424242", "exp_month": 12, "exp_year": 2020}`), http.StatusBadRequest)
+	request(t, router, "GET", "/vault/tokens/tok_1", nil, http.StatusFound)
+	request(t, router, "GET", "/vault/tokens/tok_2", nil, http.StatusNotFound)
+	request(t, router, "POST", "/vault/tokens/tok_1/detokenize", nil, http.StatusOK)
+	request(t, router, "POST", "/vault/tokens/tok_2/detokenize", nil, http.StatusNotFound)
+}
+
+func TestSubscriptionBillingPeriods(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 10, 0, 0, 0, time.UTC) }
+	require.Equal(t, date(2022, 2, 28), addInterval(date(2022, 1, 31), "month", 1))
+	require.Equal(t, date(2024, 2, 29), addInterval(date(2024, 1, 31), "month", 1))
+	require.Equal(t, date(2022, 4, 30), addInterval(date(2022, 1, 30), "month", 3))
+	require.Equal(t, date(2023, 2, 28), addInterval(date(2022, 2, 28), "year", 1))
+	require.Equal(t, date(2025, 2, 28), addInterval(date(2024, 2, 29), "year", 1))
+	require.Equal(t, date(2022, 1, 15), addInterval(date(2022, 1, 1), "week", 2))
+	require.Equal(t, date(2022, 3, 1), addInterval(date(2022, 2, 28), "day", 1))
+
+	basic, pro := &Plan{Amount: 10}, &Plan{Amount: 40}
+	start, end := date(2022, 4, 1), date(2022, 5, 1)
+	require.Equal(t, 15.0, proration(basic, pro, start, end, date(2022, 4, 16)))
+	require.Equal(t, -15.0, proration(pro, basic, start, end, date(2022, 4, 16)))
+	require.Equal(t, 30.0, proration(basic, pro, start, end, date(2022, 3, 1)))
+	require.Equal(t, 0.0, proration(basic, pro, start, end, end))
+
+	for _, c := range []struct {
+		t           Transaction
+		status      string
+		declineCode string
+	}{
+		{Transaction{Status: "НОВЫЙ"}, chargePending, ""},
+		{Transaction{Status: "УСПЕХ"}, chargePaid, ""},
+		{Transaction{Status: "НЕУСПЕХ"}, chargeFailed, ""},
+		{Transaction{Status: "ОТМЕНЕН"}, chargeFailed, ""},
+		{Transaction{Status: "ОШИБКА", DeclineCode: declineInsufficientFunds}, chargeFailed, declineInsufficientFunds},
+		{Transaction{Status: statusRequiresAction}, chargeFailed, declineAuthenticationRequired},
+	} {
+		status, declineCode := chargeStatus(&c.t)
+		require.Equal(t, c.status, status, c.t.Status)
+		require.Equal(t, c.declineCode, declineCode, c.t.Status)
+	}
+}
+
+// Transaction changed to УСПЕХ with magic amount is disputed right away
+func TestRenewalSettledWithDispute(t *testing.T) {
+	for _, amount := range []float64{10.66, 10.67, 10.68} {
+		tx := &fakeTx{rows: map[string][]interface{}{
+			"update transactions set transaction_status": {},
+			"insert into disputes":                       {1, 5},
+			"update subscription_charges":                {3, 7, 5},
+			"from subscriptions where id":                {7, 1, 1, "a@b.c", 0, subscriptionPastDue},
+			"update subscriptions set status='active'":   {7, 1, 1, "a@b.c", 0, subscriptionActive},
+		}}
+		tr := &Transaction{ID: 5, UserID: 1, MerchantID: 1, Amount: amount, Currency: "USD", Status: "НОВЫЙ"}
+		c, err := applyStatus(context.Background(), tx, tr, "УСПЕХ")
+		require.NoError(t, err)
+		require.Equal(t, "НОВЫЙ", c.from)
+		require.Equal(t, "НОВЫЙ", tr.Status)
+		require.NotNil(t, c.dispute, amount)
+		require.Equal(t, []interface{}{5, chargePending, chargePaid, ""}, tx.argsOf("update subscription_charges"))
+		require.Equal(t, "subscription.renewed", c.renewal)
+		require.Equal(t, subscriptionActive, c.subscription.Status)
+
+		statusTransitions.values = make(map[string]*counterSeries)
+		c.announce(context.Background(), nil)
+		require.Len(t, statusTransitions.values, 1)
+		require.Equal(t, []string{"НОВЫЙ", "УСПЕХ"}, statusTransitions.values["НОВЫЙ\xffУСПЕХ"].labels)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	p := &Plan{Name: "basic", Amount: 10, Currency: "RUB", Interval: "month"}
+	require.NoError(t, validatePlan(p))
+	require.Equal(t, 1, p.IntervalCount)
+	for _, p := range []*Plan{
+		{Name: "basic", Amount: 10, Currency: "RUB"},
+		{Name: "basic", Amount: -10, Currency: "RUB", Interval: "month"},
+		{Name: "basic", Amount: 10, Currency: "RUB", Interval: "fortnight"},
+		{Name: "basic", Amount: 10, Currency: "RUB", Interval: "month", TrialDays: -1},
+	} {
+		require.Error(t, validatePlan(p))
+	}
+	require.Error(t, validateSubscription(&Subscription{PlanID: 1, UserID: 1}))
+
+	api = &MockServer{}
+	router := mux.NewRouter()
+	router.Handle("/plans", errorHandler(CreatePlanHandler())).Methods("POST")
+	router.Handle("/plans", errorHandler(GetPlansHandler())).Methods("GET")
+	router.Handle("/subscriptions", errorHandler(CreateSubscriptionHandler())).Methods("POST")
+	router.Handle("/subscriptions", errorHandler(GetSubscriptionsHandler())).Methods("GET")
+	router.Handle("/subscriptions/{id}", errorHandler(GetSubscriptionHandler())).Methods("GET")
+	router.Handle("/subscriptions/{id}", errorHandler(UpdateSubscriptionHandler())).Methods("PUT")
+	router.Handle("/subscriptions/{id}", errorHandler(CancelSubscriptionHandler())).Methods("DELETE")
+	router.Handle("/subscriptions/{id}/charges", errorHandler(GetSubscriptionChargesHandler())).Methods("GET")
+
+	request(t, router, "POST", "/plans", strings.NewReader(`{"name": "basic", "amount": 10, "currency": "RUB", "interval": "month", "trial_days": 14}`), http.StatusCreated)
+	request(t, router, "POST", "/plans", strings.NewReader(`{"name": "basic", "amount": 10, "currency": "RUB", "interval": "hour"}`), http.StatusBadRequest)
+	request(t, router, "GET", "/plans", nil, http.StatusFound)
+	request(t, router, "POST", "/subscriptions", strings.NewReader(`{"plan_id": 1, "user_id": 1, "email": "a@b.c"}`), http.StatusCreated)
+	request(t, router, "POST", "/subscriptions", strings.NewReader(`{"plan_id": 2, "user_id": 1, "email": "a@b.c"}`), http.StatusBadRequest)
+	request(t, router, "GET", "/subscriptions?user_id=1&status=past_due", nil, http.StatusFound)
+	request(t, router, "GET", "/subscriptions?status=paused", nil, http.StatusBadRequest)
+	request(t, router, "GET", "/subscriptions/1", nil, http.StatusFound)
+	request(t, router, "GET", "/subscriptions/2", nil, http.StatusNotFound)
+	request(t, router, "PUT", "/subscriptions/1", strings.NewReader(`{"cancel_at_period_end": true}`), http.StatusOK)
+	request(t, router, "PUT", "/subscriptions/1", strings.NewReader(`{}`), http.StatusBadRequest)
+	request(t, router, "DELETE", "/subscriptions/1", nil, http.StatusOK)
+	request(t, router, "GET", "/subscriptions/1/charges", nil, http.StatusFound)
+	request(t, router, "GET", "/subscriptions/2/charges", nil, http.StatusNotFound)
+}
+
+func TestClock(t *testing.T) {
+	wall := time.Date(2022, 4, 1, 10, 0, 0, 0, time.UTC)
+	c := &virtualClock{wall: func() time.Time { return wall }}
+	require.Equal(t, wall, c.Now())
+
+	require.Equal(t, wall.Add(48*time.Hour), c.Advance(48*time.Hour).Now)
+	wall = wall.Add(time.Minute)
+	require.Equal(t, wall.Add(48*time.Hour), c.Now())
+
+	state := c.Freeze()
+	require.True(t, state.Frozen)
+	wall = wall.Add(time.Hour)
+	require.Equal(t, state.Now, c.Now())
+	require.Equal(t, state.Now.Add(time.Hour), c.Advance(time.Hour).Now)
+	wall = wall.Add(time.Hour)
+	require.Equal(t, state.Now.Add(time.Hour), c.Now())
+
+	// Resumed clock goes on from where it stopped
+	resumed := c.Resume()
+	require.False(t, resumed.Frozen)
+	require.Equal(t, state.Now.Add(time.Hour), resumed.Now)
+	wall = wall.Add(time.Second)
+	require.Equal(t, state.Now.Add(time.Hour+time.Second), c.Now())
+
+	at := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.Equal(t, at, c.Set(at).Now)
+	require.Equal(t, wall, c.Reset().Now)
+
+	require.Equal(t, time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC), businessDay(wall))
+
+	api = &MockServer{}
+	defer clock.Reset()
+	router := mux.NewRouter()
+	router.Handle("/clock", errorHandler(GetClockHandler())).Methods("GET")
+	router.Handle("/clock", errorHandler(ChangeClockHandler())).Methods("PUT")
+	request(t, router, "GET", "/clock", nil, http.StatusFound)
+	request(t, router, "PUT", "/clock", strings.NewReader(`{"action": "freeze"}`), http.StatusOK)
+	request(t, router, "PUT", "/clock", strings.NewReader(`{"action": "advance", "advance": "720h"}`), http.StatusOK)
+	request(t, router, "PUT", "/clock", strings.NewReader(`{"action": "advance", "advance": "-1h"}`), http.StatusBadRequest)
+	request(t, router, "PUT", "/clock", strings.NewReader(`{"action": "set", "time": "2030-01-01T00:00:00Z"}`), http.StatusOK)
+	request(t, router, "PUT", "/clock", strings.NewReader(`{"action": "set"}`), http.StatusBadRequest)
+	request(t, router, "PUT", "/clock", strings.NewReader(`{"action": "resume"}`), http.StatusOK)
+	request(t, router, "PUT", "/clock", strings.NewReader(`{"action": "rewind"}`), http.StatusBadRequest)
+	request(t, router, "PUT", "/clock", strings.NewReader(`{"action": "reset"}`), http.StatusOK)
+}
+
+func TestChaosRules(t *testing.T) {
+	rules, err := parseChaosRules(`[
+		{"route": "POST /transaction", "merchant_id": 7, "error_rate": 1, "error_codes": [503]},
+		{"route": "GET /transactions/{id}", "latency": {"distribution": "uniform", "min_ms": 10, "max_ms": 20}, "drop_rate": 1},
+		{"route": "POST /transaction", "timeout_after_commit_rate": 1}
+	]`)
+	require.NoError(t, err)
+	rnd := rand.New(rand.NewSource(1))
+	seven, eight := 7, 8
+
+	for _, c := range []struct {
+		route      string
+		merchantID *int
+		fault      string
+		status     int
+	}{
+		{"POST /transaction", &seven, faultError, http.StatusServiceUnavailable},
+		{"POST /transaction", &eight, faultTimeoutAfterCommit, 0},
+		{"POST /transaction", nil, faultTimeoutAfterCommit, 0},
+		{"GET /transactions/{id}", nil, faultDrop, 0},
+		{"GET /transactions", nil, "", 0},
+	} {
+		plan, err := planChaos(rules, c.route, c.merchantID, http.Header{}, rnd)
+		require.NoError(t, err)
+		require.Equal(t, c.fault, plan.fault, c.route)
+		require.Equal(t, c.status, plan.status, c.route)
+		if c.route == "GET /transactions/{id}" {
+			require.True(t, plan.delay >= 10*time.Millisecond && plan.delay <= 20*time.Millisecond, plan.delay)
+		}
+	}
+
+	h := http.Header{}
+	h.Set(chaosFaultHeader, "error")
+	h.Set(chaosStatusHeader, "502")
+	h.Set(chaosLatencyHeader, "5ms")
+	plan, err := planChaos(nil, "GET /balances", nil, h, rnd)
+	require.NoError(t, err)
+	require.Equal(t, chaosPlan{5 * time.Millisecond, faultError, http.StatusBadGateway}, plan)
+	h.Set(chaosFaultHeader, "none")
+	plan, err = planChaos(rules, "POST /transaction", &seven, h, rnd)
+	require.NoError(t, err)
+	require.Empty(t, plan.fault)
+	h.Set(chaosFaultHeader, "explode")
+	_, err = planChaos(nil, "GET /balances", nil, h, rnd)
+	require.Error(t, err)
+
+	_, err = parseChaosRules(`[{"error_rate": 0.6, "drop_rate": 0.6}]`)
+	require.Error(t, err)
+	_, err = parseChaosRules(`[{"latency": {"distribution": "pareto"}}]`)
+	require.Error(t, err)
+	rules, err = parseChaosRules("")
+	require.NoError(t, err)
+	require.Empty(t, rules)
+}
+
+func TestChaos(t *testing.T) {
+	api = &MockServer{}
+	defer func() { chaosRules = nil }()
+	var err error
+	chaosRules, err = parseChaosRules(`[{"route": "POST /transaction", "merchant_id": 7, "error_rate": 1, "error_codes": [504]}]`)
+	require.NoError(t, err)
+
+	var commits int32
+	router := mux.NewRouter()
+	router.Handle("/transaction", http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&commits, 1)
+		io.ReadAll(r.Body)
+		rw.Write([]byte(`{"id": 1, "status": "НОВЫЙ"}`))
+	})).Methods("POST")
+	router.Use(chaos)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	send := func(body string, fault string) (*http.Response, error) {
+		req, _ := http.NewRequest("POST", srv.URL+"/transaction", strings.NewReader(body))
+		req.Header.Set("content-type", "application/json")
+		if fault != "" {
+			req.Header.Set(chaosFaultHeader, fault)
+		}
+		return http.DefaultClient.Do(req)
+	}
+
+	resp, err := send(`{"merchant_id": 7}`, "")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	require.Equal(t, int32(0), atomic.LoadInt32(&commits))
+
+	resp, err = send(`{"merchant_id": 8}`, "")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, `{"id": 1, "status": "НОВЫЙ"}`, string(body))
+	require.Equal(t, int32(1), atomic.LoadInt32(&commits))
+
+	_, err = send(`{}`, faultDrop)
+	require.Error(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&commits))
+
+	resp, err = send(`{}`, faultTruncate)
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	require.Error(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&commits))
+
+	_, err = send(`{}`, faultTimeoutAfterCommit)
+	require.Error(t, err)
+	require.Equal(t, int32(3), atomic.LoadInt32(&commits))
+
+	resp, err = send(`{}`, "explode")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestParseScenario(t *testing.T) {
+	sc, err := parseScenario([]byte(`
+name: chargeback
+description: paid, then disputed and lost
+steps:
+  - after: 2s
+    status: УСПЕХ
+  - after: 10s
+    dispute: fraudulent
+  - after: 72h
+    resolve_dispute: lost
+`))
+	require.NoError(t, err)
+	require.Equal(t, "chargeback", sc.Name)
+	require.Equal(t, []ScenarioStep{
+		{After: "2s", Status: "УСПЕХ"},
+		{After: "10s", Dispute: "fraudulent"},
+		{After: "72h", ResolveDispute: "lost"},
+	}, sc.Steps)
+	require.Equal(t, "dispute fraudulent", sc.Steps[1].action())
+
+	sc, err = parseScenario([]byte(`{"name": "decline", "steps": [{"status": "НЕУСПЕХ"}]}`))
+	require.NoError(t, err)
+	d, err := sc.Steps[0].delay()
+	require.NoError(t, err)
+	require.Zero(t, d)
+
+	for _, def := range []string{
+		`steps: [{status: УСПЕХ}]`,
+		`{name: Bad Name, steps: [{status: УСПЕХ}]}`,
+		`{name: empty, steps: []}`,
+		`{name: late, steps: [{after: soon, status: УСПЕХ}]}`,
+		`{name: back, steps: [{after: -1s, status: УСПЕХ}]}`,
+		`{name: new, steps: [{status: НОВЫЙ}]}`,
+		`{name: both, steps: [{status: УСПЕХ, dispute: fraudulent}]}`,
+		`{name: none, steps: [{after: 1s}]}`,
+		`{name: reason, steps: [{dispute: angry}]}`,
+		`{name: draw, steps: [{resolve_dispute: draw}]}`,
+		`[1, 2]`,
+	} {
+		_, err = parseScenario([]byte(def))
+		require.Error(t, err, def)
+	}
+}
+
+func TestScenariosHandlers(t *testing.T) {
+	api = &MockServer{}
+	router := mux.NewRouter()
+	router.Handle("/scenarios", basicAuth(errorHandler(CreateScenarioHandler()))).Methods("POST")
+	router.Handle("/scenarios", errorHandler(GetScenariosHandler())).Methods("GET")
+	router.Handle("/transactions/{id}/scenario", errorHandler(GetScenarioRunHandler())).Methods("GET")
+	router.Handle("/transaction", errorHandler(CreateTransactionHandler())).Methods("POST")
+
+	for _, c := range []struct {
+		method, target, body string
+		code                 int
+	}{
+		{"POST", "/scenarios", "name: settle\nsteps:\n  - after: 2s\n    status: УСПЕХ\n", http.StatusCreated},
+		{"POST", "/scenarios", "name: chargeback\nsteps:\n  - status: УСПЕХ\n", http.StatusConflict},
+		{"POST", "/scenarios", "name: settle\nsteps: []\n", http.StatusBadRequest},
+		{"GET", "/scenarios", "", http.StatusFound},
+		{"GET", "/transactions/1/scenario", "", http.StatusFound},
+		{"GET", "/transactions/2/scenario", "", http.StatusNotFound},
+		{"GET", "/transactions/a/scenario", "", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+		req.SetBasicAuth("username", "password")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, c.code, rr.Code, c.target+" "+c.body)
+	}
+	request(t, router, "POST", "/scenarios", strings.NewReader("name: settle\nsteps:\n  - status: УСПЕХ\n"), http.StatusUnauthorized)
+
+	body := `{"user_id": 1, "email": "exmpl@m.com", "amount": 10, "currency": "USD"}`
+	for _, c := range []struct {
+		scenario string
+		code     int
+	}{
+		{"chargeback", http.StatusCreated},
+		{"unknown", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest("POST", "/transaction", strings.NewReader(body))
+		req.Header.Set(scenarioHeader, c.scenario)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, c.code, rr.Code, c.scenario)
+	}
+}
+
+func TestCassette(t *testing.T) {
+	charges := 0
+	provider := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		charges++
+		body, _ := io.ReadAll(r.Body)
+		rw.Header().Set("X-Path", r.URL.Path+"?"+r.URL.RawQuery)
+		rw.Header().Set("X-Authorized", strconv.FormatBool(r.Header.Get("Authorization") == "Bearer secret"))
+		fmt.Fprintf(rw, `{"charge": %d, "request": %s}`, charges, body)
+	}))
+	defer provider.Close()
+	path := t.TempDir() + "/cassette.jsonl"
+
+	_, err := newCassette("rewind", provider.URL, path, "")
+	require.Error(t, err)
+	_, err = newCassette(proxyRecord, "", path, "")
+	require.Error(t, err)
+	_, err = newCassette(proxyRecord, provider.URL, path, "method,cookie")
+	require.Error(t, err)
+	c, err := newCassette("", provider.URL, path, "")
+	require.NoError(t, err)
+	require.Nil(t, c)
+
+	c, err = newCassette(proxyRecord, provider.URL+"/api", path, "method,path,json:amount")
+	require.NoError(t, err)
+	for _, body := range []string{`{"amount": 10, "id": 1}`, `{"amount": 10, "id": 2}`, `{"amount": 20}`} {
+		resp, err := c.Do(context.Background(), &ProxiedRequest{
+			Method: "POST",
+			Path:   "/v1/charges",
+			Query:  "expand=card",
+			Header: http.Header{"Authorization": {"Bearer secret"}},
+			Body:   body,
+		})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.Status)
+		require.Equal(t, "/api/v1/charges?expand=card", resp.Header.Get("X-Path"))
+		require.Equal(t, "true", resp.Header.Get("X-Authorized"))
+	}
+	require.NoError(t, c.file.Close())
+	recorded, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NotContains(t, string(recorded), "Bearer secret")
+	provider.Close()
+
+	c, err = newCassette(proxyReplay, "", path, "method,path,json:amount")
+	require.NoError(t, err)
+	for _, r := range []struct {
+		body, charge string
+	}{
+		{`{"amount": 10}`, `"charge": 1`},
+		{`{"amount":10, "id": 5}`, `"charge": 2`},
+		{`{"amount": 10}`, `"charge": 2`},
+		{`{"amount": 20}`, `"charge": 3`},
+	} {
+		resp, err := c.Do(context.Background(), &ProxiedRequest{Method: "POST", Path: "/v1/charges", Body: r.body})
+		require.NoError(t, err)
+		require.Contains(t, resp.Body, r.charge)
+	}
+	_, err = c.Do(context.Background(), &ProxiedRequest{Method: "POST", Path: "/v1/charges", Body: `{"amount": 30}`})
+	require.Error(t, err)
+
+	c, err = newCassette(proxyReplay, "", path, "")
+	require.NoError(t, err)
+	resp, err := c.Do(context.Background(), &ProxiedRequest{Method: "POST", Path: "/v1/charges", Query: "expand=card", Body: `{"amount": 20}`})
+	require.NoError(t, err)
+	require.Contains(t, resp.Body, `"charge": 3`)
+	_, err = c.Do(context.Background(), &ProxiedRequest{Method: "POST", Path: "/v1/charges", Body: `{"amount": 20}`})
+	require.Error(t, err)
+
+	body, encoding := encodeBody([]byte{0xff, 0x00})
+	require.Equal(t, "base64", encoding)
+	b, err := decodeBody(body, encoding)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xff, 0x00}, b)
+}
+
+func TestProxyHandler(t *testing.T) {
+	api = &MockServer{}
+	router := mux.NewRouter()
+	router.PathPrefix(proxyPrefix + "/").Handler(errorHandler(ProxyHandler()))
+
+	req := httptest.NewRequest("POST", "/proxy/v1/charges", strings.NewReader(`{"amount": 10}`))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusPaymentRequired, rr.Code)
+	require.Equal(t, "sandbox", rr.Header().Get("X-Provider"))
+	require.Equal(t, `{"error": "card_declined"}`, rr.Body.String())
+
+	request(t, router, "GET", "/proxy/v1/refunds", nil, http.StatusNotFound)
+}
+
+func TestJournal(t *testing.T) {
+	ms := &MockServer{}
+	api = ms
+	router := mux.NewRouter()
+	router.Handle("/vault/tokens/{token}/detokenize", basicAuth(errorHandler(DetokenizeCardHandler()))).Methods("POST")
+	router.Handle("/transaction", errorHandler(CreateTransactionHandler())).Methods("POST")
+	router.Handle("/admin/requests", basicAuth(errorHandler(GetJournalHandler()))).Methods("GET")
+	router.Handle("/crash", http.HandlerFunc(func(http.ResponseWriter, *http.Request) { panic(http.ErrAbortHandler) }))
+	router.Use(journaling)
+
+	req := httptest.NewRequest("POST", "/transaction?token=secret", strings.NewReader(
+		`{"user_id": 1, "email": "exmpl@m.com", "amount": 10, "currency": "USD", "merchant_id": 3}`,
+	))
+	req.Header.Set(requestIDHeader, "req_1")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code)
+	require.Equal(t, "req_1", rr.Header().Get(requestIDHeader))
+
+	req = httptest.NewRequest("POST", "/vault/tokens/tok_1/detokenize", nil)
+	req.SetBasicAuth("username", "password")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), "4242424242424242")
+
+	require.Panics(t, func() { router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/crash", nil)) })
+
+	req = httptest.NewRequest("GET", "/admin/requests", nil)
+	req.SetBasicAuth("username", "password")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusFound, rr.Code)
+	require.NotEmpty(t, rr.Header().Get(requestIDHeader))
+	require.Len(t, ms.journal, 3)
+
+	e := ms.journal[0]
+	require.Equal(t, "req_1", e.RequestID)
+	require.Equal(t, "POST /transaction", e.Route)
+	require.Equal(t, "token="+url.QueryEscape(redacted), e.Query)
+	require.Equal(t, 3, *e.MerchantID)
+	require.Equal(t, http.StatusCreated, e.Status)
+	require.Contains(t, e.RequestBody, `"email":"exmpl@m.com"`)
+	require.Contains(t, e.ResponseBody, "Added new Transaction")
+
+	e = ms.journal[1]
+	require.Equal(t, "POST /vault/tokens/{token}/detokenize", e.Route)
+	require.Equal(t, redacted, e.RequestHeader.Get("Authorization"))
+	require.Equal(t, http.StatusOK, e.Status)
+	require.NotContains(t, e.ResponseBody, "4242424242424242")
+	require.Contains(t, e.ResponseBody, redacted)
+	require.Equal(t, "connection aborted", ms.journal[2].Error)
+
+	for _, target := range []string{"/admin/requests?status=a", "/admin/requests?from=yesterday", "/admin/requests?page=-1"} {
+		req = httptest.NewRequest("GET", target, nil)
+		req.SetBasicAuth("username", "password")
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusBadRequest, rr.Code, target)
+	}
+
+	require.Equal(t, `{"cvc":"`+redacted+`","ok":[{"number":"`+redacted+`"}]}`, journalBody([]byte(`{"ok": [{"number": "4242"}], "cvc": 123}`), false))
+	require.Equal(t, `[{"number":"`+redacted+`"...[truncated]`, journalBody([]byte(`[{"number": "42424242`), true))
+	require.Equal(t, "[binary, 2 bytes]", journalBody([]byte{0xff, 0xfe}, false))
+	require.Equal(t, "caf...[truncated]", journalBody([]byte("caf\xc3"), true))
+}
+
+func TestTransactionMetadata(t *testing.T) {
+	api = &MockServer{}
+	router := mux.NewRouter()
+	router.Handle("/transactions", errorHandler(GetUserTransactionsHandler())).Methods("GET")
+	router.Handle("/transactions/{id}", errorHandler(GetTransactionStatusHandler())).Methods("GET")
+	router.Handle("/transactions/{id}", errorHandler(UpdateTransactionHandler())).Methods("PATCH")
+	router.Handle("/transaction", errorHandler(CreateTransactionHandler())).Methods("POST")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/transactions/1", nil))
+	require.Equal(t, http.StatusFound, rr.Code)
+	require.JSONEq(t, `{"id": 1, "transaction_status": "НОВЫЙ", "metadata": {"order_id": "A-1"}, "merchant_reference": ""}`, rr.Body.String())
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/transactions/3", nil))
+	require.JSONEq(t, `{"id": 3, "transaction_status": "НОВЫЙ", "metadata": {}, "merchant_reference": ""}`, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/transactions?metadata[order_id]=A-1", nil))
+	require.Equal(t, http.StatusFound, rr.Code)
+	ts := make([]Transaction, 0)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &ts))
+	require.Len(t, ts, 1)
+	require.Equal(t, map[string]string{"order_id": "A-1"}, ts[0].Metadata)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/transactions?merchant_reference=ref-2", nil))
+	require.Equal(t, http.StatusFound, rr.Code)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &ts))
+	require.Len(t, ts, 1)
+	require.Equal(t, 2, ts[0].ID)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/transaction", strings.NewReader(
+		`{"user_id": 1, "email": "exmpl@m.com", "amount": 1.5, "currency": "USD", "metadata": {"order_id": "A-3"}, "merchant_reference": "ref-3"}`,
+	)))
+	require.Equal(t, http.StatusCreated, rr.Code)
+	require.Contains(t, rr.Body.String(), `"metadata":{"order_id":"A-3"}`)
+	require.Contains(t, rr.Body.String(), `"merchant_reference":"ref-3"`)
+
+	tooMany := make(map[string]string)
+	for i := 0; i <= maxMetadataKeys; i++ {
+		tooMany[fmt.Sprint("key", i)] = "val"
+	}
+	manyKeys, _ := json.Marshal(tooMany)
+	for _, c := range []struct {
+		method, target, body string
+		code                 int
+	}{
+		{"GET", "/transactions?metadata[order_id]=A-2", "", http.StatusFound},
+		{"GET", "/transactions?metadata[order_id]=A-1&user_id=NaN", "", http.StatusBadRequest},
+		{"POST", "/transaction", `{"user_id": 1, "email": "exmpl@m.com", "amount": 1.5, "currency": "USD", "metadata": {"order_id": ""}}`, http.StatusBadRequest},
+		{"POST", "/transaction", `{"user_id": 1, "email": "exmpl@m.com", "amount": 1.5, "currency": "USD", "metadata": ` + string(manyKeys) + `}`, http.StatusBadRequest},
+		{"POST", "/transaction", `{"user_id": 1, "email": "exmpl@m.com", "amount": 1.5, "currency": "USD", "metadata": {"` + strings.Repeat("k", 41) + `": "v"}}`, http.StatusBadRequest},
+		{"POST", "/transaction", `{"user_id": 1, "email": "exmpl@m.com", "amount": 1.5, "currency": "USD", "merchant_reference": "` + strings.Repeat("r", 101) + `"}`, http.StatusBadRequest},
+		{"PATCH", "/transactions/1", `{"metadata": {"order_id": "A-4", "cart": ""}}`, http.StatusOK},
+		{"PATCH", "/transactions/1", `{"merchant_reference": "ref-2"}`, http.StatusConflict},
+		{"PATCH", "/transactions/404", `{"merchant_reference": ""}`, http.StatusNotFound},
+		{"PATCH", "/transactions/1", `{}`, http.StatusBadRequest},
+		{"PATCH", "/transactions/1", `{"metadata": {"order_id": "` + strings.Repeat("v", 501) + `"}}`, http.StatusBadRequest},
+		{"PATCH", "/transactions/NaN", `{"metadata": {"order_id": "A-4"}}`, http.StatusBadRequest},
+	} {
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(c.method, c.target, strings.NewReader(c.body)))
+		require.Equal(t, c.code, rr.Code, c.target+" "+c.body)
+	}
+}
+
+func TestCustomers(t *testing.T) {
+	api = &MockServer{}
+	router := mux.NewRouter()
+	router.Handle("/customers", basicAuth(errorHandler(CreateCustomerHandler()))).Methods("POST")
+	router.Handle("/customers", errorHandler(GetCustomersHandler())).Methods("GET")
+	router.Handle("/customers/{id}", errorHandler(GetCustomerHandler())).Methods("GET")
+	router.Handle("/customers/{id}", basicAuth(errorHandler(UpdateCustomerHandler()))).Methods("PATCH")
+	router.Handle("/customers/{id}", basicAuth(errorHandler(DeleteCustomerHandler()))).Methods("DELETE")
+	router.Handle("/customers/{id}/transactions", errorHandler(GetCustomerTransactionsHandler())).Methods("GET")
+	router.Handle("/customers/{id}/payment-methods", basicAuth(errorHandler(SavePaymentMethodHandler()))).Methods("POST")
+	router.Handle("/customers/{id}/payment-methods", errorHandler(GetCustomerPaymentMethodsHandler())).Methods("GET")
+	router.Handle("/customers/{id}/payment-methods/{pm_id}", basicAuth(errorHandler(DetachPaymentMethodHandler()))).Methods("DELETE")
+	router.Handle("/transaction", errorHandler(CreateTransactionHandler())).Methods("POST")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/customers/1/transactions", nil))
+	require.Equal(t, http.StatusFound, rr.Code)
+	ts := make([]Transaction, 0)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &ts))
+	require.Len(t, ts, 1)
+	require.Equal(t, 1, ts[0].CustomerID)
+
+	req := httptest.NewRequest("POST", "/customers/1/payment-methods", strings.NewReader(`{"type": "wallet", "wallet": {"provider": "paypal"}}`))
+	req.SetBasicAuth("username", "password")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code)
+	pm := new(PaymentMethod)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), pm))
+	require.Equal(t, 1, pm.CustomerID)
+
+	long := strings.Repeat("a", 51)
+	for _, c := range []struct {
+		method, target, body string
+		code                 int
+	}{
+		{"POST", "/customers", `{"user_id": 2, "email": "exmpl@m.com", "name": "Ivan"}`, http.StatusCreated},
+		{"POST", "/customers", `{"user_id": 1, "email": "exmpl@m.com"}`, http.StatusConflict},
+		{"POST", "/customers", `{"user_id": 2}`, http.StatusBadRequest},
+		{"POST", "/customers", `{"user_id": -2, "email": "exmpl@m.com"}`, http.StatusBadRequest},
+		{"POST", "/customers", `{"user_id": 2, "email": "` + long + `"}`, http.StatusBadRequest},
+		{"POST", "/customers", `{"user_id": 2, "email": "exmpl@m.com", "name": "` + strings.Repeat(long, 2) + `"}`, http.StatusBadRequest},
+		{"GET", "/customers?email=exmpl@m.com", "", http.StatusFound},
+		{"GET", "/customers?user_id=NaN", "", http.StatusBadRequest},
+		{"GET", "/customers/1", "", http.StatusFound},
+		{"GET", "/customers/404", "", http.StatusNotFound},
+		{"GET", "/customers/NaN", "", http.StatusBadRequest},
+		{"PATCH", "/customers/1", `{"email": "new@m.com"}`, http.StatusOK},
+		{"PATCH", "/customers/1", `{"email": ""}`, http.StatusBadRequest},
+		{"PATCH", "/customers/1", `{}`, http.StatusBadRequest},
+		{"PATCH", "/customers/404", `{"name": "Ivan"}`, http.StatusNotFound},
+		{"DELETE", "/customers/1", "", http.StatusConflict},
+		{"DELETE", "/customers/2", "", http.StatusOK},
+		{"DELETE", "/customers/404", "", http.StatusNotFound},
+		{"GET", "/customers/404/transactions", "", http.StatusNotFound},
+		{"GET", "/customers/1/transactions?page=NaN", "", http.StatusBadRequest},
+		{"POST", "/customers/404/payment-methods", `{"type": "wallet", "wallet": {"provider": "paypal"}}`, http.StatusNotFound},
+		{"POST", "/customers/1/payment-methods", `{"type": "wallet", "wallet": {"provider": "unknown"}}`, http.StatusBadRequest},
+		{"GET", "/customers/1/payment-methods", "", http.StatusFound},
+		{"GET", "/customers/404/payment-methods", "", http.StatusNotFound},
+		{"DELETE", "/customers/1/payment-methods/2", "", http.StatusOK},
+		{"DELETE", "/customers/1/payment-methods/3", "", http.StatusNotFound},
+		{"DELETE", "/customers/1/payment-methods/NaN", "", http.StatusBadRequest},
+		{"POST", "/transaction", `{"customer_id": 1, "amount": 1.5, "currency": "USD"}`, http.StatusCreated},
+		{"POST", "/transaction", `{"customer_id": -1, "amount": 1.5, "currency": "USD"}`, http.StatusBadRequest},
+		{"POST", "/transaction", `{"user_id": 1, "amount": 1.5, "currency": "USD"}`, http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+		req.SetBasicAuth("username", "password")
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, c.code, rr.Code, c.method+" "+c.target+" "+c.body)
+	}
+
+	// Customers are changed by the payment system only
+	for _, c := range []struct{ method, target, body string }{
+		{"POST", "/customers", `{"user_id": 2, "email": "exmpl@m.com"}`},
+		{"PATCH", "/customers/1", `{"email": "new@m.com"}`},
+		{"DELETE", "/customers/2", ""},
+		{"POST", "/customers/1/payment-methods", `{"type": "wallet", "wallet": {"provider": "paypal"}}`},
+		{"DELETE", "/customers/1/payment-methods/2", ""},
+	} {
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(c.method, c.target, strings.NewReader(c.body)))
+		require.Equal(t, http.StatusUnauthorized, rr.Code, c.method+" "+c.target)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	c := newCounterVec("test_total", "Test counter.", "route", "code")
+	c.Inc("/a", "200")
+	c.Inc("/a", "200")
+	c.Inc(`/"b"`, "500")
+	var buf strings.Builder
+	c.write(&buf)
+	require.Equal(t, `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{route="/\"b\"",code="500"} 1
+test_total{route="/a",code="200"} 2
+`, buf.String())
+
+	h := newHistogramVec("test_seconds", "Test histogram.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "/a")
+	h.Observe(0.1, "/a")
+	h.Observe(0.5, "/a")
+	h.Observe(3, "/a")
+	buf.Reset()
+	h.write(&buf)
+	require.Equal(t, `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{route="/a",le="0.1"} 2
+test_seconds_bucket{route="/a",le="1"} 3
+test_seconds_bucket{route="/a",le="+Inf"} 4
+test_seconds_sum{route="/a"} 3.65
+test_seconds_count{route="/a"} 4
+`, buf.String())
+
+	httpRequests.values = make(map[string]*counterSeries)
+	httpDuration.series = make(map[string]*histogramSeries)
+	statusTransitions.values = make(map[string]*counterSeries)
+	api = &MockServer{}
+	router := mux.NewRouter()
+	router.Handle("/metrics", errorHandler(MetricsHandler())).Methods("GET")
+	router.Handle("/transactions/{id}", errorHandler(GetTransactionStatusHandler())).Methods("GET")
+	router.Handle("/panic", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	router.Use(instrumenting)
+
+	for _, target := range []string{"/transactions/1", "/transactions/2", "/transactions/NaN", "/unknown"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+	require.Panics(t, func() {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/panic", nil))
+	})
+	statusTransitions.Inc("НОВЫЙ", "УСПЕХ")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Header().Get("content-type"), "text/plain; version=0.0.4")
+	body := rr.Body.String()
+	require.Contains(t, body, `paymulator_http_requests_total{method="GET",route="/transactions/{id}",code="302"} 2`)
+	require.Contains(t, body, `paymulator_http_requests_total{method="GET",route="/transactions/{id}",code="400"} 1`)
+	require.Contains(t, body, `paymulator_http_requests_total{method="GET",route="/panic",code="aborted"} 1`)
+	require.NotContains(t, body, `/unknown`)
+	require.Contains(t, body, `paymulator_http_request_duration_seconds_count{method="GET",route="/transactions/{id}",code="302"} 2`)
+	require.Contains(t, body, `paymulator_db_pool_connections{state="idle"} 3`)
+	require.Contains(t, body, "paymulator_db_pool_acquires_total 42")
+	require.Contains(t, body, "paymulator_db_pool_acquire_duration_seconds_total 1.5")
+	require.Contains(t, body, `paymulator_transaction_status_transitions_total{from="НОВЫЙ",to="УСПЕХ"} 1`)
+}
+
+func TestTracing(t *testing.T) {
+	tc, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.True(t, ok)
+	require.True(t, tc.sampled)
+	require.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", tc.String())
+	for _, h := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-xyz92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, ok := parseTraceparent(h)
+		require.False(t, ok, h)
+	}
+	_, ok = parseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	require.True(t, ok)
+
+	_, err := newTracer("jaeger", "", "", "")
+	require.Error(t, err)
+	_, err = newTracer("otlp", "localhost:4318", "", "")
+	require.Error(t, err)
+	tr, err := newTracer("", "", "", "")
+	require.NoError(t, err)
+	require.Nil(t, tr)
+
+	// Trace of caller is passed on to webhooks while tracing is disabled
+	received := make(chan string, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("traceparent")
+	}))
+	defer hook.Close()
+	newWebhookSender(hook.URL, "").Send(withRemoteParent(context.Background(), tc), "payout.paid", nil)
+	select {
+	case h := <-received:
+		require.Equal(t, tc.String(), h)
+	case <-time.After(time.Second):
+		t.Fatal("webhook wasn't delivered")
+	}
+
+	tracer, err = newTracer("console", "", "", "")
+	require.NoError(t, err)
+	defer func() { tracer = nil }()
+	api = &MockServer{}
+	router := mux.NewRouter()
+	router.Handle("/transactions/{id}", errorHandler(func(rw http.ResponseWriter, r *http.Request) error {
+		queryTracer{}.Log(r.Context(), pgx.LogLevelInfo, "Query", map[string]interface{}{
+			"sql":      "select id\n\tfrom transactions where id=$1",
+			"args":     []interface{}{1},
+			"time":     time.Millisecond,
+			"rowCount": 1,
+		})
+		newWebhookSender(hook.URL, "").Send(r.Context(), "payout.paid", nil)
+		return &StatusError{http.StatusInternalServerError, fmt.Errorf("error: broken")}
+	})).Methods("GET")
+	router.Use(tracing)
+
+	req := httptest.NewRequest("GET", "/transactions/7?x=1", nil)
+	req.Header.Set("traceparent", tc.String())
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	var hookParent traceContext
+	select {
+	case h := <-received:
+		hookParent, ok = parseTraceparent(h)
+		require.True(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("webhook wasn't delivered")
+	}
+	spans := make(map[string]*span)
+	for len(spans) < 3 {
+		select {
+		case s := <-tracer.spans:
+			spans[s.name] = s
+		case <-time.After(time.Second):
+			t.Fatalf("spans weren't finished: %v", spans)
+		}
+	}
+	server, query, delivery := spans["GET /transactions/{id}"], spans["db Query"], spans["webhook payout.paid"]
+	require.NotNil(t, server)
+	require.NotNil(t, query)
+	require.NotNil(t, delivery)
+	require.Equal(t, tc.traceID, server.traceID)
+	require.Equal(t, tc.spanID, server.parentID)
+	require.Equal(t, spanServer, server.kind)
+	require.Equal(t, "error: broken", server.err)
+	require.Contains(t, server.attrs, spanAttribute{"http.route", "/transactions/{id}"})
+	require.Contains(t, server.attrs, spanAttribute{"http.target", "/transactions/7?x=1"})
+	require.Contains(t, server.attrs, spanAttribute{"http.status_code", 500})
+
+	require.Equal(t, tc.traceID, query.traceID)
+	require.Equal(t, server.spanID, query.parentID)
+	require.Equal(t, spanClient, query.kind)
+	require.Contains(t, query.attrs, spanAttribute{"db.statement", "select id from transactions where id=$1"})
+	require.True(t, query.end.Sub(query.start) >= time.Millisecond)
+	for _, a := range query.attrs {
+		require.NotEqual(t, "args", a.key)
+	}
+
+	require.Equal(t, server.spanID, delivery.parentID)
+	require.Equal(t, delivery.traceContext, hookParent)
+
+	// OTLP/HTTP JSON export
+	bodies := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/traces", r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer collector.Close()
+	otlp, err := newTracer("otlp", collector.URL+"/", "", "")
+	require.NoError(t, err)
+	require.NoError(t, otlp.exporter.export([]*span{server}))
+	var export struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttribute `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	require.NoError(t, json.Unmarshal(<-bodies, &export))
+	require.Equal(t, "paymulator", *export.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+	exported := export.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", exported.TraceID)
+	require.Equal(t, "00f067aa0ba902b7", exported.ParentSpanID)
+	require.Equal(t, spanServer, exported.Kind)
+	require.Equal(t, 2, exported.Status.Code)
+	for _, a := range exported.Attributes {
+		if a.Key == "http.status_code" {
+			require.Equal(t, "500", *a.Value.IntValue)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// Max transactions accepted by a single batch request
+const maxBatchSize = 10000
+
+// batchResult is a per-item outcome of a batch request
+type batchResult struct {
+	Index  int    `json:"index"`
+	ID     int    `json:"id,omitempty"`
+	Status string `json:"transaction_status,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	DeclineCode string      `json:"decline_code,omitempty"`
+	NextAction  *NextAction `json:"next_action,omitempty"`
+}
+
+// decodeBatch reads a JSON array or an NDJSON stream of items one by one.
+// Items of a wrong shape are reported through itemErr, malformed JSON
+// fails the whole request.
+func decodeBatch(r *http.Request, item func() interface{}, itemErr func(int, error)) (int, error) {
+	decoder := json.NewDecoder(r.Body)
+	ndjson := false
+	switch ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct {
+	case "application/x-ndjson", "application/ndjson":
+		ndjson = true
+	}
+	if !ndjson {
+		tok, err := decoder.Token()
+		if err != nil {
+			return 0, &StatusError{http.StatusBadRequest, err}
+		}
+		if d, ok := tok.(json.Delim); !ok || d != '[' {
+			return 0, &StatusError{http.StatusBadRequest, fmt.Errorf("error: expected JSON array or NDJSON stream")}
+		}
+	}
+
+	n := 0
+	for ; ndjson || decoder.More(); n++ {
+		if n == maxBatchSize {
+			return 0, &StatusError{http.StatusRequestEntityTooLarge, fmt.Errorf("error: batch shouldn't be more than %d items", maxBatchSize)}
+		}
+		err := decoder.Decode(item())
+		if ndjson && err == io.EOF {
+			break
+		}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			itemErr(n, err)
+			continue
+		}
+		if err != nil {
+			return 0, &StatusError{http.StatusBadRequest, fmt.Errorf("error: item %d: %s", n, err)}
+		}
+	}
+	return n, nil
+}
+
+// CreateTransactionsBatchHandler..
+func CreateTransactionsBatchHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		defer r.Body.Close()
+		atomic := r.URL.Query().Get("atomic") == "true"
+
+		ts := make([]*Transaction, 0)
+		errs := make(map[int]error)
+		n, err := decodeBatch(
+			r,
+			func() interface{} {
+				ts = append(ts, new(Transaction))
+				return ts[len(ts)-1]
+			},
+			func(i int, err error) { errs[i] = err },
+		)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: batch is empty")}
+		}
+		// NDJSON reader allocates one extra item before hitting EOF
+		ts = ts[:n]
+
+		valid := make([]*Transaction, 0, n)
+		for i, t := range ts {
+			if errs[i] != nil {
+				continue
+			}
+			if t.Scenario == "" {
+				t.Scenario = r.Header.Get(scenarioHeader)
+			}
+			if err := validateTransaction(t); err != nil {
+				errs[i] = err
+				continue
+			}
+			valid = append(valid, t)
+		}
+
+		code := http.StatusCreated
+		switch {
+		case len(valid) == 0 || atomic && len(errs) > 0:
+			code = http.StatusBadRequest
+			valid = nil
+		case len(errs) > 0:
+			code = http.StatusMultiStatus
+		}
+		if len(valid) > 0 {
+			err = api.CreateTransactions(r.Context(), valid)
+			if err != nil {
+				return err
+			}
+		}
+
+		results := make([]batchResult, n)
+		for i, t := range ts {
+			results[i].Index = i
+			switch {
+			case errs[i] != nil:
+				results[i].Error = errs[i].Error()
+			case code == http.StatusBadRequest:
+				results[i].Error = "error: batch rejected"
+			default:
+				results[i].ID = t.ID
+				results[i].Status = t.Status
+				results[i].DeclineCode = t.DeclineCode
+				results[i].NextAction = t.NextAction
+			}
+		}
+		resp := map[string]interface{}{
+			"created": len(valid),
+			"failed":  n - len(valid),
+			"results": results,
+		}
+		data, _ := json.Marshal(resp)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(code)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// statusBatchRequest is either a list of changes, or a filter and a target status
+type statusBatchRequest struct {
+	Items  []Transaction `json:"items"`
+	Filter *struct {
+		UserID int    `json:"user_id"`
+		Email  string `json:"email"`
+		Status string `json:"transaction_status"`
+	} `json:"filter"`
+	Status string `json:"transaction_status"`
+	Atomic bool   `json:"atomic"`
+}
+
+// changes resolves request into a list of status changes
+func (req *statusBatchRequest) changes(ctx context.Context) ([]Transaction, error) {
+	if req.Filter == nil {
+		return req.Items, nil
+	}
+	if len(req.Items) > 0 {
+		return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: either 'items' or 'filter' should be provided")}
+	}
+
+	var (
+		ts  []Transaction
+		err error
+	)
+	switch {
+	case req.Filter.UserID != 0:
+		ts, err = api.GetUserTransactionsByID(ctx, req.Filter.UserID)
+	case req.Filter.Email != "":
+		ts, err = api.GetUserTransactionsByEmail(ctx, req.Filter.Email)
+	default:
+		return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: no 'user_id' or 'email' provided in filter")}
+	}
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]Transaction, 0, len(ts))
+	for _, t := range ts {
+		if req.Filter.Status == "" || t.Status == req.Filter.Status {
+			changes = append(changes, Transaction{ID: t.ID, Status: req.Status})
+		}
+	}
+	return changes, nil
+}
+
+// ChangeTransactionStatusesBatchHandler..
+func ChangeTransactionStatusesBatchHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		req := new(statusBatchRequest)
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err := decoder.Decode(req)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		changes, err := req.changes(r.Context())
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(changes) == 0:
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: no transactions to change")}
+		case len(changes) > maxBatchSize:
+			return &StatusError{http.StatusRequestEntityTooLarge, fmt.Errorf("error: batch shouldn't be more than %d items", maxBatchSize)}
+		}
+
+		errs := make([]error, len(changes))
+		valid := make([]Transaction, 0, len(changes))
+		index := make([]int, 0, len(changes))
+		for i := range changes {
+			if err := validateStatusChange(&changes[i]); err != nil {
+				errs[i] = err
+				continue
+			}
+			valid = append(valid, changes[i])
+			index = append(index, i)
+		}
+		if req.Atomic && len(valid) < len(changes) || len(valid) == 0 {
+			valid = nil
+		}
+		if len(valid) > 0 {
+			results, err := api.ChangeTransactionStatuses(r.Context(), valid, req.Atomic)
+			if err != nil {
+				return err
+			}
+			for i, err := range results {
+				errs[index[i]] = err
+			}
+		}
+
+		changed := 0
+		results := make([]batchResult, len(changes))
+		for i, c := range changes {
+			results[i] = batchResult{Index: i, ID: c.ID}
+			if errs[i] != nil {
+				results[i].Error = errs[i].Error()
+				continue
+			}
+			results[i].Status = c.Status
+			changed++
+		}
+		code := http.StatusOK
+		switch {
+		case changed > 0 && changed < len(changes) && req.Atomic:
+			// Valid changes were rolled back together with invalid ones
+			for i := range results {
+				if results[i].Error == "" {
+					results[i].Status = ""
+					results[i].Error = "error: batch rejected"
+				}
+			}
+			changed = 0
+			code = http.StatusConflict
+		case changed == 0:
+			code = http.StatusConflict
+		case changed < len(changes):
+			code = http.StatusMultiStatus
+		}
+		resp := map[string]interface{}{
+			"changed": changed,
+			"failed":  len(changes) - changed,
+			"results": results,
+		}
+		data, _ := json.Marshal(resp)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(code)
+		rw.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,198 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+// Transactions waiting for 3-D Secure challenge to be passed
+const statusRequiresAction = "ТРЕБУЕТ_ДЕЙСТВИЯ"
+
+// Card outcome requiring 3-D Secure challenge before authorization
+const outcomeRequiresAction = "requires_action"
+
+// Decline code of a denied challenge
+const declineAuthenticationFailed = "authentication_failed"
+
+// NextAction tells client what to do with a transaction requiring action
+type NextAction struct {
+	Type        string `json:"type"`
+	RedirectURL string `json:"redirect_url"`
+}
+
+func newChallengeToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// nextAction points to the built-in challenge page
+func nextAction(publicURL, token string) *NextAction {
+	return &NextAction{Type: "redirect_to_url", RedirectURL: publicURL + "/3ds/" + token}
+}
+
+func (s *ApiServer) challengeTransaction(ctx context.Context, tx pgx.Tx, token string) (*Transaction, error) {
+	t := new(Transaction)
+	err := scanTransaction(tx.QueryRow(
+		ctx,
+		"select "+transactionColumns+" from transactions where challenge_token=$1 for update",
+		token,
+	), t)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: challenge not found")}
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+// GetChallenge returns transaction being authenticated by challenge token
+func (s *ApiServer) GetChallenge(ctx context.Context, token string) (*Transaction, error) {
+	tx, err := s.database.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	return s.challengeTransaction(ctx, tx, token)
+}
+
+// CompleteChallenge continues transaction as new if approved, declines it otherwise
+func (s *ApiServer) CompleteChallenge(ctx context.Context, token string, approve bool) (*Transaction, error) {
+	tx, err := s.database.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	t, err := s.challengeTransaction(ctx, tx, token)
+	if err != nil {
+		return nil, err
+	}
+	if t.Status != statusRequiresAction {
+		return nil, &StatusError{http.StatusConflict, fmt.Errorf("error: challenge is already completed")}
+	}
+	st, declineCode := "НОВЫЙ", ""
+	if !approve {
+		st, declineCode = "ОШИБКА", declineAuthenticationFailed
+	}
+	err = tx.QueryRow(
+		ctx,
+		"update transactions set transaction_status=$1, decline_code=$2, changed_at=$3 where id=$4 returning changed_at",
+		st,
+		declineCode,
+		clock.Now(),
+		t.ID,
+	).Scan(&t.Changed_at)
+	if err != nil {
+		return nil, err
+	}
+	err = postLedger(ctx, tx, statusPosting(t, t.Status, st))
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statusTransitions.Inc(t.Status, st)
+	t.Status, t.DeclineCode = st, declineCode
+	hub.Publish(StatusEvent{t.ID, st, t.Changed_at})
+	return t, nil
+}
+
+var challengePage = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>3-D Secure</title>
+<style>
+body { font-family: sans-serif; max-width: 420px; margin: 60px auto; text-align: center; }
+button { font-size: 16px; padding: 8px 24px; margin: 8px; }
+</style>
+</head>
+<body>
+<h2>3-D Secure test challenge</h2>
+<p>Transaction #{{.ID}}: {{.Amount}} {{.Currency}}</p>
+{{if eq .Status "ТРЕБУЕТ_ДЕЙСТВИЯ"}}
+<form method="post">
+<button name="decision" value="approve">Approve</button>
+<button name="decision" value="deny">Deny</button>
+</form>
+{{else}}
+<p>Challenge completed, transaction status: <b>{{.Status}}</b></p>
+{{end}}
+</body>
+</html>
+`))
+
+// validReturnURL accepts only absolute http(s) URLs
+func validReturnURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// challengeRedirect tells where to send tester after challenge, empty if transaction has no return_url
+func challengeRedirect(t *Transaction) string {
+	if t.ReturnURL == "" {
+		return ""
+	}
+	u, err := url.Parse(t.ReturnURL)
+	if err != nil {
+		return ""
+	}
+	q := u.Query()
+	q.Set("id", strconv.Itoa(t.ID))
+	q.Set("transaction_status", t.Status)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// ChallengePageHandler..
+func ChallengePageHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		t, err := api.GetChallenge(r.Context(), mux.Vars(r)["token"])
+		if err != nil {
+			return err
+		}
+		rw.Header().Add("content-type", "text/html; charset=utf-8")
+		rw.WriteHeader(http.StatusOK)
+		challengePage.Execute(rw, t)
+		return nil
+	}
+}
+
+// CompleteChallengeHandler..
+func CompleteChallengeHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		var approve bool
+		switch decision := r.FormValue("decision"); decision {
+		case "approve":
+			approve = true
+		case "deny":
+		default:
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: decision should be one of: approve, deny")}
+		}
+
+		t, err := api.CompleteChallenge(r.Context(), mux.Vars(r)["token"], approve)
+		if err != nil {
+			return err
+		}
+		if to := challengeRedirect(t); to != "" {
+			http.Redirect(rw, r, to, http.StatusSeeOther)
+			return nil
+		}
+		rw.Header().Add("content-type", "text/html; charset=utf-8")
+		rw.WriteHeader(http.StatusOK)
+		challengePage.Execute(rw, t)
+		return nil
+	}
+}
@@ -0,0 +1,263 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Faults injected by chaos middleware
+const (
+	faultError              = "error"
+	faultDrop               = "drop"
+	faultTruncate           = "truncate"
+	faultTimeoutAfterCommit = "timeout_after_commit"
+)
+
+// Request headers forcing faults regardless of rules
+const (
+	chaosLatencyHeader = "X-Chaos-Latency"
+	chaosFaultHeader   = "X-Chaos-Fault"
+	chaosStatusHeader  = "X-Chaos-Status"
+)
+
+var chaosErrorCodes = []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// chaosLatency is a delay distribution in milliseconds:
+// fixed (ms), uniform (min_ms..max_ms), normal (ms, stddev_ms) or exponential (mean ms).
+// Normal and exponential delays are clamped to min_ms..max_ms when max_ms is set.
+type chaosLatency struct {
+	Distribution string  `json:"distribution"`
+	Ms           float64 `json:"ms"`
+	StddevMs     float64 `json:"stddev_ms"`
+	MinMs        float64 `json:"min_ms"`
+	MaxMs        float64 `json:"max_ms"`
+}
+
+// chaosRule injects faults into matching requests, configured by CHAOS_RULES
+// environment variable as JSON array. The first matching rule applies.
+type chaosRule struct {
+	// Method and path template of a route, like "POST /transaction"; empty matches every route
+	Route      string        `json:"route"`
+	MerchantID *int          `json:"merchant_id"`
+	Latency    *chaosLatency `json:"latency"`
+	// Probabilities of faults, their sum shouldn't exceed 1
+	ErrorRate              float64 `json:"error_rate"`
+	ErrorCodes             []int   `json:"error_codes"`
+	DropRate               float64 `json:"drop_rate"`
+	TruncateRate           float64 `json:"truncate_rate"`
+	TimeoutAfterCommitRate float64 `json:"timeout_after_commit_rate"`
+}
+
+var chaosRules []chaosRule
+
+func parseChaosRules(s string) ([]chaosRule, error) {
+	rules := make([]chaosRule, 0)
+	if s == "" {
+		return rules, nil
+	}
+	err := json.Unmarshal([]byte(s), &rules)
+	if err != nil {
+		return nil, fmt.Errorf("error: can't parse CHAOS_RULES: %s", err)
+	}
+	for i, r := range rules {
+		rates := []float64{r.ErrorRate, r.DropRate, r.TruncateRate, r.TimeoutAfterCommitRate}
+		sum := 0.0
+		for _, rate := range rates {
+			if rate < 0 {
+				return nil, fmt.Errorf("error: CHAOS_RULES: rates can't be negative")
+			}
+			sum += rate
+		}
+		if sum > 1 {
+			return nil, fmt.Errorf("error: CHAOS_RULES: sum of rates of rule %d exceeds 1", i)
+		}
+		if len(r.ErrorCodes) == 0 {
+			rules[i].ErrorCodes = chaosErrorCodes
+		}
+		if l := r.Latency; l != nil {
+			switch l.Distribution {
+			case "", "fixed", "uniform", "normal", "exponential":
+			default:
+				return nil, fmt.Errorf("error: CHAOS_RULES: there is no distribution like '%s'; available distributions: fixed,uniform,normal,exponential", l.Distribution)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// delay draws a latency from distribution
+func (l *chaosLatency) delay(rnd *rand.Rand) time.Duration {
+	ms := l.Ms
+	switch l.Distribution {
+	case "uniform":
+		ms = l.MinMs + rnd.Float64()*(l.MaxMs-l.MinMs)
+	case "normal":
+		ms = l.Ms + rnd.NormFloat64()*l.StddevMs
+	case "exponential":
+		ms = rnd.ExpFloat64() * l.Ms
+	}
+	if l.MaxMs > 0 {
+		ms = math.Min(ms, l.MaxMs)
+	}
+	ms = math.Max(ms, l.MinMs)
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// chaosPlan is what chaos middleware does to a request
+type chaosPlan struct {
+	delay  time.Duration
+	fault  string
+	status int
+}
+
+func (r *chaosRule) matches(route string, merchantID *int) bool {
+	if r.Route != "" && r.Route != route {
+		return false
+	}
+	return r.MerchantID == nil || merchantID != nil && *r.MerchantID == *merchantID
+}
+
+// planChaos picks delay and fault of a request by headers, or by the first matching rule
+func planChaos(rules []chaosRule, route string, merchantID *int, h http.Header, rnd *rand.Rand) (chaosPlan, error) {
+	plan := chaosPlan{}
+	for i := range rules {
+		r := &rules[i]
+		if !r.matches(route, merchantID) {
+			continue
+		}
+		if r.Latency != nil {
+			plan.delay = r.Latency.delay(rnd)
+		}
+		roll := rnd.Float64()
+		switch {
+		case roll < r.ErrorRate:
+			plan.fault, plan.status = faultError, r.ErrorCodes[rnd.Intn(len(r.ErrorCodes))]
+		case roll < r.ErrorRate+r.DropRate:
+			plan.fault = faultDrop
+		case roll < r.ErrorRate+r.DropRate+r.TruncateRate:
+			plan.fault = faultTruncate
+		case roll < r.ErrorRate+r.DropRate+r.TruncateRate+r.TimeoutAfterCommitRate:
+			plan.fault = faultTimeoutAfterCommit
+		}
+		break
+	}
+
+	if val := h.Get(chaosLatencyHeader); val != "" {
+		d, err := time.ParseDuration(val)
+		if err != nil || d < 0 || d > time.Minute {
+			return plan, &StatusError{http.StatusBadRequest, fmt.Errorf("error: %s should be a duration up to 1m", chaosLatencyHeader)}
+		}
+		plan.delay = d
+	}
+	if val := h.Get(chaosFaultHeader); val != "" {
+		switch val {
+		case faultError:
+			plan.fault, plan.status = faultError, http.StatusInternalServerError
+			if code := h.Get(chaosStatusHeader); code != "" {
+				status, err := strconv.Atoi(code)
+				if err != nil || status < 500 || status > 599 {
+					return plan, &StatusError{http.StatusBadRequest, fmt.Errorf("error: %s should be 5xx", chaosStatusHeader)}
+				}
+				plan.status = status
+			}
+		case faultDrop, faultTruncate, faultTimeoutAfterCommit:
+			plan.fault = val
+		case "none":
+			plan.fault = ""
+		default:
+			return plan, &StatusError{
+				http.StatusBadRequest,
+				fmt.Errorf("error: there is no fault like '%s'; available faults: error,drop,truncate,timeout_after_commit,none", val),
+			}
+		}
+	}
+	return plan, nil
+}
+
+// bufferedResponse holds response of handler so chaos can mangle it
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// chaos injects latency and faults configured by rules or request headers
+func chaos(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := requestRoute(r)
+		var merchantID *int
+		for _, rule := range chaosRules {
+			if rule.MerchantID != nil {
+				merchantID = requestMerchantID(r)
+				break
+			}
+		}
+		plan, err := planChaos(chaosRules, route, merchantID, r.Header, chaosRand())
+		if err != nil {
+			errorHandler(func(http.ResponseWriter, *http.Request) error { return err }).ServeHTTP(w, r)
+			return
+		}
+		if plan.delay == 0 && plan.fault == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		log.Printf("Chaos %s: delay %v, fault '%s'", route, plan.delay, plan.fault)
+		select {
+		case <-time.After(plan.delay):
+		case <-r.Context().Done():
+			return
+		}
+		switch plan.fault {
+		case faultError:
+			http.Error(w, http.StatusText(plan.status), plan.status)
+		case faultDrop:
+			// Connection is closed without response
+			panic(http.ErrAbortHandler)
+		case faultTruncate:
+			buf := &bufferedResponse{header: w.Header()}
+			next.ServeHTTP(buf, r)
+			w.Header().Set("content-length", strconv.Itoa(buf.body.Len()))
+			if buf.status == 0 {
+				buf.status = http.StatusOK
+			}
+			w.WriteHeader(buf.status)
+			w.Write(buf.body.Bytes()[:buf.body.Len()/2])
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			panic(http.ErrAbortHandler)
+		case faultTimeoutAfterCommit:
+			// Request is handled, but client never gets the response
+			next.ServeHTTP(&bufferedResponse{header: make(http.Header)}, r)
+			panic(http.ErrAbortHandler)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// chaosRand is a random source of a single request, math/rand sources aren't safe for concurrent use
+func chaosRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
@@ -0,0 +1,267 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Scheduled jobs are run once per interval, each of them is due by virtual time
+const schedulerInterval = 10 * time.Second
+
+// virtualClock runs along wall clock shifted by offset, or stands still while frozen
+type virtualClock struct {
+	mu     sync.Mutex
+	wall   func() time.Time
+	offset time.Duration
+	frozen *time.Time
+}
+
+// clock is used for every timestamp, deadline and scheduled job of the service,
+// tests may replace it with one running on their own wall
+var clock = &virtualClock{wall: time.Now}
+
+// ClockState is the virtual time as reported to admins
+type ClockState struct {
+	Now    time.Time `json:"now"`
+	Frozen bool      `json:"frozen"`
+	Offset string    `json:"offset"`
+}
+
+func (c *virtualClock) now() time.Time {
+	if c.frozen != nil {
+		return *c.frozen
+	}
+	return c.wall().UTC().Add(c.offset).Truncate(time.Microsecond)
+}
+
+// Now is truncated to microseconds, timestamps keep their value through database
+func (c *virtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now()
+}
+
+func (c *virtualClock) state() ClockState {
+	return ClockState{c.now(), c.frozen != nil, c.offset.String()}
+}
+
+// State reports current virtual time
+func (c *virtualClock) State() ClockState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state()
+}
+
+// Freeze stops the clock at current time
+func (c *virtualClock) Freeze() ClockState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.frozen = &now
+	return c.state()
+}
+
+// Resume lets frozen clock go on from where it stopped
+func (c *virtualClock) Resume() ClockState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.frozen != nil {
+		c.offset = c.frozen.Sub(c.wall().UTC())
+		c.frozen = nil
+	}
+	return c.state()
+}
+
+// Advance moves the clock forward by d, frozen one stays frozen
+func (c *virtualClock) Advance(d time.Duration) ClockState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.frozen != nil {
+		t := c.frozen.Add(d)
+		c.frozen = &t
+	} else {
+		c.offset += d
+	}
+	return c.state()
+}
+
+// Set moves the clock to t, frozen one stays frozen
+func (c *virtualClock) Set(t time.Time) ClockState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t = t.UTC().Truncate(time.Microsecond)
+	if c.frozen != nil {
+		c.frozen = &t
+	} else {
+		c.offset = t.Sub(c.wall().UTC())
+	}
+	return c.state()
+}
+
+// Reset returns to wall time
+func (c *virtualClock) Reset() ClockState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offset, c.frozen = 0, nil
+	return c.state()
+}
+
+// businessDay is the start of UTC day of t
+func businessDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// closeDueSettlements closes every business day passed since the last one
+// closed and pays out merchant available balances
+func (s *ApiServer) closeDueSettlements(ctx context.Context) ([]Settlement, error) {
+	s.settlementMu.Lock()
+	defer s.settlementMu.Unlock()
+
+	settlements := make([]Settlement, 0)
+	today := businessDay(clock.Now())
+	for day := s.settledThrough.AddDate(0, 0, 1); day.Before(today); day = day.AddDate(0, 0, 1) {
+		closed, err := s.CloseSettlements(ctx, day)
+		if err != nil {
+			return settlements, fmt.Errorf("settlement of %s failed - %s", day.Format(businessDateLayout), err)
+		}
+		settlements = append(settlements, closed...)
+		s.settledThrough = day
+		log.Printf("Settled %s: %d batches", day.Format(businessDateLayout), len(closed))
+
+		payouts, err := s.PayoutBalances(ctx)
+		if err != nil {
+			return settlements, fmt.Errorf("scheduled payouts failed - %s", err)
+		}
+		log.Printf("Scheduled %d payouts", len(payouts))
+	}
+	return settlements, nil
+}
+
+// RunScheduledJobs does everything got due by the clock: closes business
+// days, moves payouts, expires disputes, renews subscriptions and does scenario steps
+func (s *ApiServer) RunScheduledJobs(ctx context.Context) (*JobsReport, error) {
+	r := new(JobsReport)
+	var err error
+	r.Settlements, err = s.closeDueSettlements(ctx)
+	if err != nil {
+		return r, err
+	}
+	r.Payouts, err = s.AdvancePayouts(ctx)
+	if err != nil {
+		return r, fmt.Errorf("payouts processing failed - %s", err)
+	}
+	r.Disputes, err = s.ExpireDisputes(ctx)
+	if err != nil {
+		return r, fmt.Errorf("disputes expiry failed - %s", err)
+	}
+	r.SubscriptionCharges, err = s.BillSubscriptions(ctx)
+	if err != nil {
+		return r, fmt.Errorf("subscriptions billing failed - %s", err)
+	}
+	r.ScenarioSteps, err = s.AdvanceScenarios(ctx)
+	if err != nil {
+		return r, fmt.Errorf("scenarios failed - %s", err)
+	}
+	return r, nil
+}
+
+// runScheduler runs scheduled jobs on wall clock ticks, scenario steps on their own shorter ones
+func runScheduler(ctx context.Context) {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+	scenarioTicker := time.NewTicker(scenarioInterval)
+	defer scenarioTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-scenarioTicker.C:
+			// Each run is a trace of its own, queries of the run are grouped under it
+			runCtx, s := startSpan(ctx, "scenario steps", spanInternal)
+			_, err := api.AdvanceScenarios(runCtx)
+			if err != nil {
+				s.SetError(err)
+				log.Printf("Scenario steps failed - %s", err)
+			}
+			s.End()
+		case <-ticker.C:
+			runCtx, s := startSpan(ctx, "scheduled jobs", spanInternal)
+			_, err := api.RunScheduledJobs(runCtx)
+			if err != nil {
+				s.SetError(err)
+				log.Printf("Scheduled jobs failed - %s", err)
+			}
+			s.End()
+		}
+	}
+}
+
+// GetClockHandler..
+func GetClockHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		data, _ := json.Marshal(clock.State())
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// ChangeClockHandler..
+func ChangeClockHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		var req struct {
+			Action  string    `json:"action"`
+			Advance string    `json:"advance"`
+			Time    time.Time `json:"time"`
+		}
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err := decoder.Decode(&req)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+
+		var state ClockState
+		switch req.Action {
+		case "freeze":
+			state = clock.Freeze()
+		case "resume":
+			state = clock.Resume()
+		case "reset":
+			state = clock.Reset()
+		case "advance":
+			d, err := time.ParseDuration(req.Advance)
+			if err != nil || d <= 0 {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: advance should be a positive duration like '720h'")}
+			}
+			state = clock.Advance(d)
+		case "set":
+			if req.Time.IsZero() {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: time")}
+			}
+			state = clock.Set(req.Time)
+		default:
+			return &StatusError{
+				http.StatusBadRequest,
+				fmt.Errorf("error: there is no action like '%s'; available actions: freeze,resume,advance,set,reset", req.Action),
+			}
+		}
+
+		// Jobs got due are done before reply, so tests see their outcome right away
+		jobs, err := api.RunScheduledJobs(r.Context())
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(map[string]interface{}{"clock": state, "jobs": jobs})
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(data)
+		return nil
+	}
+}
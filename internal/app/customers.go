@@ -0,0 +1,566 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// Limits of customer contact details
+const (
+	maxEmailLength        = 50
+	maxCustomerNameLength = 100
+)
+
+// CustomerFilter narrows down customers list. Zero values match everything.
+type CustomerFilter struct {
+	UserID int
+	Email  string
+}
+
+const customerColumns = "id, user_id, email, name, created_at, changed_at"
+
+func scanCustomer(row pgx.Row, c *Customer) error {
+	return row.Scan(&c.ID, &c.UserID, &c.Email, &c.Name, &c.Created_at, &c.Changed_at)
+}
+
+func getCustomer(ctx context.Context, q queryRower, id int) (*Customer, error) {
+	c := new(Customer)
+	err := scanCustomer(q.QueryRow(ctx, "select "+customerColumns+" from customers where id=$1", id), c)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: customer not found")}
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// ensureCustomer finds customer of the user, or creates one with the email
+// on first payment. Email of existing customer is changed by its update only.
+func ensureCustomer(ctx context.Context, q queryRower, userID int, email string) (*Customer, error) {
+	c := new(Customer)
+	now := clock.Now()
+	err := scanCustomer(q.QueryRow(
+		ctx,
+		`insert into customers (user_id, email, created_at, changed_at) values ($1,$2,$3,$3)
+		on conflict (user_id) do update set user_id=excluded.user_id returning `+customerColumns,
+		userID,
+		email,
+		now,
+	), c)
+	if err != nil {
+		return nil, err
+	}
+	return c, checkCustomerEmail(c, email)
+}
+
+func checkCustomerEmail(c *Customer, email string) error {
+	if c.Email != email {
+		return &StatusError{http.StatusConflict, fmt.Errorf("error: email doesn't match customer %d of user_id %d", c.ID, c.UserID)}
+	}
+	return nil
+}
+
+// resolveCustomers links new transactions to their customers. Transactions
+// with customer_id take user_id and email from it, others are linked by user_id.
+func resolveCustomers(ctx context.Context, q queryRower, ts []*Transaction) error {
+	byID := make(map[int]*Customer)
+	byUser := make(map[int]*Customer)
+	for _, t := range ts {
+		var err error
+		c := byID[t.CustomerID]
+		switch {
+		case t.CustomerID != 0 && c == nil:
+			c, err = getCustomer(ctx, q, t.CustomerID)
+			var se *StatusError
+			if errors.As(err, &se) {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: customer %d not found", t.CustomerID)}
+			}
+		case t.CustomerID == 0:
+			c = byUser[t.UserID]
+			if c == nil {
+				c, err = ensureCustomer(ctx, q, t.UserID, t.Email)
+			} else {
+				err = checkCustomerEmail(c, t.Email)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if t.UserID != 0 && t.UserID != c.UserID || t.Email != "" && t.Email != c.Email {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: user_id and email should match customer %d", c.ID)}
+		}
+		byID[c.ID], byUser[c.UserID] = c, c
+		t.CustomerID, t.UserID, t.Email = c.ID, c.UserID, c.Email
+	}
+	return nil
+}
+
+// customerConflict reports duplicate user_id as conflict
+func customerConflict(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "customers_user_id_key" {
+		return &StatusError{http.StatusConflict, fmt.Errorf("error: customer with this user_id already exists")}
+	}
+	return err
+}
+
+func (s *ApiServer) CreateCustomer(ctx context.Context, c *Customer) error {
+	now := clock.Now()
+	err := scanCustomer(s.database.QueryRow(
+		ctx,
+		`insert into customers (user_id, email, name, created_at, changed_at)
+		values ($1,$2,$3,$4,$4) returning `+customerColumns,
+		c.UserID,
+		c.Email,
+		c.Name,
+		now,
+	), c)
+	if err != nil {
+		return customerConflict(err)
+	}
+	s.webhooks.Send(ctx, "customer.created", c)
+	return nil
+}
+
+func (s *ApiServer) GetCustomer(ctx context.Context, id int) (*Customer, error) {
+	return getCustomer(ctx, s.database, id)
+}
+
+func (s *ApiServer) GetCustomers(ctx context.Context, f CustomerFilter) ([]Customer, error) {
+	rows, err := s.database.Query(
+		ctx,
+		`select `+customerColumns+` from customers
+		where ($1::int = 0 or user_id=$1) and ($2 = '' or email=$2) order by id`,
+		f.UserID,
+		f.Email,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cs := make([]Customer, 0)
+	for rows.Next() {
+		c := Customer{}
+		err = scanCustomer(rows, &c)
+		if err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+	return cs, rows.Err()
+}
+
+// UpdateCustomer changes contact details, subscriptions renewing
+// on behalf of the customer follow its email
+func (s *ApiServer) UpdateCustomer(ctx context.Context, id int, u CustomerUpdate) (*Customer, error) {
+	tx, err := s.database.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	c := new(Customer)
+	err = scanCustomer(tx.QueryRow(
+		ctx,
+		`update customers set email=coalesce($2, email), name=coalesce($3, name), changed_at=$4
+		where id=$1 returning `+customerColumns,
+		id,
+		u.Email,
+		u.Name,
+		clock.Now(),
+	), c)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: customer not found")}
+		}
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, "update subscriptions set email=$2 where user_id=$1", c.UserID, c.Email)
+	if err != nil {
+		return nil, err
+	}
+	// Transactions are searched by email, so it follows the customer
+	_, err = tx.Exec(ctx, "update transactions set email=$2 where customer_id=$1 and email<>$2", c.ID, c.Email)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.webhooks.Send(ctx, "customer.updated", c)
+	return c, nil
+}
+
+// DeleteCustomer removes customer without payments, its saved payment methods are detached
+func (s *ApiServer) DeleteCustomer(ctx context.Context, id int) error {
+	c, err := getCustomer(ctx, s.database, id)
+	if err != nil {
+		return err
+	}
+	var paid bool
+	err = s.database.QueryRow(
+		ctx,
+		`select exists(select 1 from transactions where customer_id=$1)
+		or exists(select 1 from subscriptions where user_id=$2)`,
+		id,
+		c.UserID,
+	).Scan(&paid)
+	if err != nil {
+		return err
+	}
+	if paid {
+		return &StatusError{http.StatusConflict, fmt.Errorf("error: customer has transactions or subscriptions and can't be deleted")}
+	}
+	tag, err := s.database.Exec(ctx, "delete from customers where id=$1", id)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+			return &StatusError{http.StatusConflict, fmt.Errorf("error: customer has transactions or subscriptions and can't be deleted")}
+		}
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return &StatusError{http.StatusNotFound, fmt.Errorf("error: customer not found")}
+	}
+	s.webhooks.Send(ctx, "customer.deleted", c)
+	return nil
+}
+
+// SavePaymentMethod stores payment method for later payments of the customer
+func (s *ApiServer) SavePaymentMethod(ctx context.Context, customerID int, pm *PaymentMethod) error {
+	_, err := getCustomer(ctx, s.database, customerID)
+	if err != nil {
+		return err
+	}
+	pm.CustomerID = customerID
+	return insertPaymentMethod(ctx, s.database, pm)
+}
+
+func (s *ApiServer) GetCustomerPaymentMethods(ctx context.Context, customerID int) ([]PaymentMethod, error) {
+	_, err := getCustomer(ctx, s.database, customerID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.database.Query(
+		ctx,
+		"select "+paymentMethodColumns+" from payment_methods where customer_id=$1 order by id",
+		customerID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	methods := make([]PaymentMethod, 0)
+	for rows.Next() {
+		pm := PaymentMethod{}
+		err = scanPaymentMethod(rows, &pm)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, pm)
+	}
+	return methods, rows.Err()
+}
+
+// DetachPaymentMethod stops keeping payment method for the customer,
+// transactions already paid by it still refer to it
+func (s *ApiServer) DetachPaymentMethod(ctx context.Context, customerID, id int) error {
+	tag, err := s.database.Exec(
+		ctx,
+		"update payment_methods set customer_id=null where id=$1 and customer_id=$2",
+		id,
+		customerID,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return &StatusError{http.StatusNotFound, fmt.Errorf("error: payment method not found")}
+	}
+	return nil
+}
+
+func validateCustomer(c *Customer) error {
+	switch {
+	case c.UserID == 0 || c.Email == "":
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: user_id, email")}
+	case c.UserID < 0:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: user_id shouldn't be negative")}
+	}
+	return validateCustomerUpdate(CustomerUpdate{Email: &c.Email, Name: &c.Name})
+}
+
+func validateCustomerUpdate(u CustomerUpdate) error {
+	switch {
+	case u.Email != nil && *u.Email == "":
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: email can't be empty")}
+	case u.Email != nil && len([]rune(*u.Email)) > maxEmailLength:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: email shouldn't be more than %d characters", maxEmailLength)}
+	case u.Name != nil && len([]rune(*u.Name)) > maxCustomerNameLength:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: name shouldn't be more than %d characters", maxCustomerNameLength)}
+	}
+	return nil
+}
+
+func customerID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, &StatusError{http.StatusBadRequest, fmt.Errorf("error: id is NaN")}
+	}
+	return id, nil
+}
+
+// CreateCustomerHandler..
+func CreateCustomerHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		c := new(Customer)
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err := decoder.Decode(c)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		err = validateCustomer(c)
+		if err != nil {
+			return err
+		}
+
+		err = api.CreateCustomer(r.Context(), c)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(c)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// GetCustomersHandler..
+func GetCustomersHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		query := r.URL.Query()
+		filter := CustomerFilter{Email: query.Get("email")}
+		if val := query.Get("user_id"); val != "" {
+			userID, err := strconv.Atoi(val)
+			if err != nil {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: 'user_id' is NaN")}
+			}
+			filter.UserID = userID
+		}
+		page, err := pageParam(query.Get("page"))
+		if err != nil {
+			return err
+		}
+
+		cs, err := api.GetCustomers(r.Context(), filter)
+		if err != nil {
+			return err
+		}
+		start, end := Paginate(page, 10, len(cs))
+		data, _ := json.Marshal(cs[start:end])
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// GetCustomerHandler..
+func GetCustomerHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := customerID(r)
+		if err != nil {
+			return err
+		}
+		c, err := api.GetCustomer(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(c)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// UpdateCustomerHandler..
+func UpdateCustomerHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := customerID(r)
+		if err != nil {
+			return err
+		}
+		u := CustomerUpdate{}
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err = decoder.Decode(&u)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		if u.Email == nil && u.Name == nil {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: email or name")}
+		}
+		err = validateCustomerUpdate(u)
+		if err != nil {
+			return err
+		}
+
+		c, err := api.UpdateCustomer(r.Context(), id, u)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(c)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// DeleteCustomerHandler..
+func DeleteCustomerHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := customerID(r)
+		if err != nil {
+			return err
+		}
+
+		err = api.DeleteCustomer(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(map[string]interface{}{"message": "Customer deleted", "id": id})
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// GetCustomerTransactionsHandler..
+func GetCustomerTransactionsHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := customerID(r)
+		if err != nil {
+			return err
+		}
+		query := r.URL.Query()
+		page, err := pageParam(query.Get("page"))
+		if err != nil {
+			return err
+		}
+		_, err = api.GetCustomer(r.Context(), id)
+		if err != nil {
+			return err
+		}
+
+		ts := make([]Transaction, 0)
+		filter := ExportFilter{CustomerID: id, Sort: query.Get("sort"), Order: query.Get("order")}
+		err = api.ExportTransactions(r.Context(), filter, func(t *Transaction) error {
+			ts = append(ts, *t)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = sortTransactions(ts, query.Get("sort"), query.Get("order"))
+		if err != nil {
+			return err
+		}
+		start, end := Paginate(page, 10, len(ts))
+		data, _ := json.Marshal(ts[start:end])
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// SavePaymentMethodHandler..
+func SavePaymentMethodHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := customerID(r)
+		if err != nil {
+			return err
+		}
+		req := new(PaymentMethodRequest)
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err = decoder.Decode(req)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		pm, err := newPaymentMethod(req, clock.Now())
+		if err != nil {
+			return err
+		}
+
+		err = api.SavePaymentMethod(r.Context(), id, pm)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(pm)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// GetCustomerPaymentMethodsHandler..
+func GetCustomerPaymentMethodsHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := customerID(r)
+		if err != nil {
+			return err
+		}
+		methods, err := api.GetCustomerPaymentMethods(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(methods)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// DetachPaymentMethodHandler..
+func DetachPaymentMethodHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := customerID(r)
+		if err != nil {
+			return err
+		}
+		pmID, err := strconv.Atoi(mux.Vars(r)["pm_id"])
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: payment method id is NaN")}
+		}
+
+		err = api.DetachPaymentMethod(r.Context(), id, pmID)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(map[string]interface{}{"message": "Payment method detached", "id": pmID})
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(data)
+		return nil
+	}
+}
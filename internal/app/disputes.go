@@ -0,0 +1,497 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// Dispute statuses
+const (
+	disputeNeedsResponse = "needs_response"
+	disputeUnderReview   = "under_review"
+	disputeWon           = "won"
+	disputeLost          = "lost"
+)
+
+// Merchant has this long to submit evidence, otherwise dispute is lost
+const disputeResponseWindow = 7 * 24 * time.Hour
+
+// disputeReasons are accepted reason codes
+var disputeReasons = []string{"fraudulent", "product_not_received", "duplicate", "credit_not_processed", "general"}
+
+// Successful transactions with these cents are disputed automatically, e.g. 10.66
+var magicDisputeCents = map[int]string{
+	66: "fraudulent",
+	67: "product_not_received",
+	68: "duplicate",
+}
+
+func magicDisputeReason(amount float64) string {
+	return magicDisputeCents[int(math.Round(amount*100))%100]
+}
+
+func validDisputeReason(reason string) bool {
+	for _, r := range disputeReasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// DisputeFilter narrows down disputes list. Zero values match everything.
+type DisputeFilter struct {
+	MerchantID    *int
+	TransactionID int
+	Status        string
+}
+
+const disputeColumns = `id, transaction_id, merchant_id, amount, currency, reason_code, status,
+	evidence, evidence_due_by, created_at, changed_at`
+
+func scanDispute(row pgx.Row, d *Dispute) error {
+	return row.Scan(
+		&d.ID,
+		&d.TransactionID,
+		&d.MerchantID,
+		&d.Amount,
+		&d.Currency,
+		&d.ReasonCode,
+		&d.Status,
+		&d.Evidence,
+		&d.EvidenceDueBy,
+		&d.Created_at,
+		&d.Changed_at,
+	)
+}
+
+// openDispute disputes successful transaction t locked by caller's database transaction
+func openDispute(ctx context.Context, tx pgx.Tx, t *Transaction, reason string) (*Dispute, error) {
+	if t.Status != "УСПЕХ" {
+		return nil, &StatusError{http.StatusConflict, fmt.Errorf("error: only successful transactions can be disputed")}
+	}
+	now := clock.Now()
+	d := new(Dispute)
+	err := scanDispute(tx.QueryRow(
+		ctx,
+		`insert into disputes (transaction_id, merchant_id, amount, currency, reason_code, evidence_due_by, created_at, changed_at)
+		values ($1,$2,$3,$4,$5,$6,$7,$7) returning `+disputeColumns,
+		t.ID,
+		t.MerchantID,
+		t.Amount,
+		t.Currency,
+		reason,
+		now.Add(disputeResponseWindow),
+		now,
+	), d)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, &StatusError{http.StatusConflict, fmt.Errorf("error: transaction is already disputed")}
+		}
+		return nil, err
+	}
+	// Disputed amount is held on merchant disputed account until dispute is resolved
+	err = postLedger(ctx, tx, transfer(t, "dispute_opened", merchantAccount(t.MerchantID, "available"), merchantAccount(t.MerchantID, "disputed"), t.Amount))
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// captureTransaction applies side effects of transaction reaching "УСПЕХ":
+// charges fee and opens dispute for magic amounts
+func captureTransaction(ctx context.Context, tx pgx.Tx, t *Transaction) (*Dispute, error) {
+	err := chargeFee(ctx, tx, t)
+	if err != nil {
+		return nil, err
+	}
+	reason := magicDisputeReason(t.Amount)
+	if reason == "" {
+		return nil, nil
+	}
+	// Caller's transaction keeps the status it had before
+	captured := *t
+	captured.Status = "УСПЕХ"
+	return openDispute(ctx, tx, &captured, reason)
+}
+
+func (s *ApiServer) OpenDispute(ctx context.Context, transactionID int, reason string) (*Dispute, error) {
+	tx, err := s.database.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	t := new(Transaction)
+	err = scanTransaction(tx.QueryRow(
+		ctx,
+		"select "+transactionColumns+" from transactions where id=$1 for update",
+		transactionID,
+	), t)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: transaction not found")}
+		}
+		return nil, err
+	}
+	d, err := openDispute(ctx, tx, t, reason)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.webhooks.Send(ctx, "dispute.created", d)
+	return d, nil
+}
+
+// updateDispute locks dispute and its transaction, checks it's still open and applies fn
+func (s *ApiServer) updateDispute(ctx context.Context, id int, fn func(pgx.Tx, *Dispute, *Transaction) error) (*Dispute, error) {
+	tx, err := s.database.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	d := new(Dispute)
+	err = scanDispute(tx.QueryRow(ctx, "select "+disputeColumns+" from disputes where id=$1 for update", id), d)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: dispute not found")}
+		}
+		return nil, err
+	}
+	if d.Status == disputeWon || d.Status == disputeLost {
+		return nil, &StatusError{http.StatusConflict, fmt.Errorf("error: dispute is already %s", d.Status)}
+	}
+	t := new(Transaction)
+	err = scanTransaction(tx.QueryRow(
+		ctx,
+		"select "+transactionColumns+" from transactions where id=$1 for update",
+		d.TransactionID,
+	), t)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fn(tx, d, t)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(
+		ctx,
+		"update disputes set status=$1, evidence=$2, changed_at=$3 where id=$4 returning changed_at",
+		d.Status,
+		d.Evidence,
+		clock.Now(),
+		d.ID,
+	).Scan(&d.Changed_at)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.webhooks.Send(ctx, "dispute."+d.Status, d)
+	return d, nil
+}
+
+// resolve moves disputed amount back to merchant if dispute is won, or to customer if lost.
+// Lost amount is refunded, so its fee is reversed.
+func resolve(ctx context.Context, tx pgx.Tx, d *Dispute, t *Transaction, status string) error {
+	d.Status = status
+	to := merchantAccount(t.MerchantID, "available")
+	if status == disputeLost {
+		to = customerAccount(t.UserID)
+	}
+	err := postLedger(ctx, tx, transfer(t, "dispute_"+status, merchantAccount(t.MerchantID, "disputed"), to, d.Amount))
+	if err != nil || status != disputeLost {
+		return err
+	}
+	return reverseFee(ctx, tx, t, d.Amount)
+}
+
+// SubmitDisputeEvidence puts dispute under review, if evidence came before deadline
+func (s *ApiServer) SubmitDisputeEvidence(ctx context.Context, id int, evidence string) (*Dispute, error) {
+	return s.updateDispute(ctx, id, func(tx pgx.Tx, d *Dispute, t *Transaction) error {
+		if d.Status != disputeNeedsResponse {
+			return &StatusError{http.StatusConflict, fmt.Errorf("error: evidence is already submitted")}
+		}
+		if clock.Now().After(d.EvidenceDueBy) {
+			return &StatusError{http.StatusConflict, fmt.Errorf("error: evidence was due by %s", d.EvidenceDueBy.Format(time.RFC3339))}
+		}
+		d.Status, d.Evidence = disputeUnderReview, evidence
+		return nil
+	})
+}
+
+// ResolveDispute closes dispute as won or lost
+func (s *ApiServer) ResolveDispute(ctx context.Context, id int, status string) (*Dispute, error) {
+	return s.updateDispute(ctx, id, func(tx pgx.Tx, d *Dispute, t *Transaction) error {
+		return resolve(ctx, tx, d, t, status)
+	})
+}
+
+// ExpireDisputes loses disputes without evidence past their deadline
+func (s *ApiServer) ExpireDisputes(ctx context.Context) ([]Dispute, error) {
+	rows, err := s.database.Query(
+		ctx,
+		"select id from disputes where status=$1 and evidence_due_by < $2 order by id",
+		disputeNeedsResponse,
+		clock.Now(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0)
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	disputes := make([]Dispute, 0, len(ids))
+	for _, id := range ids {
+		d, err := s.ResolveDispute(ctx, id, disputeLost)
+		if err != nil {
+			var se Error
+			if errors.As(err, &se) && se.Status() == http.StatusConflict {
+				continue
+			}
+			return disputes, err
+		}
+		disputes = append(disputes, *d)
+	}
+	return disputes, nil
+}
+
+func (s *ApiServer) GetDispute(ctx context.Context, id int) (*Dispute, error) {
+	d := new(Dispute)
+	err := scanDispute(s.database.QueryRow(ctx, "select "+disputeColumns+" from disputes where id=$1", id), d)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: dispute not found")}
+		}
+		return nil, err
+	}
+	return d, nil
+}
+
+func (s *ApiServer) GetDisputes(ctx context.Context, f DisputeFilter) ([]Dispute, error) {
+	q := "select " + disputeColumns + " from disputes where true"
+	args := make([]interface{}, 0, 3)
+	if f.MerchantID != nil {
+		args = append(args, *f.MerchantID)
+		q += fmt.Sprintf(" and merchant_id=$%d", len(args))
+	}
+	if f.TransactionID != 0 {
+		args = append(args, f.TransactionID)
+		q += fmt.Sprintf(" and transaction_id=$%d", len(args))
+	}
+	if f.Status != "" {
+		args = append(args, f.Status)
+		q += fmt.Sprintf(" and status=$%d", len(args))
+	}
+	rows, err := s.database.Query(ctx, q+" order by id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	disputes := make([]Dispute, 0)
+	for rows.Next() {
+		d := Dispute{}
+		err = scanDispute(rows, &d)
+		if err != nil {
+			return nil, err
+		}
+		disputes = append(disputes, d)
+	}
+	return disputes, rows.Err()
+}
+
+// writeDispute replies with a single dispute
+func writeDispute(rw http.ResponseWriter, d *Dispute, code int) {
+	data, _ := json.Marshal(d)
+	rw.Header().Add("content-type", "application/json")
+	rw.WriteHeader(code)
+	rw.Write(data)
+}
+
+// disputeID parses dispute id from path
+func disputeID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, &StatusError{http.StatusBadRequest, fmt.Errorf("error: id is NaN")}
+	}
+	return id, nil
+}
+
+// OpenDisputeHandler..
+func OpenDisputeHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		req := struct {
+			TransactionID int    `json:"transaction_id"`
+			ReasonCode    string `json:"reason_code"`
+		}{}
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err := decoder.Decode(&req)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		if req.TransactionID == 0 || req.ReasonCode == "" {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: transaction_id, reason_code")}
+		}
+		if !validDisputeReason(req.ReasonCode) {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: there is no reason code like '%s'", req.ReasonCode)}
+		}
+
+		d, err := api.OpenDispute(r.Context(), req.TransactionID, req.ReasonCode)
+		if err != nil {
+			return err
+		}
+		writeDispute(rw, d, http.StatusCreated)
+		return nil
+	}
+}
+
+// SubmitDisputeEvidenceHandler..
+func SubmitDisputeEvidenceHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := disputeID(r)
+		if err != nil {
+			return err
+		}
+		req := struct {
+			Evidence string `json:"evidence"`
+		}{}
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err = decoder.Decode(&req)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		if req.Evidence == "" {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: evidence")}
+		}
+
+		d, err := api.SubmitDisputeEvidence(r.Context(), id, req.Evidence)
+		if err != nil {
+			return err
+		}
+		writeDispute(rw, d, http.StatusOK)
+		return nil
+	}
+}
+
+// ResolveDisputeHandler..
+func ResolveDisputeHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := disputeID(r)
+		if err != nil {
+			return err
+		}
+		req := struct {
+			Status string `json:"status"`
+		}{}
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err = decoder.Decode(&req)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		if req.Status != disputeWon && req.Status != disputeLost {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: status should be one of: won, lost")}
+		}
+
+		d, err := api.ResolveDispute(r.Context(), id, req.Status)
+		if err != nil {
+			return err
+		}
+		writeDispute(rw, d, http.StatusOK)
+		return nil
+	}
+}
+
+// GetDisputesHandler..
+func GetDisputesHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		query := r.URL.Query()
+		filter := DisputeFilter{Status: query.Get("status")}
+		if val := query.Get("merchant_id"); val != "" {
+			merchantID, err := strconv.Atoi(val)
+			if err != nil {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: 'merchant_id' is NaN")}
+			}
+			filter.MerchantID = &merchantID
+		}
+		if val := query.Get("transaction_id"); val != "" {
+			id, err := strconv.Atoi(val)
+			if err != nil {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: 'transaction_id' is NaN")}
+			}
+			filter.TransactionID = id
+		}
+		switch filter.Status {
+		case "", disputeNeedsResponse, disputeUnderReview, disputeWon, disputeLost:
+		default:
+			return &StatusError{
+				http.StatusBadRequest,
+				fmt.Errorf("error: there is no status like '%s'; available statuses: needs_response,under_review,won,lost", filter.Status),
+			}
+		}
+		page, err := pageParam(query.Get("page"))
+		if err != nil {
+			return err
+		}
+
+		disputes, err := api.GetDisputes(r.Context(), filter)
+		if err != nil {
+			return err
+		}
+		start, end := Paginate(page, 10, len(disputes))
+		data, _ := json.Marshal(disputes[start:end])
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// GetDisputeHandler..
+func GetDisputeHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := disputeID(r)
+		if err != nil {
+			return err
+		}
+		d, err := api.GetDispute(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		writeDispute(rw, d, http.StatusFound)
+		return nil
+	}
+}
@@ -0,0 +1,91 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+// StatusEvent describes a committed change of a transaction status
+type StatusEvent struct {
+	ID        int       `json:"id"`
+	Status    string    `json:"transaction_status"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// Events buffered per subscriber before it is considered a slow consumer
+const subscriberBuffer = 64
+
+// subscriber receives status events for the transactions it is subscribed to.
+// Events are buffered; a subscriber that doesn't keep up is dropped.
+type subscriber struct {
+	events chan StatusEvent
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newSubscriber(buffer int) *subscriber {
+	return &subscriber{
+		events: make(chan StatusEvent, buffer),
+		done:   make(chan struct{}),
+	}
+}
+
+// drop marks subscriber as gone. Safe to call multiple times.
+func (s *subscriber) drop() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// Hub fans out status events to subscribers by transaction id
+type Hub struct {
+	mu   sync.RWMutex
+	subs map[int]map[*subscriber]struct{}
+}
+
+var hub = NewHub()
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[int]map[*subscriber]struct{})}
+}
+
+func (h *Hub) Subscribe(id int, s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[id] == nil {
+		h.subs[id] = make(map[*subscriber]struct{})
+	}
+	h.subs[id][s] = struct{}{}
+}
+
+func (h *Hub) Unsubscribe(id int, s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[id], s)
+	if len(h.subs[id]) == 0 {
+		delete(h.subs, id)
+	}
+}
+
+// UnsubscribeAll removes subscriber from every transaction it listens to
+func (h *Hub) UnsubscribeAll(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, set := range h.subs {
+		delete(set, s)
+		if len(set) == 0 {
+			delete(h.subs, id)
+		}
+	}
+}
+
+// Publish never blocks: subscribers with a full buffer are dropped
+func (h *Hub) Publish(ev StatusEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subs[ev.ID] {
+		select {
+		case s.events <- ev:
+		default:
+			s.drop()
+		}
+	}
+}
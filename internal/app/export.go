@@ -0,0 +1,345 @@
+package app
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportFilter narrows down exported transactions. Zero values match everything.
+type ExportFilter struct {
+	CustomerID int
+	UserID     int
+	Email      string
+	// Transactions having all of these metadata values
+	Metadata          map[string]string
+	MerchantReference string
+	Sort              string
+	Order             string
+}
+
+// exportColumns are available columns in their default order
+var exportColumns = []string{"id", "customer_id", "user_id", "email", "amount", "currency", "created_at", "changed_at", "transaction_status", "merchant_id", "fee", "net_amount", "payment_method_id", "decline_code", "merchant_reference", "metadata"}
+
+// exportValue returns typed value of a transaction column
+func exportValue(t *Transaction, column string, loc *time.Location) interface{} {
+	switch column {
+	case "id":
+		return t.ID
+	case "customer_id":
+		return t.CustomerID
+	case "user_id":
+		return t.UserID
+	case "email":
+		return t.Email
+	case "amount":
+		return t.Amount
+	case "currency":
+		return t.Currency
+	case "created_at":
+		return t.Created_at.In(loc).Format(time.RFC3339)
+	case "changed_at":
+		return t.Changed_at.In(loc).Format(time.RFC3339)
+	case "transaction_status":
+		return t.Status
+	case "merchant_id":
+		return t.MerchantID
+	case "fee":
+		return optionalValue(t.Fee)
+	case "net_amount":
+		return optionalValue(t.NetAmount)
+	case "payment_method_id":
+		return t.PaymentMethodID
+	case "decline_code":
+		return t.DeclineCode
+	case "merchant_reference":
+		return t.MerchantReference
+	case "metadata":
+		if len(t.Metadata) == 0 {
+			return ""
+		}
+		b, _ := json.Marshal(t.Metadata)
+		return string(b)
+	}
+	return nil
+}
+
+// optionalValue exports unset values as empty cells
+func optionalValue(v *float64) interface{} {
+	if v == nil {
+		return ""
+	}
+	return *v
+}
+
+// rowWriter writes exported rows in a specific format
+type rowWriter interface {
+	Header(columns []string) error
+	Row(values []interface{}) error
+	Close() error
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (cw *csvWriter) Header(columns []string) error {
+	return cw.w.Write(columns)
+}
+
+func (cw *csvWriter) Row(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		record[i] = fmt.Sprint(v)
+	}
+	return cw.w.Write(record)
+}
+
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type ndjsonWriter struct {
+	enc     *json.Encoder
+	columns []string
+}
+
+func (nw *ndjsonWriter) Header(columns []string) error {
+	nw.columns = columns
+	return nil
+}
+
+func (nw *ndjsonWriter) Row(values []interface{}) error {
+	obj := make(map[string]interface{}, len(values))
+	for i, v := range values {
+		obj[nw.columns[i]] = v
+	}
+	return nw.enc.Encode(obj)
+}
+
+func (nw *ndjsonWriter) Close() error {
+	return nil
+}
+
+// xlsxWriter streams a minimal single sheet workbook. Sheet rows are written
+// as they come, the rest of the package is added on Close.
+type xlsxWriter struct {
+	zw    *zip.Writer
+	sheet io.Writer
+}
+
+func newXLSXWriter(w io.Writer) *xlsxWriter {
+	return &xlsxWriter{zw: zip.NewWriter(w)}
+}
+
+func (xw *xlsxWriter) Header(columns []string) error {
+	var err error
+	xw.sheet, err = xw.zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(xw.sheet, xml.Header+
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	if err != nil {
+		return err
+	}
+	values := make([]interface{}, len(columns))
+	for i, c := range columns {
+		values[i] = c
+	}
+	return xw.Row(values)
+}
+
+func (xw *xlsxWriter) Row(values []interface{}) error {
+	b := strings.Builder{}
+	b.WriteString("<row>")
+	for _, v := range values {
+		switch v := v.(type) {
+		case int:
+			b.WriteString(`<c><v>` + strconv.Itoa(v) + `</v></c>`)
+		case float64:
+			b.WriteString(`<c><v>` + strconv.FormatFloat(v, 'f', -1, 64) + `</v></c>`)
+		default:
+			b.WriteString(`<c t="inlineStr"><is><t>`)
+			xml.EscapeText(&b, []byte(fmt.Sprint(v)))
+			b.WriteString(`</t></is></c>`)
+		}
+	}
+	b.WriteString("</row>")
+	_, err := io.WriteString(xw.sheet, b.String())
+	return err
+}
+
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="transactions" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+func (xw *xlsxWriter) Close() error {
+	_, err := io.WriteString(xw.sheet, `</sheetData></worksheet>`)
+	if err != nil {
+		return err
+	}
+	for _, p := range xlsxParts {
+		f, err := xw.zw.Create(p.name)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(f, xml.Header+p.content)
+		if err != nil {
+			return err
+		}
+	}
+	return xw.zw.Close()
+}
+
+// exportStream sends response headers with the first bytes of export, so
+// export failed before that can still be replied with an error
+type exportStream struct {
+	rw          http.ResponseWriter
+	contentType string
+	filename    string
+	started     bool
+}
+
+func (es *exportStream) Write(p []byte) (int, error) {
+	if !es.started {
+		es.started = true
+		es.rw.Header().Add("content-type", es.contentType)
+		es.rw.Header().Add("content-disposition", fmt.Sprintf(`attachment; filename="%s"`, es.filename))
+	}
+	return es.rw.Write(p)
+}
+
+// ExportTransactionsHandler..
+func ExportTransactionsHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		query := r.URL.Query()
+		filter := ExportFilter{
+			Email:             query.Get("email"),
+			Metadata:          metadataParams(query),
+			MerchantReference: query.Get("merchant_reference"),
+			Sort:              query.Get("sort"),
+			Order:             query.Get("order"),
+		}
+		if uid := query.Get("user_id"); uid != "" {
+			userID, err := strconv.Atoi(uid)
+			if err != nil {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: 'user_id' is NaN")}
+			}
+			filter.UserID = userID
+		}
+		switch filter.Order {
+		case "", "asc", "desc":
+		default:
+			return &StatusError{
+				http.StatusBadRequest,
+				fmt.Errorf("error: there is no order like '%s'; available orders: asc,desc", filter.Order),
+			}
+		}
+		switch filter.Sort {
+		case "", "date", "amount":
+		default:
+			return &StatusError{
+				http.StatusBadRequest,
+				fmt.Errorf("error: there is no sort like '%s'; available sorts: date,amount", filter.Sort),
+			}
+		}
+
+		columns := exportColumns
+		if val := query.Get("columns"); val != "" {
+			columns = strings.Split(val, ",")
+			for _, c := range columns {
+				if exportValue(&Transaction{}, c, time.UTC) == nil {
+					return &StatusError{
+						http.StatusBadRequest,
+						fmt.Errorf("error: there is no column like '%s'; available columns: %s", c, strings.Join(exportColumns, ",")),
+					}
+				}
+			}
+		}
+
+		loc := time.UTC
+		if tz := query.Get("tz"); tz != "" {
+			var err error
+			loc, err = time.LoadLocation(tz)
+			if err != nil {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: unknown timezone '%s'", tz)}
+			}
+		}
+
+		var w rowWriter
+		stream := &exportStream{rw: rw}
+		switch format := query.Get("format"); format {
+		case "", "csv":
+			stream.contentType, stream.filename = "text/csv", "transactions.csv"
+			w = &csvWriter{csv.NewWriter(stream)}
+		case "ndjson":
+			stream.contentType, stream.filename = "application/x-ndjson", "transactions.ndjson"
+			w = &ndjsonWriter{enc: json.NewEncoder(stream)}
+		case "xlsx":
+			stream.contentType, stream.filename = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "transactions.xlsx"
+			w = newXLSXWriter(stream)
+		default:
+			return &StatusError{
+				http.StatusBadRequest,
+				fmt.Errorf("error: there is no format like '%s'; available formats: csv,ndjson,xlsx", format),
+			}
+		}
+
+		// Header is written with the first row, so failed query is replied with an error
+		header := false
+		writeHeader := func() error {
+			if header {
+				return nil
+			}
+			header = true
+			return w.Header(columns)
+		}
+		values := make([]interface{}, len(columns))
+		err := api.ExportTransactions(r.Context(), filter, func(t *Transaction) error {
+			err := writeHeader()
+			if err != nil {
+				return err
+			}
+			for i, c := range columns {
+				values[i] = exportValue(t, c, loc)
+			}
+			return w.Row(values)
+		})
+		if err == nil {
+			err = writeHeader()
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil && stream.started {
+			// Connection is broken, so truncated file doesn't look complete
+			log.Printf("Export aborted - %s", err)
+			panic(http.ErrAbortHandler)
+		}
+		return err
+	}
+}
@@ -0,0 +1,280 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+// Ledger account collecting fees of the payment system
+const feesAccount = "provider:fees"
+
+// roundCents rounds amount to the smallest currency unit
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// Fee is percentage plus fixed part, clamped to min/max caps
+// and never exceeding amount itself
+func (fs *FeeSchedule) Fee(amount float64) float64 {
+	fee := amount*fs.Percent/100 + fs.Fixed
+	if fee < fs.MinFee {
+		fee = fs.MinFee
+	}
+	if fs.MaxFee != nil && fee > *fs.MaxFee {
+		fee = *fs.MaxFee
+	}
+	return roundCents(math.Min(fee, amount))
+}
+
+// matches tells how specific schedule is for transaction paid by method, -1 if it doesn't apply
+func (fs *FeeSchedule) matches(t *Transaction, method string) int {
+	score := 0
+	switch fs.Currency {
+	case "":
+	case t.Currency:
+		score += 2
+	default:
+		return -1
+	}
+	switch fs.PaymentMethod {
+	case "":
+	case method:
+		score++
+	default:
+		return -1
+	}
+	return score
+}
+
+// pickFeeSchedule returns the most specific schedule applying to t, latest one wins a tie
+func pickFeeSchedule(schedules []FeeSchedule, t *Transaction, method string) *FeeSchedule {
+	var best *FeeSchedule
+	bestScore := -1
+	for i := range schedules {
+		if score := schedules[i].matches(t, method); score >= bestScore && score >= 0 {
+			best, bestScore = &schedules[i], score
+		}
+	}
+	return best
+}
+
+// refundFee is a part of fee returned to merchant when refunded amount is given back to customer
+func refundFee(t *Transaction, refunded float64) float64 {
+	if t.Fee == nil || t.Amount == 0 {
+		return 0
+	}
+	return roundCents(*t.Fee * math.Min(refunded, t.Amount) / t.Amount)
+}
+
+// reverseFee gives merchant back the part of fee of amount refunded to customer,
+// fee and net amount of transaction are left for the rest of it
+func reverseFee(ctx context.Context, tx pgx.Tx, t *Transaction, refunded float64) error {
+	if t.Fee == nil {
+		return nil
+	}
+	reversed := refundFee(t, refunded)
+	fee := roundCents(*t.Fee - reversed)
+	net := roundCents(t.Amount - math.Min(refunded, t.Amount) - fee)
+	t.Fee, t.NetAmount = &fee, &net
+	_, err := tx.Exec(ctx, "update transactions set fee=$1, net_amount=$2 where id=$3", fee, net, t.ID)
+	if err != nil {
+		return err
+	}
+	if reversed == 0 {
+		return nil
+	}
+	return postLedger(ctx, tx, transfer(t, "fee_reversal", feesAccount, merchantAccount(t.MerchantID, "available"), reversed))
+}
+
+// chargeFee computes fee of a successful transaction, stores fee and net
+// amount and moves fee from merchant available account to the provider
+func chargeFee(ctx context.Context, tx pgx.Tx, t *Transaction) error {
+	rows, err := tx.Query(
+		ctx,
+		"select "+feeScheduleColumns+" from fee_schedules where merchant_id=$1 order by id",
+		t.MerchantID,
+	)
+	if err != nil {
+		return err
+	}
+	schedules, err := scanFeeSchedules(rows)
+	if err != nil {
+		return err
+	}
+
+	fee := 0.0
+	if fs := pickFeeSchedule(schedules, t, t.PaymentMethodType); fs != nil {
+		fee = fs.Fee(t.Amount)
+	}
+	net := roundCents(t.Amount - fee)
+	t.Fee, t.NetAmount = &fee, &net
+	_, err = tx.Exec(ctx, "update transactions set fee=$1, net_amount=$2 where id=$3", fee, net, t.ID)
+	if err != nil {
+		return err
+	}
+	if fee == 0 {
+		return nil
+	}
+	return postLedger(ctx, tx, transfer(t, "fee", merchantAccount(t.MerchantID, "available"), feesAccount, fee))
+}
+
+const feeScheduleColumns = "id, merchant_id, currency, payment_method, percent, fixed, min_fee, max_fee, created_at"
+
+func scanFeeSchedules(rows pgx.Rows) ([]FeeSchedule, error) {
+	defer rows.Close()
+	schedules := make([]FeeSchedule, 0)
+	for rows.Next() {
+		fs := FeeSchedule{}
+		err := rows.Scan(
+			&fs.ID,
+			&fs.MerchantID,
+			&fs.Currency,
+			&fs.PaymentMethod,
+			&fs.Percent,
+			&fs.Fixed,
+			&fs.MinFee,
+			&fs.MaxFee,
+			&fs.Created_at,
+		)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, fs)
+	}
+	return schedules, rows.Err()
+}
+
+func (s *ApiServer) CreateFeeSchedule(ctx context.Context, fs *FeeSchedule) error {
+	return s.database.QueryRow(
+		ctx,
+		`insert into fee_schedules (merchant_id, currency, payment_method, percent, fixed, min_fee, max_fee, created_at)
+		values ($1,$2,$3,$4,$5,$6,$7,$8) returning id, created_at`,
+		fs.MerchantID,
+		fs.Currency,
+		fs.PaymentMethod,
+		fs.Percent,
+		fs.Fixed,
+		fs.MinFee,
+		fs.MaxFee,
+		clock.Now(),
+	).Scan(&fs.ID, &fs.Created_at)
+}
+
+func (s *ApiServer) GetFeeSchedules(ctx context.Context, merchantID *int) ([]FeeSchedule, error) {
+	q := "select " + feeScheduleColumns + " from fee_schedules"
+	args := make([]interface{}, 0, 1)
+	if merchantID != nil {
+		args = append(args, *merchantID)
+		q += " where merchant_id=$1"
+	}
+	rows, err := s.database.Query(ctx, q+" order by id", args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanFeeSchedules(rows)
+}
+
+func (s *ApiServer) DeleteFeeSchedule(ctx context.Context, id int) error {
+	tag, err := s.database.Exec(ctx, "delete from fee_schedules where id=$1", id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return &StatusError{http.StatusNotFound, fmt.Errorf("error: fee schedule not found")}
+	}
+	return nil
+}
+
+func validateFeeSchedule(fs *FeeSchedule) error {
+	switch {
+	case fs.MerchantID < 0:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: merchant_id can't be negative")}
+	case fs.Percent < 0 || fs.Percent > 100:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: percent should be within 0..100")}
+	case fs.Fixed < 0 || fs.MinFee < 0:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: fixed and min_fee can't be negative")}
+	case fs.MaxFee != nil && *fs.MaxFee < fs.MinFee:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: max_fee can't be less than min_fee")}
+	case len(fs.Currency) > 20:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: maximum length of currency is 20")}
+	}
+	return nil
+}
+
+// CreateFeeScheduleHandler..
+func CreateFeeScheduleHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		fs := new(FeeSchedule)
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err := decoder.Decode(fs)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		err = validateFeeSchedule(fs)
+		if err != nil {
+			return err
+		}
+
+		err = api.CreateFeeSchedule(r.Context(), fs)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(fs)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// GetFeeSchedulesHandler..
+func GetFeeSchedulesHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		var merchantID *int
+		if val := r.URL.Query().Get("merchant_id"); val != "" {
+			id, err := strconv.Atoi(val)
+			if err != nil {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: 'merchant_id' is NaN")}
+			}
+			merchantID = &id
+		}
+
+		schedules, err := api.GetFeeSchedules(r.Context(), merchantID)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(schedules)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// DeleteFeeScheduleHandler..
+func DeleteFeeScheduleHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: id is NaN")}
+		}
+
+		err = api.DeleteFeeSchedule(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(map[string]interface{}{"message": "Fee schedule deleted", "id": id})
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,715 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+const (
+	// Max nesting of selections in a single query
+	graphqlMaxDepth = 8
+	// Max cost of a single query; every requested list item costs 1, every field
+	// resolved by a database query costs 1 and 1 more per row it loads
+	graphqlMaxComplexity = 500
+	// Max page size of transaction connections
+	graphqlMaxPageSize = 100
+)
+
+const graphqlSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+type Query {
+	transaction(id: Int!): Transaction
+	# Either userId or email filter is required
+	transactions(filter: TransactionFilter!, first: Int = 10, after: String): TransactionConnection!
+	user(id: Int!): User
+}
+
+type Mutation {
+	createTransaction(input: CreateTransactionInput!): Transaction!
+	cancelTransaction(id: Int!): Transaction!
+	# Requires payment system basic auth
+	changeTransactionStatus(id: Int!, status: String!): Transaction!
+}
+
+input TransactionFilter {
+	userId: Int
+	email: String
+	status: String
+	currency: String
+	minAmount: Float
+	maxAmount: Float
+}
+
+input CreateTransactionInput {
+	customerId: Int
+	userId: Int
+	email: String
+	amount: Float!
+	currency: String!
+	merchantId: Int
+	paymentMethodId: Int
+	returnUrl: String
+	cardToken: String
+	metadata: [MetadataInput!]
+	merchantReference: String
+}
+
+input MetadataInput {
+	key: String!
+	value: String!
+}
+
+type Metadata {
+	key: String!
+	value: String!
+}
+
+type User {
+	id: Int!
+	emails: [String!]!
+	transactions(status: String, first: Int = 10, after: String): TransactionConnection!
+}
+
+type Transaction {
+	id: Int!
+	customerId: Int
+	userId: Int!
+	email: String!
+	amount: Float!
+	currency: String!
+	createdAt: Time
+	changedAt: Time
+	status: String!
+	merchantId: Int!
+	fee: Float
+	netAmount: Float
+	paymentMethodId: Int
+	declineCode: String
+	redirectUrl: String
+	metadata: [Metadata!]!
+	merchantReference: String
+	user: User!
+	# Ledger postings of the transaction: authorize, capture, void, fee, dispute and fee_reversal
+	events: [Event!]!
+	dispute: Dispute
+	# Amounts given back to the customer, by lost disputes
+	refunds: [Refund!]!
+}
+
+type Event {
+	postingId: Int!
+	event: String!
+	account: String!
+	direction: String!
+	amount: Float!
+	currency: String!
+	createdAt: Time
+}
+
+type Dispute {
+	id: Int!
+	amount: Float!
+	currency: String!
+	reasonCode: String!
+	status: String!
+	evidenceDueBy: Time!
+	createdAt: Time
+	changedAt: Time
+}
+
+type Refund {
+	disputeId: Int!
+	amount: Float!
+	currency: String!
+	createdAt: Time
+}
+
+type TransactionConnection {
+	totalCount: Int!
+	edges: [TransactionEdge!]!
+	pageInfo: PageInfo!
+}
+
+type TransactionEdge {
+	cursor: String!
+	node: Transaction!
+}
+
+type PageInfo {
+	endCursor: String
+	hasNextPage: Boolean!
+}
+
+scalar Time
+`
+
+var schema = graphql.MustParseSchema(
+	graphqlSchema,
+	&graphqlResolver{},
+	graphql.MaxDepth(graphqlMaxDepth),
+)
+
+type graphqlCtxKey int
+
+const (
+	ctxKeyComplexity graphqlCtxKey = iota
+	ctxKeyAuthorized
+)
+
+// chargeComplexity spends query budget stored in ctx
+func chargeComplexity(ctx context.Context, cost int) error {
+	budget, ok := ctx.Value(ctxKeyComplexity).(*int64)
+	if !ok {
+		return nil
+	}
+	if atomic.AddInt64(budget, -int64(cost)) < 0 {
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: query is too complex; max complexity is %d", graphqlMaxComplexity)}
+	}
+	return nil
+}
+
+// gqlError hides internal errors the same way errorHandler does
+func gqlError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(Error); ok {
+		return e
+	}
+	log.Printf("GraphQL - %s", err)
+	return errors.New(http.StatusText(http.StatusInternalServerError))
+}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// GraphQLHandler..
+func GraphQLHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		req := graphqlRequest{}
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err := decoder.Decode(&req)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		if req.Query == "" {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: query")}
+		}
+
+		budget := int64(graphqlMaxComplexity)
+		ctx := context.WithValue(r.Context(), ctxKeyComplexity, &budget)
+		username, password, ok := r.BasicAuth()
+		ctx = context.WithValue(ctx, ctxKeyAuthorized, ok && validCredentials(username, password))
+
+		resp := schema.Exec(ctx, req.Query, req.OperationName, req.Variables)
+		data, err := json.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(data)
+		return nil
+	}
+}
+
+type graphqlResolver struct{}
+
+type transactionFilter struct {
+	UserID    *int32
+	Email     *string
+	Status    *string
+	Currency  *string
+	MinAmount *float64
+	MaxAmount *float64
+}
+
+func (f *transactionFilter) match(t *Transaction) bool {
+	switch {
+	case f.Status != nil && t.Status != *f.Status:
+	case f.Currency != nil && t.Currency != *f.Currency:
+	case f.MinAmount != nil && t.Amount < *f.MinAmount:
+	case f.MaxAmount != nil && t.Amount > *f.MaxAmount:
+	default:
+		return true
+	}
+	return false
+}
+
+func (r *graphqlResolver) Transaction(ctx context.Context, args struct{ ID int32 }) (*transactionResolver, error) {
+	t, err := api.GetTransaction(ctx, int(args.ID))
+	if err != nil {
+		if e, ok := err.(Error); ok && e.Status() == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, gqlError(err)
+	}
+	return &transactionResolver{t}, nil
+}
+
+func (r *graphqlResolver) Transactions(ctx context.Context, args struct {
+	Filter transactionFilter
+	First  int32
+	After  *string
+}) (*connectionResolver, error) {
+	var (
+		ts  []Transaction
+		err error
+	)
+	switch {
+	case args.Filter.UserID != nil:
+		ts, err = api.GetUserTransactionsByID(ctx, int(*args.Filter.UserID))
+	case args.Filter.Email != nil:
+		ts, err = api.GetUserTransactionsByEmail(ctx, *args.Filter.Email)
+	default:
+		return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: no 'userId' or 'email' filter provided")}
+	}
+	if err != nil {
+		return nil, gqlError(err)
+	}
+	return newConnection(ctx, ts, &args.Filter, args.First, args.After)
+}
+
+func (r *graphqlResolver) User(ctx context.Context, args struct{ ID int32 }) (*userResolver, error) {
+	u, err := loadUser(ctx, args.ID)
+	if err != nil || len(u.ts) == 0 {
+		return nil, err
+	}
+	return u, nil
+}
+
+type createTransactionInput struct {
+	CustomerID        *int32
+	UserID            *int32
+	Email             *string
+	Amount            float64
+	Currency          string
+	MerchantID        *int32
+	PaymentMethodID   *int32
+	ReturnURL         *string
+	CardToken         *string
+	Metadata          *[]metadataEntry
+	MerchantReference *string
+}
+
+// metadataEntry is a key of metadata, GraphQL has no maps
+type metadataEntry struct {
+	Key   string
+	Value string
+}
+
+func (r *graphqlResolver) CreateTransaction(ctx context.Context, args struct{ Input createTransactionInput }) (*transactionResolver, error) {
+	t := &Transaction{
+		Amount:   args.Input.Amount,
+		Currency: args.Input.Currency,
+	}
+	if args.Input.CustomerID != nil {
+		t.CustomerID = int(*args.Input.CustomerID)
+	}
+	if args.Input.UserID != nil {
+		t.UserID = int(*args.Input.UserID)
+	}
+	if args.Input.Email != nil {
+		t.Email = *args.Input.Email
+	}
+	if args.Input.MerchantID != nil {
+		t.MerchantID = int(*args.Input.MerchantID)
+	}
+	if args.Input.PaymentMethodID != nil {
+		t.PaymentMethodID = int(*args.Input.PaymentMethodID)
+	}
+	if args.Input.ReturnURL != nil {
+		t.ReturnURL = *args.Input.ReturnURL
+	}
+	if args.Input.CardToken != nil {
+		t.CardToken = *args.Input.CardToken
+	}
+	if args.Input.Metadata != nil {
+		t.Metadata = make(map[string]string)
+		for _, e := range *args.Input.Metadata {
+			t.Metadata[e.Key] = e.Value
+		}
+	}
+	if args.Input.MerchantReference != nil {
+		t.MerchantReference = *args.Input.MerchantReference
+	}
+	err := validateTransaction(t)
+	if err != nil {
+		return nil, err
+	}
+	err = api.CreateTransaction(ctx, t)
+	if err != nil {
+		return nil, gqlError(err)
+	}
+	return &transactionResolver{t}, nil
+}
+
+func (r *graphqlResolver) CancelTransaction(ctx context.Context, args struct{ ID int32 }) (*transactionResolver, error) {
+	return changeStatus(ctx, int(args.ID), "ОТМЕНЕН")
+}
+
+func (r *graphqlResolver) ChangeTransactionStatus(ctx context.Context, args struct {
+	ID     int32
+	Status string
+}) (*transactionResolver, error) {
+	if authorized, _ := ctx.Value(ctxKeyAuthorized).(bool); !authorized {
+		return nil, &StatusError{http.StatusUnauthorized, fmt.Errorf("Unauthorized")}
+	}
+	err := validateStatusChange(&Transaction{ID: int(args.ID), Status: args.Status})
+	if err != nil {
+		return nil, err
+	}
+	return changeStatus(ctx, int(args.ID), args.Status)
+}
+
+func changeStatus(ctx context.Context, id int, st string) (*transactionResolver, error) {
+	err := api.ChangeTransactionStatus(ctx, id, st)
+	if err != nil {
+		return nil, gqlError(err)
+	}
+	t, err := api.GetTransaction(ctx, id)
+	if err != nil {
+		return nil, gqlError(err)
+	}
+	return &transactionResolver{t}, nil
+}
+
+type transactionResolver struct {
+	t *Transaction
+}
+
+func (r *transactionResolver) ID() int32           { return int32(r.t.ID) }
+func (r *transactionResolver) UserID() int32       { return int32(r.t.UserID) }
+func (r *transactionResolver) Email() string       { return r.t.Email }
+func (r *transactionResolver) Amount() float64     { return r.t.Amount }
+func (r *transactionResolver) Currency() string    { return r.t.Currency }
+func (r *transactionResolver) Status() string      { return r.t.Status }
+func (r *transactionResolver) MerchantID() int32   { return int32(r.t.MerchantID) }
+func (r *transactionResolver) Fee() *float64       { return r.t.Fee }
+func (r *transactionResolver) NetAmount() *float64 { return r.t.NetAmount }
+func (r *transactionResolver) CustomerID() *int32 {
+	if r.t.CustomerID == 0 {
+		return nil
+	}
+	id := int32(r.t.CustomerID)
+	return &id
+}
+func (r *transactionResolver) PaymentMethodID() *int32 {
+	if r.t.PaymentMethodID == 0 {
+		return nil
+	}
+	id := int32(r.t.PaymentMethodID)
+	return &id
+}
+func (r *transactionResolver) DeclineCode() *string {
+	if r.t.DeclineCode == "" {
+		return nil
+	}
+	return &r.t.DeclineCode
+}
+func (r *transactionResolver) RedirectURL() *string {
+	if r.t.NextAction == nil {
+		return nil
+	}
+	return &r.t.NextAction.RedirectURL
+}
+func (r *transactionResolver) Metadata() []*metadataResolver {
+	keys := make([]string, 0, len(r.t.Metadata))
+	for key := range r.t.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	entries := make([]*metadataResolver, len(keys))
+	for i, key := range keys {
+		entries[i] = &metadataResolver{metadataEntry{key, r.t.Metadata[key]}}
+	}
+	return entries
+}
+func (r *transactionResolver) MerchantReference() *string {
+	if r.t.MerchantReference == "" {
+		return nil
+	}
+	return &r.t.MerchantReference
+}
+func (r *transactionResolver) CreatedAt() *graphql.Time {
+	if r.t.Created_at.IsZero() {
+		return nil
+	}
+	return &graphql.Time{Time: r.t.Created_at}
+}
+func (r *transactionResolver) ChangedAt() *graphql.Time {
+	if r.t.Changed_at.IsZero() {
+		return nil
+	}
+	return &graphql.Time{Time: r.t.Changed_at}
+}
+
+func (r *transactionResolver) User(ctx context.Context) (*userResolver, error) {
+	return loadUser(ctx, int32(r.t.UserID))
+}
+
+func (r *transactionResolver) Events(ctx context.Context) ([]*eventResolver, error) {
+	err := chargeComplexity(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := api.GetLedgerEntries(ctx, LedgerFilter{TransactionID: r.t.ID})
+	if err != nil {
+		return nil, gqlError(err)
+	}
+	err = chargeComplexity(ctx, len(entries))
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*eventResolver, len(entries))
+	for i := range entries {
+		events[i] = &eventResolver{&entries[i]}
+	}
+	return events, nil
+}
+
+// dispute of transaction, there is one at most
+func (r *transactionResolver) dispute(ctx context.Context) (*Dispute, error) {
+	err := chargeComplexity(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	disputes, err := api.GetDisputes(ctx, DisputeFilter{TransactionID: r.t.ID})
+	if err != nil || len(disputes) == 0 {
+		return nil, gqlError(err)
+	}
+	err = chargeComplexity(ctx, len(disputes))
+	if err != nil {
+		return nil, err
+	}
+	return &disputes[0], nil
+}
+
+func (r *transactionResolver) Dispute(ctx context.Context) (*disputeResolver, error) {
+	d, err := r.dispute(ctx)
+	if d == nil {
+		return nil, err
+	}
+	return &disputeResolver{d}, nil
+}
+
+func (r *transactionResolver) Refunds(ctx context.Context) ([]*refundResolver, error) {
+	d, err := r.dispute(ctx)
+	if err != nil {
+		return nil, err
+	}
+	refunds := make([]*refundResolver, 0, 1)
+	if d != nil && d.Status == disputeLost {
+		refunds = append(refunds, &refundResolver{d})
+	}
+	return refunds, nil
+}
+
+type eventResolver struct {
+	e *LedgerEntry
+}
+
+func (r *eventResolver) PostingID() int32  { return int32(r.e.PostingID) }
+func (r *eventResolver) Event() string     { return r.e.Event }
+func (r *eventResolver) Account() string   { return r.e.Account }
+func (r *eventResolver) Direction() string { return r.e.Direction }
+func (r *eventResolver) Amount() float64   { return r.e.Amount }
+func (r *eventResolver) Currency() string  { return r.e.Currency }
+func (r *eventResolver) CreatedAt() *graphql.Time {
+	return graphqlTime(r.e.Created_at)
+}
+
+type disputeResolver struct {
+	d *Dispute
+}
+
+func (r *disputeResolver) ID() int32          { return int32(r.d.ID) }
+func (r *disputeResolver) Amount() float64    { return r.d.Amount }
+func (r *disputeResolver) Currency() string   { return r.d.Currency }
+func (r *disputeResolver) ReasonCode() string { return r.d.ReasonCode }
+func (r *disputeResolver) Status() string     { return r.d.Status }
+func (r *disputeResolver) EvidenceDueBy() graphql.Time {
+	return graphql.Time{Time: r.d.EvidenceDueBy}
+}
+func (r *disputeResolver) CreatedAt() *graphql.Time { return graphqlTime(r.d.Created_at) }
+func (r *disputeResolver) ChangedAt() *graphql.Time { return graphqlTime(r.d.Changed_at) }
+
+// refundResolver represents amount given back by lost dispute
+type refundResolver struct {
+	d *Dispute
+}
+
+func (r *refundResolver) DisputeID() int32         { return int32(r.d.ID) }
+func (r *refundResolver) Amount() float64          { return r.d.Amount }
+func (r *refundResolver) Currency() string         { return r.d.Currency }
+func (r *refundResolver) CreatedAt() *graphql.Time { return graphqlTime(r.d.Changed_at) }
+
+// graphqlTime is nil for zero time
+func graphqlTime(t time.Time) *graphql.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &graphql.Time{Time: t}
+}
+
+type metadataResolver struct {
+	e metadataEntry
+}
+
+func (r *metadataResolver) Key() string   { return r.e.Key }
+func (r *metadataResolver) Value() string { return r.e.Value }
+
+// userResolver represents user assembled from their transactions
+type userResolver struct {
+	id int32
+	ts []Transaction
+}
+
+func loadUser(ctx context.Context, id int32) (*userResolver, error) {
+	err := chargeComplexity(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := api.GetUserTransactionsByID(ctx, int(id))
+	if err != nil {
+		return nil, gqlError(err)
+	}
+	// User is assembled from all of their transactions
+	err = chargeComplexity(ctx, len(ts))
+	if err != nil {
+		return nil, err
+	}
+	return &userResolver{id, ts}, nil
+}
+
+func (r *userResolver) ID() int32 { return r.id }
+
+func (r *userResolver) Emails() []string {
+	emails := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, t := range r.ts {
+		if !seen[t.Email] {
+			seen[t.Email] = true
+			emails = append(emails, t.Email)
+		}
+	}
+	return emails
+}
+
+func (r *userResolver) Transactions(ctx context.Context, args struct {
+	Status *string
+	First  int32
+	After  *string
+}) (*connectionResolver, error) {
+	return newConnection(ctx, r.ts, &transactionFilter{Status: args.Status}, args.First, args.After)
+}
+
+type connectionResolver struct {
+	total   int
+	edges   []*edgeResolver
+	hasNext bool
+}
+
+// newConnection filters ts and cuts a page after cursor, ordered by id
+func newConnection(ctx context.Context, ts []Transaction, f *transactionFilter, firstArg int32, afterArg *string) (*connectionResolver, error) {
+	first := int(firstArg)
+	if first < 0 || first > graphqlMaxPageSize {
+		return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: 'first' should be between 0 and %d", graphqlMaxPageSize)}
+	}
+	after := 0
+	if afterArg != nil {
+		var err error
+		after, err = decodeCursor(*afterArg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := chargeComplexity(ctx, first)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]Transaction, 0, len(ts))
+	for i := range ts {
+		if f.match(&ts[i]) {
+			filtered = append(filtered, ts[i])
+		}
+	}
+	err = sortTransactions(filtered, "date", "asc")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &connectionResolver{total: len(filtered), edges: make([]*edgeResolver, 0, first)}
+	for i := range filtered {
+		if filtered[i].ID <= after {
+			continue
+		}
+		if len(c.edges) == first {
+			c.hasNext = true
+			break
+		}
+		c.edges = append(c.edges, &edgeResolver{&filtered[i]})
+	}
+	return c, nil
+}
+
+func (r *connectionResolver) TotalCount() int32           { return int32(r.total) }
+func (r *connectionResolver) Edges() []*edgeResolver      { return r.edges }
+func (r *connectionResolver) PageInfo() *pageInfoResolver { return &pageInfoResolver{r} }
+
+type pageInfoResolver struct {
+	c *connectionResolver
+}
+
+func (r *pageInfoResolver) HasNextPage() bool { return r.c.hasNext }
+
+func (r *pageInfoResolver) EndCursor() *string {
+	if len(r.c.edges) == 0 {
+		return nil
+	}
+	cursor := r.c.edges[len(r.c.edges)-1].Cursor()
+	return &cursor
+}
+
+type edgeResolver struct {
+	t *Transaction
+}
+
+func (r *edgeResolver) Cursor() string             { return encodeCursor(r.t.ID) }
+func (r *edgeResolver) Node() *transactionResolver { return &transactionResolver{r.t} }
+
+func encodeCursor(id int) string {
+	return base64.StdEncoding.EncodeToString([]byte("transaction:" + strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	data, err := base64.StdEncoding.DecodeString(cursor)
+	if err == nil && strings.HasPrefix(string(data), "transaction:") {
+		id, err := strconv.Atoi(strings.TrimPrefix(string(data), "transaction:"))
+		if err == nil {
+			return id, nil
+		}
+	}
+	return 0, &StatusError{http.StatusBadRequest, fmt.Errorf("error: invalid cursor '%s'", cursor)}
+}
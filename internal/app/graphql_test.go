@@ -0,0 +1,99 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func graphqlRequestFor(t *testing.T, query string, auth bool) map[string]interface{} {
+	body, _ := json.Marshal(graphqlRequest{Query: query})
+	req := httptest.NewRequest("POST", "/graphql", strings.NewReader(string(body)))
+	if auth {
+		req.SetBasicAuth("username", "password")
+	}
+	// Fields resolved by a query cost 1 and 1 per loaded row
+	budget := int64(graphqlMaxComplexity)
+	ctx := context.WithValue(context.Background(), ctxKeyComplexity, &budget)
+	tr := &transactionResolver{&Transaction{ID: 1, UserID: 1}}
+	_, err := tr.User(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(graphqlMaxComplexity-3), budget)
+	_, err = tr.Events(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(graphqlMaxComplexity-6), budget)
+	_, err = tr.Dispute(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(graphqlMaxComplexity-8), budget)
+
+	rr := httptest.NewRecorder()
+	errorHandler(GraphQLHandler()).ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	resp := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestGraphQL(t *testing.T) {
+	api = &MockServer{}
+
+	resp := graphqlRequestFor(t, `{ transactions(filter: {userId: 1}, first: 1) {
+		totalCount edges { cursor node { id amount user { id } } } pageInfo { endCursor hasNextPage } } }`, false)
+	require.Nil(t, resp["errors"])
+	conn := resp["data"].(map[string]interface{})["transactions"].(map[string]interface{})
+	require.Equal(t, 2.0, conn["totalCount"])
+	require.Len(t, conn["edges"], 1)
+	pageInfo := conn["pageInfo"].(map[string]interface{})
+	require.Equal(t, true, pageInfo["hasNextPage"])
+
+	resp = graphqlRequestFor(t, `{ transactions(filter: {email: "a@b.c", minAmount: 5}, after: "`+pageInfo["endCursor"].(string)+`") { edges { node { id } } } }`, false)
+	require.Nil(t, resp["errors"])
+	edges := resp["data"].(map[string]interface{})["transactions"].(map[string]interface{})["edges"].([]interface{})
+	require.Len(t, edges, 1)
+
+	resp = graphqlRequestFor(t, `{ transaction(id: 1) { events { event account direction amount } dispute { id status } refunds { disputeId amount } } }`, false)
+	require.Nil(t, resp["errors"])
+	tr := resp["data"].(map[string]interface{})["transaction"].(map[string]interface{})
+	require.Len(t, tr["events"], 2)
+	require.Equal(t, map[string]interface{}{"event": "authorize", "account": "customer:1", "direction": "debit", "amount": 1.2}, tr["events"].([]interface{})[0])
+	require.Equal(t, map[string]interface{}{"id": float64(2), "status": disputeLost}, tr["dispute"])
+	require.Equal(t, []interface{}{map[string]interface{}{"disputeId": float64(2), "amount": 1.2}}, tr["refunds"])
+
+	resp = graphqlRequestFor(t, `{ user(id: 1) { transactions { edges { node { id dispute { id } refunds { amount } } } } } }`, false)
+	require.Nil(t, resp["errors"])
+
+	tc := []struct {
+		query string
+		auth  bool
+		fails bool
+	}{
+		{`{ transaction(id: 1) { id status } }`, false, false},
+		{`{ transactions(filter: {}) { totalCount } }`, false, true},
+		{`{ transactions(filter: {userId: 1}, after: "smth") { totalCount } }`, false, true},
+		{`{ transactions(filter: {userId: 1}, first: 1000) { totalCount } }`, false, true},
+		{`{ user(id: 1) { transactions { edges { node { user { transactions { edges { node { user { id } } } } } } } } } }`, false, true},
+		{`{ a: transactions(filter: {userId: 1}, first: 100) { totalCount } b: transactions(filter: {userId: 1}, first: 100) { totalCount }
+			c: transactions(filter: {userId: 1}, first: 100) { totalCount } d: transactions(filter: {userId: 1}, first: 100) { totalCount }
+			e: transactions(filter: {userId: 1}, first: 100) { totalCount } f: transactions(filter: {userId: 1}, first: 100) { totalCount } }`, false, true},
+		{`{ user(id: 1) { id emails transactions(status: "НОВЫЙ") { totalCount } } }`, false, false},
+		{`mutation { createTransaction(input: {userId: 1, email: "exmpl@m.com", amount: 1.5, currency: "USD"}) { id } }`, false, false},
+		{`mutation { createTransaction(input: {userId: 1, email: "exmpl@m.com", amount: 1.5, currency: ""}) { id } }`, false, true},
+		{`mutation { cancelTransaction(id: 1) { id } }`, false, false},
+		{`mutation { changeTransactionStatus(id: 1, status: "УСПЕХ") { id } }`, false, true},
+		{`mutation { changeTransactionStatus(id: 1, status: "УСПЕХ") { id } }`, true, false},
+		{`mutation { changeTransactionStatus(id: 1, status: "SUCCESS") { id } }`, true, true},
+	}
+	for _, c := range tc {
+		resp = graphqlRequestFor(t, c.query, c.auth)
+		require.Equal(t, c.fails, resp["errors"] != nil, c.query)
+	}
+
+	rr := httptest.NewRecorder()
+	errorHandler(GraphQLHandler()).ServeHTTP(rr, httptest.NewRequest("POST", "/graphql", strings.NewReader("{}")))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,309 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ineverbee/paymulator/internal/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer exposes the same Server implementation over gRPC
+type grpcServer struct {
+	pb.UnimplementedPaymulatorServer
+}
+
+func NewGRPCServer() *grpc.Server {
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(unaryInterceptor),
+		grpc.StreamInterceptor(streamInterceptor),
+	)
+	pb.RegisterPaymulatorServer(s, &grpcServer{})
+	return s
+}
+
+// unaryInterceptor is a gRPC counterpart of loggingHandler(limit(...))
+func unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	log.Printf("Strated %s", info.FullMethod)
+	defer func() { log.Printf("Completed %s in %v", info.FullMethod, time.Since(start)) }()
+	if !limiter.Allow() {
+		return nil, status.Error(codes.ResourceExhausted, http.StatusText(http.StatusTooManyRequests))
+	}
+	ctx, s := startGRPCSpan(ctx, info.FullMethod)
+	defer s.End()
+	resp, err := handler(ctx, req)
+	err = grpcError(err)
+	setGRPCStatus(s, err)
+	return resp, err
+}
+
+func streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	log.Printf("Strated %s", info.FullMethod)
+	defer func() { log.Printf("Completed %s in %v", info.FullMethod, time.Since(start)) }()
+	if !limiter.Allow() {
+		return status.Error(codes.ResourceExhausted, http.StatusText(http.StatusTooManyRequests))
+	}
+	ctx, s := startGRPCSpan(ss.Context(), info.FullMethod)
+	defer s.End()
+	err := grpcError(handler(srv, &tracedStream{ss, ctx}))
+	setGRPCStatus(s, err)
+	return err
+}
+
+// setGRPCStatus records status of call, only server faults mark span as failed like 5xx do
+func setGRPCStatus(s *span, err error) {
+	code := status.Code(err)
+	s.SetAttribute("rpc.grpc.status_code", int(code))
+	switch code {
+	case codes.Unknown, codes.DeadlineExceeded, codes.Unimplemented, codes.Internal, codes.Unavailable, codes.DataLoss:
+		s.SetError(err)
+	}
+}
+
+// startGRPCSpan starts server span of call, continuing trace of traceparent metadata
+func startGRPCSpan(ctx context.Context, method string) (context.Context, *span) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(traceparentHeader); len(v) > 0 {
+			if tc, ok := parseTraceparent(v[0]); ok {
+				ctx = withRemoteParent(ctx, tc)
+			}
+		}
+	}
+	ctx, s := startSpan(ctx, strings.TrimPrefix(method, "/"), spanServer)
+	s.SetAttribute("rpc.system", "grpc")
+	s.SetAttribute("rpc.method", method)
+	return ctx, s
+}
+
+// tracedStream passes span of stream to its handler
+type tracedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedStream) Context() context.Context {
+	return s.ctx
+}
+
+// grpcCodes maps StatusError HTTP codes to gRPC codes
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.FailedPrecondition,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+	http.StatusNotImplemented:      codes.Unimplemented,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+	http.StatusGatewayTimeout:      codes.DeadlineExceeded,
+	http.StatusInternalServerError: codes.Internal,
+}
+
+// grpcError does the same job for gRPC as errorHandler does for HTTP
+func grpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	var e Error
+	if errors.As(err, &e) {
+		log.Printf("gRPC %d - %s", e.Status(), e)
+		code, ok := grpcCodes[e.Status()]
+		if !ok {
+			code = codes.Unknown
+		}
+		return status.Error(code, e.Error())
+	}
+	log.Printf("gRPC - %s", err)
+	return status.Error(codes.Internal, http.StatusText(http.StatusInternalServerError))
+}
+
+// grpcBasicAuth checks payment system credentials passed in
+// 'authorization: Basic ...' metadata
+func grpcBasicAuth(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if !strings.HasPrefix(v, "Basic ") {
+			continue
+		}
+		c, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(v, "Basic "))
+		if err != nil {
+			continue
+		}
+		username, password, ok := strings.Cut(string(c), ":")
+		if ok && validCredentials(username, password) {
+			return nil
+		}
+	}
+	return &StatusError{http.StatusUnauthorized, fmt.Errorf("Unauthorized")}
+}
+
+func toPBTransaction(t *Transaction) *pb.Transaction {
+	return &pb.Transaction{
+		Id:                int64(t.ID),
+		CustomerId:        int64(t.CustomerID),
+		UserId:            int64(t.UserID),
+		Email:             t.Email,
+		Amount:            t.Amount,
+		Currency:          t.Currency,
+		CreatedAt:         toPBTimestamp(t.Created_at),
+		ChangedAt:         toPBTimestamp(t.Changed_at),
+		TransactionStatus: t.Status,
+		MerchantId:        int64(t.MerchantID),
+		Fee:               t.Fee,
+		NetAmount:         t.NetAmount,
+		PaymentMethodId:   int64(t.PaymentMethodID),
+		DeclineCode:       t.DeclineCode,
+		RedirectUrl:       redirectURL(t),
+		Metadata:          t.Metadata,
+		MerchantReference: t.MerchantReference,
+	}
+}
+
+func redirectURL(t *Transaction) string {
+	if t.NextAction == nil {
+		return ""
+	}
+	return t.NextAction.RedirectURL
+}
+
+func toPBTimestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func (s *grpcServer) CreateTransaction(ctx context.Context, req *pb.CreateTransactionRequest) (*pb.Transaction, error) {
+	t := &Transaction{
+		CustomerID:        int(req.CustomerId),
+		UserID:            int(req.UserId),
+		Email:             req.Email,
+		Amount:            req.Amount,
+		Currency:          req.Currency,
+		MerchantID:        int(req.MerchantId),
+		PaymentMethodID:   int(req.PaymentMethodId),
+		ReturnURL:         req.ReturnUrl,
+		CardToken:         req.CardToken,
+		Metadata:          req.Metadata,
+		MerchantReference: req.MerchantReference,
+	}
+	err := validateTransaction(t)
+	if err != nil {
+		return nil, err
+	}
+	err = api.CreateTransaction(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	return toPBTransaction(t), nil
+}
+
+func (s *grpcServer) GetTransaction(ctx context.Context, req *pb.GetTransactionRequest) (*pb.Transaction, error) {
+	t, err := api.GetTransaction(ctx, int(req.Id))
+	if err != nil {
+		return nil, err
+	}
+	return toPBTransaction(t), nil
+}
+
+func (s *grpcServer) ListTransactions(ctx context.Context, req *pb.ListTransactionsRequest) (*pb.ListTransactionsResponse, error) {
+	var (
+		ts  []Transaction
+		err error
+	)
+	switch {
+	case req.UserId != 0:
+		ts, err = api.GetUserTransactionsByID(ctx, int(req.UserId))
+	case req.Email != "":
+		ts, err = api.GetUserTransactionsByEmail(ctx, req.Email)
+	default:
+		return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: no 'user_id' or 'email' provided")}
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = sortTransactions(ts, req.Sort, req.Order)
+	if err != nil {
+		return nil, err
+	}
+	start, end := Paginate(int(req.Page), 10, len(ts))
+	resp := &pb.ListTransactionsResponse{}
+	for i := range ts[start:end] {
+		resp.Transactions = append(resp.Transactions, toPBTransaction(&ts[start+i]))
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) ChangeStatus(ctx context.Context, req *pb.ChangeStatusRequest) (*pb.ChangeStatusResponse, error) {
+	err := grpcBasicAuth(ctx)
+	if err != nil {
+		return nil, err
+	}
+	t := &Transaction{ID: int(req.Id), Status: req.TransactionStatus}
+	err = validateStatusChange(t)
+	if err != nil {
+		return nil, err
+	}
+	err = api.ChangeTransactionStatus(ctx, t.ID, t.Status)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ChangeStatusResponse{Id: req.Id, TransactionStatus: t.Status}, nil
+}
+
+func (s *grpcServer) Cancel(ctx context.Context, req *pb.CancelRequest) (*pb.ChangeStatusResponse, error) {
+	err := api.ChangeTransactionStatus(ctx, int(req.Id), "ОТМЕНЕН")
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ChangeStatusResponse{Id: req.Id, TransactionStatus: "ОТМЕНЕН"}, nil
+}
+
+func (s *grpcServer) WatchTransaction(req *pb.WatchTransactionRequest, stream pb.Paymulator_WatchTransactionServer) error {
+	id := int(req.Id)
+	sub := newSubscriber(subscriberBuffer)
+	// Subscribe before reading current status so no change slips in between
+	hub.Subscribe(id, sub)
+	defer hub.UnsubscribeAll(sub)
+
+	st, err := api.GetTransactionStatus(stream.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = stream.Send(&pb.StatusEvent{Id: req.Id, TransactionStatus: st})
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-sub.done:
+			return status.Error(codes.ResourceExhausted, "slow consumer")
+		case ev := <-sub.events:
+			err = stream.Send(&pb.StatusEvent{
+				Id:                int64(ev.ID),
+				TransactionStatus: ev.Status,
+				ChangedAt:         toPBTimestamp(ev.ChangedAt),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ineverbee/paymulator/internal/pb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPC(t *testing.T) {
+	api = &MockServer{}
+	limiter = rate.NewLimiter(10, 30)
+
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewGRPCServer()
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.Dial(
+		"bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewPaymulatorClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = client.CreateTransaction(ctx, &pb.CreateTransactionRequest{UserId: 1, Email: "exmpl@m.com", Amount: 1.5, Currency: "USD"})
+	require.NoError(t, err)
+	_, err = client.CreateTransaction(ctx, &pb.CreateTransactionRequest{UserId: 1, Email: "exmpl@m.com", Amount: 1.5})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	tr, err := client.GetTransaction(ctx, &pb.GetTransactionRequest{Id: 3})
+	require.NoError(t, err)
+	require.Equal(t, int64(3), tr.Id)
+	_, err = client.GetTransaction(ctx, &pb.GetTransactionRequest{Id: 0})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.GetTransaction(ctx, &pb.GetTransactionRequest{Id: -1})
+	require.Equal(t, codes.Internal, status.Code(err))
+
+	list, err := client.ListTransactions(ctx, &pb.ListTransactionsRequest{UserId: 1, Sort: "amount", Order: "desc"})
+	require.NoError(t, err)
+	require.Len(t, list.Transactions, 2)
+	require.Equal(t, 11.2, list.Transactions[0].Amount)
+	_, err = client.ListTransactions(ctx, &pb.ListTransactionsRequest{Email: "exmpl@m.com", Sort: "user"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.ListTransactions(ctx, &pb.ListTransactionsRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.ChangeStatus(ctx, &pb.ChangeStatusRequest{Id: 1, TransactionStatus: "УСПЕХ"})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	authCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("username:password")))
+	_, err = client.ChangeStatus(authCtx, &pb.ChangeStatusRequest{Id: 1, TransactionStatus: "УСПЕХ"})
+	require.NoError(t, err)
+	_, err = client.ChangeStatus(authCtx, &pb.ChangeStatusRequest{Id: 1, TransactionStatus: "SUCCESS"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.Cancel(ctx, &pb.CancelRequest{Id: 1})
+	require.NoError(t, err)
+
+	stream, err := client.WatchTransaction(ctx, &pb.WatchTransactionRequest{Id: 5})
+	require.NoError(t, err)
+	ev, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, int64(5), ev.Id)
+	hub.Publish(StatusEvent{ID: 5, Status: "УСПЕХ", ChangedAt: time.Now()})
+	ev, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "УСПЕХ", ev.TransactionStatus)
+	require.NotNil(t, ev.ChangedAt)
+}
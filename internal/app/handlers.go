@@ -1,14 +1,21 @@
 package app
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -20,6 +27,7 @@ var limiter = rate.NewLimiter(10, 30)
 func limit(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !limiter.Allow() {
+			rateLimited.Inc(r.Method, routeTemplate(r))
 			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
 			return
 		}
@@ -62,22 +70,104 @@ func loggingHandler(next http.Handler) http.Handler {
 	})
 }
 
+// requestRoute is method and path template of matched route, like "GET /transactions/{id}"
+func requestRoute(r *http.Request) string {
+	return r.Method + " " + routeTemplate(r)
+}
+
+// routeTemplate is path template of matched route, or path itself
+func routeTemplate(r *http.Request) string {
+	if cur := mux.CurrentRoute(r); cur != nil {
+		if tpl, err := cur.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return r.URL.Path
+}
+
+// statusRecorder keeps response status for middleware,
+// hijacking and flushing are left to the underlying writer
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("error: connection can't be hijacked")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// Request body is peeked for merchant_id up to this size
+const maxMerchantPeek = 1 << 20
+
+// requestMerchantID finds merchant of request in merchant_id query parameter or JSON body,
+// body is left for handler to read
+func requestMerchantID(r *http.Request) *int {
+	if val := r.URL.Query().Get("merchant_id"); val != "" {
+		if id, err := strconv.Atoi(val); err == nil {
+			return &id
+		}
+	}
+	if r.Body == nil || !strings.HasPrefix(r.Header.Get("content-type"), "application/json") && r.Header.Get("content-type") != "" {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxMerchantPeek))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil {
+		return nil
+	}
+	var req struct {
+		MerchantID *int `json:"merchant_id"`
+	}
+	json.Unmarshal(body, &req)
+	return req.MerchantID
+}
+
+// validCredentials checks payment system credentials in constant time
+func validCredentials(username, password string) bool {
+	usernameHash := sha256.Sum256([]byte(username))
+	passwordHash := sha256.Sum256([]byte(password))
+	expectedUsernameHash := sha256.Sum256([]byte(api.AuthUsername()))
+	expectedPasswordHash := sha256.Sum256([]byte(api.AuthPassword()))
+
+	usernameMatch := (subtle.ConstantTimeCompare(usernameHash[:], expectedUsernameHash[:]) == 1)
+	passwordMatch := (subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:]) == 1)
+
+	return usernameMatch && passwordMatch
+}
+
 func basicAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		username, password, ok := r.BasicAuth()
-		if ok {
-			usernameHash := sha256.Sum256([]byte(username))
-			passwordHash := sha256.Sum256([]byte(password))
-			expectedUsernameHash := sha256.Sum256([]byte(api.AuthUsername()))
-			expectedPasswordHash := sha256.Sum256([]byte(api.AuthPassword()))
-
-			usernameMatch := (subtle.ConstantTimeCompare(usernameHash[:], expectedUsernameHash[:]) == 1)
-			passwordMatch := (subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:]) == 1)
-
-			if usernameMatch && passwordMatch {
-				next.ServeHTTP(w, r)
-				return
-			}
+		if ok && validCredentials(username, password) {
+			next.ServeHTTP(w, r)
+			return
 		}
 
 		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
@@ -95,11 +185,15 @@ func (f errorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			// We can retrieve the status here and write out a specific
 			// HTTP status code.
 			log.Printf("HTTP %d - %s", e.Status(), e)
+			if e.Status() >= 500 {
+				spanFromContext(r.Context()).SetError(e)
+			}
 			http.Error(w, e.Error(), e.Status())
 		default:
 			// Any error types we don't specifically look out for default
 			// to serving a HTTP 500
 			log.Printf("HTTP - %s", e)
+			spanFromContext(r.Context()).SetError(e)
 			http.Error(w, http.StatusText(http.StatusInternalServerError),
 				http.StatusInternalServerError)
 		}
@@ -114,13 +208,20 @@ func GetTransactionStatusHandler() errorHandler {
 		if err != nil {
 			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: id is NaN")}
 		}
-		st, err := api.GetTransactionStatus(id)
+		t, err := api.GetTransaction(r.Context(), id)
 		if err != nil {
 			return err
 		}
+		// Merchant's data is always present, lookups by id shouldn't check for it
+		metadata := t.Metadata
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
 		resp := map[string]interface{}{
 			"id":                 id,
-			"transaction_status": st,
+			"transaction_status": t.Status,
+			"metadata":           metadata,
+			"merchant_reference": t.MerchantReference,
 		}
 		data, _ := json.Marshal(resp)
 		rw.Header().Add("content-type", "application/json")
@@ -136,73 +237,49 @@ func GetUserTransactionsHandler() errorHandler {
 		query := r.URL.Query()
 		ts := make([]Transaction, 0)
 		var err error
-		if uid := query.Get("user_id"); uid != "" {
+		if metadata, reference := metadataParams(query), query.Get("merchant_reference"); len(metadata) > 0 || reference != "" {
+			filter := ExportFilter{Email: query.Get("email"), Metadata: metadata, MerchantReference: reference}
+			if uid := query.Get("user_id"); uid != "" {
+				filter.UserID, err = strconv.Atoi(uid)
+				if err != nil {
+					return &StatusError{http.StatusBadRequest, fmt.Errorf("error: 'user_id' is NaN")}
+				}
+			}
+			err = api.ExportTransactions(r.Context(), filter, func(t *Transaction) error {
+				ts = append(ts, *t)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		} else if uid := query.Get("user_id"); uid != "" {
 			userID, err := strconv.Atoi(uid)
 			if err != nil {
 				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: 'user_id' is NaN")}
 			}
-			ts, err = api.GetUserTransactionsByID(userID)
+			ts, err = api.GetUserTransactionsByID(r.Context(), userID)
 			if err != nil {
 				return err
 			}
 		} else if email := query.Get("email"); email != "" {
-			ts, err = api.GetUserTransactionsByEmail(email)
+			ts, err = api.GetUserTransactionsByEmail(r.Context(), email)
 			if err != nil {
 				return err
 			}
 		} else {
 			return &StatusError{
 				http.StatusBadRequest,
-				fmt.Errorf("error: no 'user_id' or 'email' provided"),
+				fmt.Errorf("error: no 'user_id', 'email', 'merchant_reference' or 'metadata[key]' provided"),
 			}
 		}
 
-		order := query.Get("order")
-		switch order {
-		case "", "asc", "desc":
-		default:
-			return &StatusError{
-				http.StatusBadRequest,
-				fmt.Errorf("error: there is no order like '%s'; available orders: asc,desc", order),
-			}
-		}
-
-		switch sorting := query.Get("sort"); {
-		case sorting == "date" || sorting == "":
-			if order == "desc" {
-				sort.Slice(ts, func(i, j int) bool {
-					return ts[i].ID > ts[j].ID
-				})
-			} else {
-				sort.Slice(ts, func(i, j int) bool {
-					return ts[i].ID < ts[j].ID
-				})
-			}
-		case sorting == "amount":
-			if order == "desc" {
-				sort.Slice(ts, func(i, j int) bool {
-					return ts[i].Amount > ts[j].Amount
-				})
-			} else {
-				sort.Slice(ts, func(i, j int) bool {
-					return ts[i].Amount < ts[j].Amount
-				})
-			}
-		default:
-			return &StatusError{
-				http.StatusBadRequest,
-				fmt.Errorf("error: there is no sort like '%s'; available sorts: date,amount", sorting),
-			}
+		err = sortTransactions(ts, query.Get("sort"), query.Get("order"))
+		if err != nil {
+			return err
 		}
-		page := 0
-		if val := query.Get("page"); val != "" {
-			page, err = strconv.Atoi(val)
-			if err != nil {
-				return &StatusError{
-					http.StatusBadRequest,
-					fmt.Errorf("error: page should be integer, got '%v'", val),
-				}
-			}
+		page, err := pageParam(query.Get("page"))
+		if err != nil {
+			return err
 		}
 
 		start, end := Paginate(page, 10, len(ts))
@@ -224,16 +301,15 @@ func CreateTransactionHandler() errorHandler {
 		if err != nil {
 			return &StatusError{http.StatusBadRequest, err}
 		}
-		switch {
-		case t.UserID == 0 || t.Email == "" || t.Amount == 0 || t.Currency == "":
-			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: user_id, email, amount, currency")}
-		case len([]rune(t.Email)) > 50:
-			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: email shouldn't be more than 50 characters")}
-		case len([]rune(t.Currency)) > 20:
-			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: currency shouldn't be more than 20 characters")}
+		if name := r.Header.Get(scenarioHeader); name != "" {
+			t.Scenario = name
+		}
+		err = validateTransaction(t)
+		if err != nil {
+			return err
 		}
 
-		err = api.CreateTransaction(t)
+		err = api.CreateTransaction(r.Context(), t)
 		if err != nil {
 			return err
 		}
@@ -242,6 +318,18 @@ func CreateTransactionHandler() errorHandler {
 			"id":                 t.ID,
 			"transaction_status": t.Status,
 		}
+		if t.DeclineCode != "" {
+			resp["decline_code"] = t.DeclineCode
+		}
+		if t.NextAction != nil {
+			resp["next_action"] = t.NextAction
+		}
+		if len(t.Metadata) > 0 {
+			resp["metadata"] = t.Metadata
+		}
+		if t.MerchantReference != "" {
+			resp["merchant_reference"] = t.MerchantReference
+		}
 		data, _ := json.Marshal(resp)
 		rw.WriteHeader(http.StatusCreated)
 		rw.Write(data)
@@ -249,6 +337,43 @@ func CreateTransactionHandler() errorHandler {
 	}
 }
 
+// UpdateTransactionHandler..
+func UpdateTransactionHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: id is NaN")}
+		}
+		u := TransactionUpdate{}
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err = decoder.Decode(&u)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		if u.Metadata == nil && u.MerchantReference == nil {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: metadata or merchant_reference")}
+		}
+		if u.MerchantReference != nil && len([]rune(*u.MerchantReference)) > maxReferenceLength {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: merchant_reference shouldn't be more than %d characters", maxReferenceLength)}
+		}
+		err = validateMetadata(u.Metadata, true)
+		if err != nil {
+			return err
+		}
+
+		t, err := api.UpdateTransaction(r.Context(), id, u)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(t)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(data)
+		return nil
+	}
+}
+
 // ChangeTransactionStatusHandler..
 func ChangeTransactionStatusHandler() errorHandler {
 	return func(rw http.ResponseWriter, r *http.Request) error {
@@ -260,17 +385,12 @@ func ChangeTransactionStatusHandler() errorHandler {
 			return &StatusError{http.StatusBadRequest, err}
 		}
 
-		if t.ID == 0 || t.Status == "" {
-			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: id, transaction_status")}
-		}
-
-		switch t.Status {
-		case "УСПЕХ", "НЕУСПЕХ":
-		default:
-			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: can't change transaction status to '%s'", t.Status)}
+		err = validateStatusChange(t)
+		if err != nil {
+			return err
 		}
 
-		err = api.ChangeTransactionStatus(t.ID, t.Status)
+		err = api.ChangeTransactionStatus(r.Context(), t.ID, t.Status)
 		if err != nil {
 			return err
 		}
@@ -294,7 +414,7 @@ func CancelTransactionHandler() errorHandler {
 			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: id is NaN")}
 		}
 
-		err = api.ChangeTransactionStatus(id, "ОТМЕНЕН")
+		err = api.ChangeTransactionStatus(r.Context(), id, "ОТМЕНЕН")
 		if err != nil {
 			return err
 		}
@@ -309,6 +429,140 @@ func CancelTransactionHandler() errorHandler {
 	}
 }
 
+// validateTransaction checks a new transaction before it's created
+func validateTransaction(t *Transaction) error {
+	switch {
+	case t.CustomerID == 0 && (t.UserID == 0 || t.Email == "") || t.Amount == 0 || t.Currency == "":
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: user_id, email, amount, currency")}
+	case t.Amount < 0:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: amount should be positive")}
+	case t.CustomerID < 0:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: customer_id shouldn't be negative")}
+	case len([]rune(t.Email)) > maxEmailLength:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: email shouldn't be more than %d characters", maxEmailLength)}
+	case len([]rune(t.Currency)) > 20:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: currency shouldn't be more than 20 characters")}
+	case t.MerchantID < 0:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: merchant_id shouldn't be negative")}
+	case t.PaymentMethodID < 0:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: payment_method_id shouldn't be negative")}
+	case t.PaymentMethodID != 0 && t.CardToken != "":
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: either payment_method_id or card_token should be set, not both")}
+	case t.ReturnURL != "" && !validReturnURL(t.ReturnURL):
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: return_url should be an absolute http(s) URL")}
+	case len([]rune(t.MerchantReference)) > maxReferenceLength:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: merchant_reference shouldn't be more than %d characters", maxReferenceLength)}
+	}
+	return validateMetadata(t.Metadata, false)
+}
+
+// Limits of merchant's data on transaction
+const (
+	maxMetadataKeys        = 50
+	maxMetadataKeyLength   = 40
+	maxMetadataValueLength = 500
+	maxReferenceLength     = 100
+)
+
+// validateMetadata checks metadata limits, update may have empty values removing keys
+func validateMetadata(m map[string]string, update bool) error {
+	if len(m) > maxMetadataKeys {
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: metadata can't have more than %d keys", maxMetadataKeys)}
+	}
+	for key, val := range m {
+		switch {
+		case key == "" || len([]rune(key)) > maxMetadataKeyLength:
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: metadata keys should be 1 to %d characters", maxMetadataKeyLength)}
+		case val == "" && !update:
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: metadata value of '%s' is empty", key)}
+		case len([]rune(val)) > maxMetadataValueLength:
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: metadata value of '%s' shouldn't be more than %d characters", key, maxMetadataValueLength)}
+		}
+	}
+	return nil
+}
+
+// metadataParams reads metadata[key]=value query parameters
+func metadataParams(query url.Values) map[string]string {
+	m := make(map[string]string)
+	for param, vals := range query {
+		if strings.HasPrefix(param, "metadata[") && strings.HasSuffix(param, "]") && len(vals) > 0 {
+			m[param[len("metadata["):len(param)-1]] = vals[0]
+		}
+	}
+	return m
+}
+
+// validateStatusChange checks status change requested by payment system
+func validateStatusChange(t *Transaction) error {
+	if t.ID == 0 || t.Status == "" {
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: id, transaction_status")}
+	}
+
+	switch t.Status {
+	case "УСПЕХ", "НЕУСПЕХ":
+	default:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: can't change transaction status to '%s'", t.Status)}
+	}
+	return nil
+}
+
+// sortTransactions sorts ts in place by date or amount
+func sortTransactions(ts []Transaction, sorting, order string) error {
+	switch order {
+	case "", "asc", "desc":
+	default:
+		return &StatusError{
+			http.StatusBadRequest,
+			fmt.Errorf("error: there is no order like '%s'; available orders: asc,desc", order),
+		}
+	}
+
+	switch {
+	case sorting == "date" || sorting == "":
+		if order == "desc" {
+			sort.Slice(ts, func(i, j int) bool {
+				return ts[i].ID > ts[j].ID
+			})
+		} else {
+			sort.Slice(ts, func(i, j int) bool {
+				return ts[i].ID < ts[j].ID
+			})
+		}
+	case sorting == "amount":
+		if order == "desc" {
+			sort.Slice(ts, func(i, j int) bool {
+				return ts[i].Amount > ts[j].Amount
+			})
+		} else {
+			sort.Slice(ts, func(i, j int) bool {
+				return ts[i].Amount < ts[j].Amount
+			})
+		}
+	default:
+		return &StatusError{
+			http.StatusBadRequest,
+			fmt.Errorf("error: there is no sort like '%s'; available sorts: date,amount", sorting),
+		}
+	}
+	return nil
+}
+
+// pageParam parses optional 'page' query parameter
+func pageParam(val string) (int, error) {
+	if val == "" {
+		return 0, nil
+	}
+	page, err := strconv.Atoi(val)
+	if err != nil || page < 0 {
+		return 0, &StatusError{
+			http.StatusBadRequest,
+			fmt.Errorf("error: page should be non-negative integer, got '%v'", val),
+		}
+	}
+	return page, nil
+}
+
 func Paginate(pageNum int, pageSize int, sliceLength int) (int, int) {
 	start := pageNum * pageSize
 
@@ -0,0 +1,414 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Request id is taken from client, or generated and returned in this header
+const requestIDHeader = "X-Request-Id"
+
+// Bodies are journaled up to this size
+const journalBodyLimit = 64 << 10
+
+// Entries wait for database in this queue, they are dropped when it's full
+const journalQueueSize = 1000
+
+// Journal grows with every call, so it's paged by database
+const journalPageSize = 10
+
+const journalPruneInterval = time.Hour
+
+const redacted = "[REDACTED]"
+
+// Values of these headers, query parameters and JSON fields never reach the journal
+var (
+	journalSecretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+	journalSecretParams  = []string{"token"}
+	journalSecretFields  = map[string]bool{"number": true, "cvc": true, "cvv": true, "password": true, "secret": true}
+)
+
+// journal persists API calls in background, so clients don't wait for it
+type journal struct {
+	entries   chan *JournalEntry
+	retention time.Duration
+}
+
+// newJournal is configured by JOURNAL_RETENTION, journal is disabled if it's "0"
+func newJournal(retention string) (*journal, error) {
+	j := &journal{entries: make(chan *JournalEntry, journalQueueSize), retention: 7 * 24 * time.Hour}
+	if retention == "" {
+		return j, nil
+	}
+	d, err := time.ParseDuration(retention)
+	if err != nil || d < 0 {
+		return nil, fmt.Errorf("error: JOURNAL_RETENTION should be a duration like '168h'")
+	}
+	if d == 0 {
+		return nil, nil
+	}
+	j.retention = d
+	return j, nil
+}
+
+// RecordRequest queues entry for the journal
+func (s *ApiServer) RecordRequest(e *JournalEntry) {
+	if s.journal == nil {
+		return
+	}
+	select {
+	case s.journal.entries <- e:
+	default:
+		log.Printf("Journal is full, request %s isn't recorded", e.RequestID)
+	}
+}
+
+// runJournal writes queued entries and removes ones older than retention
+func (s *ApiServer) runJournal(ctx context.Context) {
+	ticker := time.NewTicker(journalPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-s.journal.entries:
+			err := s.insertJournalEntry(ctx, e)
+			if err != nil {
+				log.Printf("Journal entry of request %s failed - %s", e.RequestID, err)
+			}
+		case <-ticker.C:
+			_, err := s.database.Exec(ctx, "delete from request_journal where created_at<$1", clock.Now().Add(-s.journal.retention))
+			if err != nil {
+				log.Printf("Journal pruning failed - %s", err)
+			}
+		}
+	}
+}
+
+func (s *ApiServer) insertJournalEntry(ctx context.Context, e *JournalEntry) error {
+	reqHeader, _ := json.Marshal(e.RequestHeader)
+	respHeader, _ := json.Marshal(e.ResponseHeader)
+	return s.database.QueryRow(
+		ctx,
+		`insert into request_journal (request_id, method, path, route, query, merchant_id, request_header, request_body,
+		status, response_header, response_body, latency_ms, error, created_at)
+		values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14) returning id`,
+		e.RequestID,
+		e.Method,
+		e.Path,
+		e.Route,
+		e.Query,
+		e.MerchantID,
+		reqHeader,
+		e.RequestBody,
+		e.Status,
+		respHeader,
+		e.ResponseBody,
+		e.LatencyMs,
+		e.Error,
+		e.Created_at,
+	).Scan(&e.ID)
+}
+
+// JournalFilter narrows down journal. Zero values match everything.
+type JournalFilter struct {
+	Method     string
+	Path       string
+	Status     int
+	MerchantID *int
+	RequestID  string
+	From, To   time.Time
+	Page       int
+}
+
+const journalColumns = `id, request_id, method, path, route, query, merchant_id, request_header, request_body,
+	status, response_header, response_body, latency_ms, error, created_at`
+
+func scanJournalEntry(row pgx.Row, e *JournalEntry) error {
+	return row.Scan(
+		&e.ID,
+		&e.RequestID,
+		&e.Method,
+		&e.Path,
+		&e.Route,
+		&e.Query,
+		&e.MerchantID,
+		&e.RequestHeader,
+		&e.RequestBody,
+		&e.Status,
+		&e.ResponseHeader,
+		&e.ResponseBody,
+		&e.LatencyMs,
+		&e.Error,
+		&e.Created_at,
+	)
+}
+
+// GetJournal lists journaled calls, the latest first
+func (s *ApiServer) GetJournal(ctx context.Context, f JournalFilter) ([]JournalEntry, error) {
+	q := "select " + journalColumns + " from request_journal where true"
+	args := make([]interface{}, 0, 8)
+	if f.Method != "" {
+		args = append(args, f.Method)
+		q += fmt.Sprintf(" and method=$%d", len(args))
+	}
+	if f.Path != "" {
+		args = append(args, f.Path)
+		q += fmt.Sprintf(" and (path=$%d or route=$%[1]d)", len(args))
+	}
+	if f.Status != 0 {
+		args = append(args, f.Status)
+		q += fmt.Sprintf(" and status=$%d", len(args))
+	}
+	if f.MerchantID != nil {
+		args = append(args, *f.MerchantID)
+		q += fmt.Sprintf(" and merchant_id=$%d", len(args))
+	}
+	if f.RequestID != "" {
+		args = append(args, f.RequestID)
+		q += fmt.Sprintf(" and request_id=$%d", len(args))
+	}
+	if !f.From.IsZero() {
+		args = append(args, f.From)
+		q += fmt.Sprintf(" and created_at>=$%d", len(args))
+	}
+	if !f.To.IsZero() {
+		args = append(args, f.To)
+		q += fmt.Sprintf(" and created_at<$%d", len(args))
+	}
+	q += fmt.Sprintf(" order by id desc limit %d offset %d", journalPageSize, f.Page*journalPageSize)
+	rows, err := s.database.Query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]JournalEntry, 0)
+	for rows.Next() {
+		e := JournalEntry{}
+		err = scanJournalEntry(rows, &e)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "req_" + hex.EncodeToString(b)
+}
+
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range journalSecretHeaders {
+		if h.Get(name) != "" {
+			h.Set(name, redacted)
+		}
+	}
+	return h
+}
+
+func redactQuery(rawQuery string) string {
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return ""
+	}
+	for _, name := range journalSecretParams {
+		if q.Get(name) != "" {
+			q.Set(name, redacted)
+		}
+	}
+	return q.Encode()
+}
+
+// redactValue replaces secret fields of decoded JSON in place
+func redactValue(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			if journalSecretFields[key] {
+				v[key] = redacted
+				continue
+			}
+			redactValue(val)
+		}
+	case []interface{}:
+		for _, val := range v {
+			redactValue(val)
+		}
+	}
+}
+
+// secretFieldPattern finds secret fields of JSON cut by size limit, which can't be decoded
+var secretFieldPattern = regexp.MustCompile(`"(number|cvc|cvv|password|secret)"\s*:\s*("[^"]*"?|[0-9]+)`)
+
+// journalBody makes body fit for the journal: JSON has secrets redacted,
+// binary is left out and long one is cut
+func journalBody(b []byte, truncated bool) string {
+	if len(b) == 0 {
+		return ""
+	}
+	if !truncated {
+		var v interface{}
+		if json.Unmarshal(b, &v) == nil {
+			redactValue(v)
+			b, _ = json.Marshal(v)
+			return string(b)
+		}
+	}
+	text := b
+	// Cut may split the last character
+	for i := 1; truncated && i < utf8.UTFMax && len(text) > 0 && !utf8.Valid(text); i++ {
+		text = text[:len(text)-1]
+	}
+	if !utf8.Valid(text) {
+		return fmt.Sprintf("[binary, %d bytes]", len(b))
+	}
+	text = secretFieldPattern.ReplaceAll(text, []byte(`"$1":"`+redacted+`"`))
+	if truncated {
+		return string(text) + "...[truncated]"
+	}
+	return string(text)
+}
+
+// journalWriter keeps the start of response body along with status
+type journalWriter struct {
+	statusRecorder
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *journalWriter) Write(p []byte) (int, error) {
+	if room := journalBodyLimit - w.body.Len(); room > 0 {
+		if len(p) > room {
+			w.body.Write(p[:room])
+			w.truncated = true
+		} else {
+			w.body.Write(p)
+		}
+	} else if len(p) > 0 {
+		w.truncated = true
+	}
+	return w.statusRecorder.Write(p)
+}
+
+// journaling records every API call with its response, tagged by request id
+func journaling(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 100 {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		route := requestRoute(r)
+		// Reading the journal and scrapes aren't journaled, they would drown what testers look for
+		if route == "GET /admin/requests" || route == "GET /metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		e := &JournalEntry{
+			RequestID:     id,
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			Route:         route,
+			Query:         redactQuery(r.URL.RawQuery),
+			MerchantID:    requestMerchantID(r),
+			RequestHeader: redactHeader(r.Header),
+			Created_at:    clock.Now(),
+		}
+		if r.Body != nil {
+			body, _ := io.ReadAll(io.LimitReader(r.Body, journalBodyLimit+1))
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+			if len(body) > journalBodyLimit {
+				e.RequestBody = journalBody(body[:journalBodyLimit], true)
+			} else {
+				e.RequestBody = journalBody(body, false)
+			}
+		}
+
+		jw := &journalWriter{statusRecorder: statusRecorder{ResponseWriter: w}}
+		defer func() {
+			p := recover()
+			e.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+			e.Status = jw.status
+			if e.Status == 0 && p == nil {
+				e.Status = http.StatusOK
+			}
+			if p != nil {
+				e.Error = "connection aborted"
+			}
+			e.ResponseHeader = redactHeader(w.Header())
+			e.ResponseBody = journalBody(jw.body.Bytes(), jw.truncated)
+			api.RecordRequest(e)
+			if p != nil {
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(jw, r)
+	})
+}
+
+// GetJournalHandler..
+func GetJournalHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		query := r.URL.Query()
+		filter := JournalFilter{Method: query.Get("method"), Path: query.Get("path"), RequestID: query.Get("request_id")}
+		if val := query.Get("status"); val != "" {
+			status, err := strconv.Atoi(val)
+			if err != nil {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: 'status' is NaN")}
+			}
+			filter.Status = status
+		}
+		if val := query.Get("merchant_id"); val != "" {
+			merchantID, err := strconv.Atoi(val)
+			if err != nil {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: 'merchant_id' is NaN")}
+			}
+			filter.MerchantID = &merchantID
+		}
+		for param, t := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+			if val := query.Get(param); val != "" {
+				var err error
+				*t, err = time.Parse(time.RFC3339, val)
+				if err != nil {
+					return &StatusError{http.StatusBadRequest, fmt.Errorf("error: '%s' should be RFC 3339 time", param)}
+				}
+			}
+		}
+		var err error
+		filter.Page, err = pageParam(query.Get("page"))
+		if err != nil {
+			return err
+		}
+
+		entries, err := api.GetJournal(r.Context(), filter)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(entries)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
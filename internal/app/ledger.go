@@ -0,0 +1,288 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/jackc/pgconn"
+)
+
+// Entry directions. Balance of an account is its credits minus debits.
+const (
+	debit  = "debit"
+	credit = "credit"
+)
+
+// Ledger accounts. Customer funds move to merchant pending account
+// on authorization and further to available account on capture.
+func customerAccount(userID int) string {
+	return fmt.Sprintf("customer:%d", userID)
+}
+
+func merchantAccount(merchantID int, kind string) string {
+	return fmt.Sprintf("merchant:%d:%s", merchantID, kind)
+}
+
+// fundsAccount tells where transaction amount is held in given status
+func fundsAccount(t *Transaction, status string) string {
+	switch status {
+	case "НОВЫЙ":
+		return merchantAccount(t.MerchantID, "pending")
+	case "УСПЕХ":
+		return merchantAccount(t.MerchantID, "available")
+	}
+	return customerAccount(t.UserID)
+}
+
+type ledgerLine struct {
+	account   string
+	direction string
+	amount    float64
+}
+
+// posting is a balanced set of ledger entries produced by a single event
+type posting struct {
+	transactionID int
+	payoutID      int
+	merchantID    int
+	currency      string
+	event         string
+	lines         []ledgerLine
+}
+
+// transfer builds a posting moving amount from one account to another
+func transfer(t *Transaction, event, from, to string, amount float64) *posting {
+	return &posting{
+		transactionID: t.ID,
+		merchantID:    t.MerchantID,
+		currency:      t.Currency,
+		event:         event,
+		lines: []ledgerLine{
+			{from, debit, amount},
+			{to, credit, amount},
+		},
+	}
+}
+
+// statusPosting moves funds of t according to its status change,
+// nil if funds stay where they are
+func statusPosting(t *Transaction, from, to string) *posting {
+	src, dst := fundsAccount(t, from), fundsAccount(t, to)
+	if src == dst {
+		return nil
+	}
+	event := "void"
+	switch to {
+	case "НОВЫЙ":
+		event = "authorize"
+	case "УСПЕХ":
+		event = "capture"
+	}
+	return transfer(t, event, src, dst, t.Amount)
+}
+
+func (p *posting) validate() error {
+	sum := 0.0
+	for _, l := range p.lines {
+		switch l.direction {
+		case debit:
+			sum += l.amount
+		case credit:
+			sum -= l.amount
+		default:
+			return fmt.Errorf("error: unknown entry direction '%s'", l.direction)
+		}
+	}
+	if math.Abs(sum) > 1e-6 {
+		return fmt.Errorf("error: %s posting of transaction %d is unbalanced by %v", p.event, p.transactionID, sum)
+	}
+	return nil
+}
+
+// Inserts posting and its entries in one statement, so postings can be batched.
+// Database checks balance of every posting on commit as well.
+const postingQuery = `with p as (
+	insert into ledger_postings (transaction_id, payout_id, merchant_id, event, created_at)
+	values (nullif($1::int, 0), nullif($2::int, 0), $3, $4, $9) returning id
+)
+insert into ledger_entries (posting_id, account, currency, direction, amount)
+select p.id, e.account, $5, e.direction, e.amount
+from p, unnest($6::varchar[], $7::direction[], $8::float8[]) as e(account, direction, amount)`
+
+func (p *posting) args() []interface{} {
+	accounts := make([]string, len(p.lines))
+	directions := make([]string, len(p.lines))
+	amounts := make([]float64, len(p.lines))
+	for i, l := range p.lines {
+		accounts[i], directions[i], amounts[i] = l.account, l.direction, l.amount
+	}
+	return []interface{}{p.transactionID, p.payoutID, p.merchantID, p.event, p.currency, accounts, directions, amounts, clock.Now()}
+}
+
+type execer interface {
+	Exec(context.Context, string, ...interface{}) (pgconn.CommandTag, error)
+}
+
+// postLedger writes posting within the caller's database transaction
+func postLedger(ctx context.Context, db execer, p *posting) error {
+	if p == nil {
+		return nil
+	}
+	err := p.validate()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx, postingQuery, p.args()...)
+	return err
+}
+
+// LedgerFilter narrows down ledger queries. Zero values match everything.
+type LedgerFilter struct {
+	MerchantID    *int
+	Currency      string
+	TransactionID int
+}
+
+func (s *ApiServer) GetBalances(ctx context.Context, f LedgerFilter) ([]Balance, error) {
+	q := `select account, currency, sum(case when direction='credit' then amount else -amount end)
+	from ledger_entries where true`
+	args := make([]interface{}, 0, 2)
+	if f.MerchantID != nil {
+		args = append(args, fmt.Sprintf("merchant:%d:%%", *f.MerchantID))
+		q += fmt.Sprintf(" and account like $%d", len(args))
+	}
+	if f.Currency != "" {
+		args = append(args, f.Currency)
+		q += fmt.Sprintf(" and currency=$%d", len(args))
+	}
+	rows, err := s.database.Query(ctx, q+" group by account, currency order by account, currency", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := make([]Balance, 0)
+	for rows.Next() {
+		b := Balance{}
+		err = rows.Scan(&b.Account, &b.Currency, &b.Balance)
+		if err != nil {
+			return nil, err
+		}
+		balances = append(balances, b)
+	}
+	return balances, rows.Err()
+}
+
+func (s *ApiServer) GetLedgerEntries(ctx context.Context, f LedgerFilter) ([]LedgerEntry, error) {
+	q := `select e.id, e.posting_id, coalesce(p.transaction_id, 0), coalesce(p.payout_id, 0), p.merchant_id, p.event, e.account, e.currency, e.direction, e.amount, p.created_at
+	from ledger_entries e join ledger_postings p on p.id=e.posting_id where true`
+	args := make([]interface{}, 0, 3)
+	if f.MerchantID != nil {
+		args = append(args, *f.MerchantID)
+		q += fmt.Sprintf(" and p.merchant_id=$%d", len(args))
+	}
+	if f.Currency != "" {
+		args = append(args, f.Currency)
+		q += fmt.Sprintf(" and e.currency=$%d", len(args))
+	}
+	if f.TransactionID != 0 {
+		args = append(args, f.TransactionID)
+		q += fmt.Sprintf(" and p.transaction_id=$%d", len(args))
+	}
+	rows, err := s.database.Query(ctx, q+" order by e.id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]LedgerEntry, 0)
+	for rows.Next() {
+		e := LedgerEntry{}
+		err = rows.Scan(
+			&e.ID,
+			&e.PostingID,
+			&e.TransactionID,
+			&e.PayoutID,
+			&e.MerchantID,
+			&e.Event,
+			&e.Account,
+			&e.Currency,
+			&e.Direction,
+			&e.Amount,
+			&e.Created_at,
+		)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// ledgerFilter parses query parameters shared by ledger endpoints
+func ledgerFilter(r *http.Request) (LedgerFilter, error) {
+	query := r.URL.Query()
+	f := LedgerFilter{Currency: query.Get("currency")}
+	if val := query.Get("merchant_id"); val != "" {
+		merchantID, err := strconv.Atoi(val)
+		if err != nil {
+			return f, &StatusError{http.StatusBadRequest, fmt.Errorf("error: 'merchant_id' is NaN")}
+		}
+		f.MerchantID = &merchantID
+	}
+	if val := query.Get("transaction_id"); val != "" {
+		id, err := strconv.Atoi(val)
+		if err != nil {
+			return f, &StatusError{http.StatusBadRequest, fmt.Errorf("error: 'transaction_id' is NaN")}
+		}
+		f.TransactionID = id
+	}
+	return f, nil
+}
+
+// GetBalancesHandler..
+func GetBalancesHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		f, err := ledgerFilter(r)
+		if err != nil {
+			return err
+		}
+		balances, err := api.GetBalances(r.Context(), f)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(balances)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// GetLedgerEntriesHandler..
+func GetLedgerEntriesHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		f, err := ledgerFilter(r)
+		if err != nil {
+			return err
+		}
+		page, err := pageParam(r.URL.Query().Get("page"))
+		if err != nil {
+			return err
+		}
+		entries, err := api.GetLedgerEntries(r.Context(), f)
+		if err != nil {
+			return err
+		}
+		start, end := Paginate(page, 10, len(entries))
+		data, _ := json.Marshal(entries[start:end])
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
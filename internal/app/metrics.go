@@ -0,0 +1,264 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latency buckets of API requests, in seconds
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Webhook delivery results. Failed attempt is retried, dropped event isn't.
+const (
+	webhookDelivered = "delivered"
+	webhookRetried   = "retried"
+	webhookDropped   = "dropped"
+)
+
+var (
+	httpRequests = newCounterVec(
+		"paymulator_http_requests_total",
+		"API requests by route and status code.",
+		"method", "route", "code",
+	)
+	httpDuration = newHistogramVec(
+		"paymulator_http_request_duration_seconds",
+		"API request latency by route and status code.",
+		latencyBuckets,
+		"method", "route", "code",
+	)
+	rateLimited = newCounterVec(
+		"paymulator_rate_limited_requests_total",
+		"Requests rejected by rate limiter.",
+		"method", "route",
+	)
+	transactionsCreated = newCounterVec(
+		"paymulator_transactions_created_total",
+		"Transactions created by initial status and currency.",
+		"status", "currency",
+	)
+	statusTransitions = newCounterVec(
+		"paymulator_transaction_status_transitions_total",
+		"Transaction status changes.",
+		"from", "to",
+	)
+	webhookDeliveries = newCounterVec(
+		"paymulator_webhook_deliveries_total",
+		"Webhook delivery attempts by event type and result.",
+		"event", "result",
+	)
+)
+
+// counterVec is a Prometheus counter partitioned by label values
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labels []string
+	value  float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]*counterSeries)}
+}
+
+// Inc adds one to the counter of label values, given in order of label names
+func (c *counterVec) Inc(values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := strings.Join(values, "\xff")
+	s := c.values[key]
+	if s == nil {
+		s = &counterSeries{labels: values}
+		c.values[key] = s
+	}
+	s.value++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelPairs(c.labels, s.labels, "", ""), formatFloat(s.value))
+	}
+}
+
+// histogramVec is a Prometheus histogram partitioned by label values
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	// counts[i] is number of observations in bucket i, not cumulative
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+// Observe adds value to the histogram of label values
+func (h *histogramVec) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(values, "\xff")
+	s := h.series[key]
+	if s == nil {
+		s = &histogramSeries{labels: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, s.labels, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelPairs(h.labels, s.labels, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, s.labels, "", ""), s.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelPairs formats labels as {name="value",...}, extra label is added when named
+func labelPairs(names, values []string, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writePoolStats exposes database connection pool, read at scrape time
+func writePoolStats(w io.Writer, st *PoolStats) {
+	if st == nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP paymulator_db_pool_connections Database connections by state.\n# TYPE paymulator_db_pool_connections gauge\n")
+	fmt.Fprintf(w, "paymulator_db_pool_connections{state=\"acquired\"} %d\n", st.AcquiredConns)
+	fmt.Fprintf(w, "paymulator_db_pool_connections{state=\"idle\"} %d\n", st.IdleConns)
+	fmt.Fprintf(w, "paymulator_db_pool_connections{state=\"constructing\"} %d\n", st.ConstructingConns)
+	for _, m := range []struct {
+		name, help, kind string
+		value            float64
+	}{
+		{"paymulator_db_pool_total_connections", "Database connections open.", "gauge", float64(st.TotalConns)},
+		{"paymulator_db_pool_max_connections", "Maximum size of database pool.", "gauge", float64(st.MaxConns)},
+		{"paymulator_db_pool_acquires_total", "Connections acquired from database pool.", "counter", float64(st.AcquireCount)},
+		{"paymulator_db_pool_empty_acquires_total", "Acquires that waited for a connection.", "counter", float64(st.EmptyAcquireCount)},
+		{"paymulator_db_pool_canceled_acquires_total", "Acquires canceled while waiting.", "counter", float64(st.CanceledAcquireCount)},
+		{"paymulator_db_pool_acquire_duration_seconds_total", "Time spent acquiring connections.", "counter", st.AcquireDuration.Seconds()},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", m.name, m.help, m.name, m.kind, m.name, formatFloat(m.value))
+	}
+}
+
+// writeMetrics writes all metrics in Prometheus text format
+func writeMetrics(w io.Writer, pool *PoolStats) {
+	httpRequests.write(w)
+	httpDuration.write(w)
+	rateLimited.write(w)
+	writePoolStats(w, pool)
+	transactionsCreated.write(w)
+	statusTransitions.write(w)
+	webhookDeliveries.write(w)
+}
+
+// instrumenting counts API requests and observes their latency by route template,
+// so ids in paths don't make a series each
+func instrumenting(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := routeTemplate(r)
+		sw := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			code := strconv.Itoa(sw.status)
+			switch {
+			case p != nil:
+				code = "aborted"
+			case sw.status == 0:
+				code = strconv.Itoa(http.StatusOK)
+			}
+			httpRequests.Inc(r.Method, route, code)
+			httpDuration.Observe(time.Since(start).Seconds(), r.Method, route, code)
+			if p != nil {
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// MetricsHandler..
+func MetricsHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		rw.Header().Set("content-type", "text/plain; version=0.0.4; charset=utf-8")
+		rw.WriteHeader(http.StatusOK)
+		writeMetrics(rw, api.PoolStats())
+		return nil
+	}
+}
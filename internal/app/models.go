@@ -1,10 +1,14 @@
 package app
 
-import "time"
+import (
+	"net/http"
+	"time"
+)
 
-//Transaction defines a structure for an item in transaction list
+// Transaction defines a structure for an item in transaction list
 type Transaction struct {
 	ID         int       `json:"id,omitempty"`
+	CustomerID int       `json:"customer_id,omitempty"`
 	UserID     int       `json:"user_id,omitempty"`
 	Email      string    `json:"email,omitempty"`
 	Amount     float64   `json:"amount,omitempty"`
@@ -12,4 +16,347 @@ type Transaction struct {
 	Created_at time.Time `json:"created_at,omitempty"`
 	Changed_at time.Time `json:"changed_at,omitempty"`
 	Status     string    `json:"transaction_status,omitempty"`
+	MerchantID int       `json:"merchant_id,omitempty"`
+	Fee        *float64  `json:"fee,omitempty"`
+	NetAmount  *float64  `json:"net_amount,omitempty"`
+
+	PaymentMethodID   int    `json:"payment_method_id,omitempty"`
+	PaymentMethodType string `json:"payment_method_type,omitempty"`
+	DeclineCode       string `json:"decline_code,omitempty"`
+
+	// Client is redirected here after 3-D Secure challenge
+	ReturnURL      string      `json:"return_url,omitempty"`
+	NextAction     *NextAction `json:"next_action,omitempty"`
+	ChallengeToken string      `json:"-"`
+
+	// Vault token paying instead of payment_method_id, never stored
+	CardToken string `json:"card_token,omitempty"`
+
+	// Name of scenario scripting transaction lifecycle, kept in its run
+	Scenario string `json:"scenario,omitempty"`
+
+	// Merchant's own data, like order ids, reference is unique per merchant
+	Metadata          map[string]string `json:"metadata,omitempty"`
+	MerchantReference string            `json:"merchant_reference,omitempty"`
+}
+
+// Customer is a payer, transactions keep its user_id and email
+// at the time they were made
+type Customer struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	Email      string    `json:"email"`
+	Name       string    `json:"name,omitempty"`
+	Created_at time.Time `json:"created_at"`
+	Changed_at time.Time `json:"changed_at"`
+}
+
+// CustomerUpdate changes contact details of a customer, nil fields are kept
+type CustomerUpdate struct {
+	Email *string `json:"email"`
+	Name  *string `json:"name"`
+}
+
+// PoolStats is a snapshot of database connection pool
+type PoolStats struct {
+	AcquiredConns        int32
+	IdleConns            int32
+	ConstructingConns    int32
+	TotalConns           int32
+	MaxConns             int32
+	AcquireCount         int64
+	EmptyAcquireCount    int64
+	CanceledAcquireCount int64
+	AcquireDuration      time.Duration
+}
+
+// TransactionUpdate changes merchant's data of a transaction. Metadata is merged,
+// keys with empty values are removed; nil reference is kept, empty one is cleared.
+type TransactionUpdate struct {
+	Metadata          map[string]string `json:"metadata"`
+	MerchantReference *string           `json:"merchant_reference"`
+}
+
+// FeeSchedule is a merchant pricing rule. Empty currency or payment method
+// matches any, the most specific matching schedule is applied.
+type FeeSchedule struct {
+	ID            int       `json:"id,omitempty"`
+	MerchantID    int       `json:"merchant_id"`
+	Currency      string    `json:"currency,omitempty"`
+	PaymentMethod string    `json:"payment_method,omitempty"`
+	Percent       float64   `json:"percent"`
+	Fixed         float64   `json:"fixed"`
+	MinFee        float64   `json:"min_fee"`
+	MaxFee        *float64  `json:"max_fee,omitempty"`
+	Created_at    time.Time `json:"created_at,omitempty"`
+}
+
+// Settlement is a batch of transactions of one merchant and currency
+// that reached a final status during one business day
+type Settlement struct {
+	ID              int     `json:"id"`
+	MerchantID      int     `json:"merchant_id"`
+	Currency        string  `json:"currency"`
+	BusinessDate    string  `json:"business_date"`
+	SuccessCount    int     `json:"success_count"`
+	SuccessAmount   float64 `json:"success_amount"`
+	FailedCount     int     `json:"failed_count"`
+	FailedAmount    float64 `json:"failed_amount"`
+	CancelledCount  int     `json:"cancelled_count"`
+	CancelledAmount float64 `json:"cancelled_amount"`
+	RefundedCount   int     `json:"refunded_count"`
+	RefundedAmount  float64 `json:"refunded_amount"`
+	// Fees of successful transactions less fees reversed by refunds
+	FeeAmount float64 `json:"fee_amount"`
+	// Amount due to merchant: successful less refunded amounts and fees
+	NetAmount  float64   `json:"net_amount"`
+	Created_at time.Time `json:"created_at"`
+}
+
+// SettlementLine is a transaction, or a refund of it, included into settlement.
+// Fee and net amount of a refund are negative.
+type SettlementLine struct {
+	ID            int     `json:"id"`
+	SettlementID  int     `json:"settlement_id"`
+	Type          string  `json:"type"`
+	TransactionID int     `json:"transaction_id"`
+	DisputeID     int     `json:"dispute_id,omitempty"`
+	Status        string  `json:"transaction_status"`
+	Amount        float64 `json:"amount"`
+	Fee           float64 `json:"fee"`
+	NetAmount     float64 `json:"net_amount"`
+}
+
+// LedgerEntry is one side of a balanced ledger posting
+type LedgerEntry struct {
+	ID            int       `json:"id"`
+	PostingID     int       `json:"posting_id"`
+	TransactionID int       `json:"transaction_id,omitempty"`
+	PayoutID      int       `json:"payout_id,omitempty"`
+	MerchantID    int       `json:"merchant_id"`
+	Event         string    `json:"event"`
+	Account       string    `json:"account"`
+	Currency      string    `json:"currency"`
+	Direction     string    `json:"direction"`
+	Amount        float64   `json:"amount"`
+	Created_at    time.Time `json:"created_at"`
+}
+
+// Balance of a ledger account in one currency
+type Balance struct {
+	Account  string  `json:"account"`
+	Currency string  `json:"currency"`
+	Balance  float64 `json:"balance"`
+}
+
+// Payout moves merchant available balance to a simulated bank account
+type Payout struct {
+	ID            int       `json:"id,omitempty"`
+	MerchantID    int       `json:"merchant_id"`
+	Currency      string    `json:"currency"`
+	Amount        float64   `json:"amount"`
+	BankAccount   string    `json:"bank_account,omitempty"`
+	Status        string    `json:"status,omitempty"`
+	FailureReason string    `json:"failure_reason,omitempty"`
+	Created_at    time.Time `json:"created_at,omitempty"`
+	Changed_at    time.Time `json:"changed_at,omitempty"`
+}
+
+// Dispute is a chargeback opened on a successful transaction
+type Dispute struct {
+	ID            int       `json:"id"`
+	TransactionID int       `json:"transaction_id"`
+	MerchantID    int       `json:"merchant_id"`
+	Amount        float64   `json:"amount"`
+	Currency      string    `json:"currency"`
+	ReasonCode    string    `json:"reason_code"`
+	Status        string    `json:"status"`
+	Evidence      string    `json:"evidence,omitempty"`
+	EvidenceDueBy time.Time `json:"evidence_due_by"`
+	Created_at    time.Time `json:"created_at"`
+	Changed_at    time.Time `json:"changed_at"`
+}
+
+// Plan is a recurring price customers subscribe to
+type Plan struct {
+	ID            int       `json:"id,omitempty"`
+	Name          string    `json:"name"`
+	MerchantID    int       `json:"merchant_id"`
+	Amount        float64   `json:"amount"`
+	Currency      string    `json:"currency"`
+	Interval      string    `json:"interval"`
+	IntervalCount int       `json:"interval_count"`
+	TrialDays     int       `json:"trial_days"`
+	Created_at    time.Time `json:"created_at,omitempty"`
+}
+
+// Subscription bills its plan every period by creating a transaction
+type Subscription struct {
+	ID                 int        `json:"id,omitempty"`
+	PlanID             int        `json:"plan_id"`
+	UserID             int        `json:"user_id"`
+	Email              string     `json:"email"`
+	PaymentMethodID    int        `json:"payment_method_id,omitempty"`
+	Status             string     `json:"status,omitempty"`
+	CurrentPeriodStart time.Time  `json:"current_period_start"`
+	CurrentPeriodEnd   time.Time  `json:"current_period_end"`
+	NextBillingAt      *time.Time `json:"next_billing_at,omitempty"`
+	CancelAtPeriodEnd  bool       `json:"cancel_at_period_end"`
+	CanceledAt         *time.Time `json:"canceled_at,omitempty"`
+	FailedAttempts     int        `json:"failed_attempts"`
+	ProrationBalance   float64    `json:"proration_balance"`
+	Created_at         time.Time  `json:"created_at,omitempty"`
+}
+
+// SubscriptionCharge is a renewal attempt of a subscription period
+type SubscriptionCharge struct {
+	ID             int       `json:"id"`
+	SubscriptionID int       `json:"subscription_id"`
+	TransactionID  int       `json:"transaction_id,omitempty"`
+	Amount         float64   `json:"amount"`
+	PeriodStart    time.Time `json:"period_start"`
+	PeriodEnd      time.Time `json:"period_end"`
+	Status         string    `json:"status"`
+	DeclineCode    string    `json:"decline_code,omitempty"`
+	Created_at     time.Time `json:"created_at"`
+}
+
+// JobsReport lists what scheduled jobs did in one run
+type JobsReport struct {
+	Settlements         []Settlement         `json:"settlements"`
+	Payouts             []Payout             `json:"payouts"`
+	Disputes            []Dispute            `json:"disputes"`
+	SubscriptionCharges []SubscriptionCharge `json:"subscription_charges"`
+	ScenarioSteps       []ScenarioStepResult `json:"scenario_steps"`
+}
+
+// Scenario scripts lifecycle of transactions it's attached to
+type Scenario struct {
+	Name        string         `json:"name" yaml:"name"`
+	Description string         `json:"description,omitempty" yaml:"description"`
+	Steps       []ScenarioStep `json:"steps" yaml:"steps"`
+	Created_at  time.Time      `json:"created_at,omitempty" yaml:"-"`
+}
+
+// ScenarioStep does one action after delay since the previous step was due
+type ScenarioStep struct {
+	After          string `json:"after,omitempty" yaml:"after"`
+	Status         string `json:"status,omitempty" yaml:"status"`
+	Dispute        string `json:"dispute,omitempty" yaml:"dispute"`
+	ResolveDispute string `json:"resolve_dispute,omitempty" yaml:"resolve_dispute"`
+}
+
+// ScenarioRun is progress of scenario attached to a transaction
+type ScenarioRun struct {
+	TransactionID int                  `json:"transaction_id"`
+	Scenario      string               `json:"scenario"`
+	Status        string               `json:"status"`
+	Steps         []ScenarioStep       `json:"steps"`
+	NextStep      int                  `json:"next_step"`
+	NextAt        *time.Time           `json:"next_at,omitempty"`
+	Results       []ScenarioStepResult `json:"results"`
+	Created_at    time.Time            `json:"created_at"`
+	Changed_at    time.Time            `json:"changed_at"`
+}
+
+// ScenarioStepResult is outcome of a done scenario step
+type ScenarioStepResult struct {
+	TransactionID int       `json:"transaction_id"`
+	Step          int       `json:"step"`
+	Action        string    `json:"action"`
+	DoneAt        time.Time `json:"done_at"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// CardData is raw card data, kept only encrypted in the vault
+type CardData struct {
+	Number     string `json:"number"`
+	ExpMonth   int    `json:"exp_month"`
+	ExpYear    int    `json:"exp_year"`
+	HolderName string `json:"holder_name,omitempty"`
+}
+
+// CardToken is an opaque reference to card data stored in the vault
+type CardToken struct {
+	Token      string      `json:"token"`
+	Card       CardDetails `json:"card"`
+	Created_at time.Time   `json:"created_at"`
+}
+
+// PaymentMethod is a stored tokenized payment method, raw card
+// and account numbers are not kept
+type PaymentMethod struct {
+	ID           int                  `json:"id"`
+	CustomerID   int                  `json:"customer_id,omitempty"`
+	Type         string               `json:"type"`
+	Card         *CardDetails         `json:"card,omitempty"`
+	Wallet       *WalletDetails       `json:"wallet,omitempty"`
+	BankTransfer *BankTransferDetails `json:"bank_transfer,omitempty"`
+	Created_at   time.Time            `json:"created_at"`
+
+	// outcome of authorization for test cards
+	outcome string
+}
+
+type CardDetails struct {
+	Brand       string `json:"brand"`
+	Last4       string `json:"last4"`
+	ExpMonth    int    `json:"exp_month"`
+	ExpYear     int    `json:"exp_year"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type WalletDetails struct {
+	Provider string `json:"provider"`
+}
+
+type BankTransferDetails struct {
+	Last4       string `json:"last4"`
+	BankCode    string `json:"bank_code"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// ProxiedRequest is a request forwarded to the provider, as kept in cassette.
+// Binary body is base64 with body_encoding set.
+type ProxiedRequest struct {
+	Method       string      `json:"method"`
+	Path         string      `json:"path"`
+	Query        string      `json:"query,omitempty"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"body_encoding,omitempty"`
+}
+
+// ProxiedResponse is a response of the provider, as kept in cassette
+type ProxiedResponse struct {
+	Status       int         `json:"status"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"body_encoding,omitempty"`
+}
+
+// Interaction is a recorded request/response pair of the provider
+type Interaction struct {
+	Request     ProxiedRequest  `json:"request"`
+	Response    ProxiedResponse `json:"response"`
+	Recorded_at time.Time       `json:"recorded_at"`
+}
+
+// JournalEntry is an API call as seen by the service, secrets are redacted
+type JournalEntry struct {
+	ID             int         `json:"id"`
+	RequestID      string      `json:"request_id"`
+	Method         string      `json:"method"`
+	Path           string      `json:"path"`
+	Route          string      `json:"route"`
+	Query          string      `json:"query,omitempty"`
+	MerchantID     *int        `json:"merchant_id,omitempty"`
+	RequestHeader  http.Header `json:"request_header"`
+	RequestBody    string      `json:"request_body,omitempty"`
+	Status         int         `json:"status"`
+	ResponseHeader http.Header `json:"response_header"`
+	ResponseBody   string      `json:"response_body,omitempty"`
+	LatencyMs      float64     `json:"latency_ms"`
+	Error          string      `json:"error,omitempty"`
+	Created_at     time.Time   `json:"created_at"`
 }
@@ -0,0 +1,412 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+// Payment method types
+const (
+	methodCard         = "card"
+	methodWallet       = "wallet"
+	methodBankTransfer = "bank_transfer"
+)
+
+// Card outcomes beside decline codes
+const (
+	outcomeApproved = "approved"
+	outcomeRandom   = ""
+)
+
+// Decline codes
+const (
+	declineCardDeclined      = "card_declined"
+	declineInsufficientFunds = "insufficient_funds"
+	declineExpiredCard       = "expired_card"
+	declineIncorrectCVC      = "incorrect_cvc"
+)
+
+// testCards are documented card numbers with a fixed outcome,
+// other valid numbers are approved or declined randomly
+var testCards = map[string]string{
+	"4242424242424242": outcomeApproved,
+	"5555555555554444": outcomeApproved,
+	"378282246310005":  outcomeApproved,
+	"2200000000000004": outcomeApproved,
+	"4000000000000002": declineCardDeclined,
+	"4000000000009995": declineInsufficientFunds,
+	"4000000000000069": declineExpiredCard,
+	"4000000000000127": declineIncorrectCVC,
+	"4000002500003155": outcomeRequiresAction,
+	"4000000000003220": outcomeRequiresAction,
+}
+
+var walletProviders = []string{"apple_pay", "google_pay", "paypal"}
+
+// PaymentMethodRequest carries raw payment details, they are never stored
+type PaymentMethodRequest struct {
+	Type string `json:"type"`
+	Card *struct {
+		Number   string `json:"number"`
+		ExpMonth int    `json:"exp_month"`
+		ExpYear  int    `json:"exp_year"`
+		CVC      string `json:"cvc"`
+	} `json:"card,omitempty"`
+	Wallet *struct {
+		Provider string `json:"provider"`
+	} `json:"wallet,omitempty"`
+	BankTransfer *struct {
+		AccountNumber string `json:"account_number"`
+		BankCode      string `json:"bank_code"`
+	} `json:"bank_transfer,omitempty"`
+}
+
+// luhnValid checks card number checksum
+func luhnValid(number string) bool {
+	if len(number) < 12 || len(number) > 19 {
+		return false
+	}
+	sum := 0
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if d < 0 || d > 9 {
+			return false
+		}
+		if (len(number)-i)%2 == 0 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// cardBrand detects brand by number prefix
+func cardBrand(number string) string {
+	prefix := func(n int) int {
+		if len(number) < n {
+			return 0
+		}
+		p, _ := strconv.Atoi(number[:n])
+		return p
+	}
+	switch p2, p4 := prefix(2), prefix(4); {
+	case number[0] == '4':
+		return "visa"
+	case p2 >= 51 && p2 <= 55 || p4 >= 2221 && p4 <= 2720:
+		return "mastercard"
+	case p4 >= 2200 && p4 <= 2204:
+		return "mir"
+	case p2 == 34 || p2 == 37:
+		return "amex"
+	case p4 == 6011 || p2 == 65 || prefix(3) >= 644 && prefix(3) <= 649:
+		return "discover"
+	case p4 >= 3528 && p4 <= 3589:
+		return "jcb"
+	case p2 == 62:
+		return "unionpay"
+	}
+	return "unknown"
+}
+
+// fingerprint identifies details without storing them
+func fingerprint(details string) string {
+	sum := sha256.Sum256([]byte(details))
+	return hex.EncodeToString(sum[:8])
+}
+
+func last4(s string) string {
+	if len(s) < 4 {
+		return s
+	}
+	return s[len(s)-4:]
+}
+
+// newCardDetails validates card number and expiry date
+func newCardDetails(number string, expMonth, expYear int, now time.Time) (*CardDetails, error) {
+	if !luhnValid(number) {
+		return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: card number is invalid")}
+	}
+	if expMonth < 1 || expMonth > 12 || expYear < 1000 || expYear > 9999 {
+		return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: exp_month should be 1..12 and exp_year four digits")}
+	}
+	if expYear < now.Year() || expYear == now.Year() && expMonth < int(now.Month()) {
+		return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: card is expired")}
+	}
+	return &CardDetails{
+		Brand:       cardBrand(number),
+		Last4:       last4(number),
+		ExpMonth:    expMonth,
+		ExpYear:     expYear,
+		Fingerprint: fingerprint(number),
+	}, nil
+}
+
+// newPaymentMethod validates request and turns it into a stored payment method
+func newPaymentMethod(req *PaymentMethodRequest, now time.Time) (*PaymentMethod, error) {
+	pm := &PaymentMethod{Type: req.Type}
+	switch req.Type {
+	case methodCard:
+		c := req.Card
+		if c == nil {
+			return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: card")}
+		}
+		number := strings.ReplaceAll(c.Number, " ", "")
+		card, err := newCardDetails(number, c.ExpMonth, c.ExpYear, now)
+		if err != nil {
+			return nil, err
+		}
+		cvcLen := 3
+		if card.Brand == "amex" {
+			cvcLen = 4
+		}
+		if _, err := strconv.Atoi(c.CVC); err != nil || len(c.CVC) != cvcLen {
+			return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: cvc should be %d digits", cvcLen)}
+		}
+		pm.Card = card
+		pm.outcome = testCards[number]
+	case methodWallet:
+		if req.Wallet == nil || !contains(walletProviders, req.Wallet.Provider) {
+			return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: wallet provider should be one of: %s", strings.Join(walletProviders, ","))}
+		}
+		pm.Wallet = &WalletDetails{Provider: req.Wallet.Provider}
+	case methodBankTransfer:
+		b := req.BankTransfer
+		if b == nil || b.AccountNumber == "" || b.BankCode == "" {
+			return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: bank_transfer.account_number, bank_transfer.bank_code")}
+		}
+		if len(b.AccountNumber) > 34 {
+			return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: maximum length of account_number is 34")}
+		}
+		pm.BankTransfer = &BankTransferDetails{
+			Last4:       last4(b.AccountNumber),
+			BankCode:    b.BankCode,
+			Fingerprint: fingerprint(b.BankCode + "/" + b.AccountNumber),
+		}
+	default:
+		return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: there is no payment method type like '%s'; available types: card,wallet,bank_transfer", req.Type)}
+	}
+	return pm, nil
+}
+
+func contains(values []string, v string) bool {
+	for _, val := range values {
+		if val == v {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizationResult decides status of a new transaction paid by pm,
+// transactions without payment method keep random outcome
+func authorizationResult(pm *PaymentMethod, now time.Time) (string, string) {
+	if pm == nil {
+		return randomStatus(), ""
+	}
+	outcome := pm.outcome
+	if pm.Card != nil && (pm.Card.ExpYear < now.Year() || pm.Card.ExpYear == now.Year() && pm.Card.ExpMonth < int(now.Month())) {
+		outcome = declineExpiredCard
+	}
+	switch outcome {
+	case outcomeApproved:
+		return "НОВЫЙ", ""
+	case outcomeRequiresAction:
+		return statusRequiresAction, ""
+	case outcomeRandom:
+		status := randomStatus()
+		if status == "ОШИБКА" {
+			return status, declineCardDeclined
+		}
+		return status, ""
+	}
+	return "ОШИБКА", outcome
+}
+
+// authorizeTransactions sets status and decline code of new transactions
+// according to their payment methods, and starts 3-D Secure challenges
+func authorizeTransactions(ctx context.Context, tx pgx.Tx, ts []*Transaction, publicURL string) error {
+	rand.Seed(time.Now().UTC().UnixNano())
+	ids := make([]int, 0)
+	for _, t := range ts {
+		if t.PaymentMethodID != 0 {
+			ids = append(ids, t.PaymentMethodID)
+		}
+	}
+	methods := make(map[int]*PaymentMethod)
+	if len(ids) > 0 {
+		rows, err := tx.Query(ctx, "select "+paymentMethodColumns+" from payment_methods where id = any($1)", ids)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			pm := new(PaymentMethod)
+			err = scanPaymentMethod(rows, pm)
+			if err != nil {
+				return err
+			}
+			methods[pm.ID] = pm
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	now := clock.Now()
+	for _, t := range ts {
+		var pm *PaymentMethod
+		t.PaymentMethodType = ""
+		if t.PaymentMethodID != 0 {
+			pm = methods[t.PaymentMethodID]
+			if pm == nil {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: payment method %d not found", t.PaymentMethodID)}
+			}
+			if pm.CustomerID != 0 && pm.CustomerID != t.CustomerID {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: payment method %d is saved by another customer", t.PaymentMethodID)}
+			}
+			t.PaymentMethodType = pm.Type
+		}
+		t.Status, t.DeclineCode = authorizationResult(pm, now)
+		t.ChallengeToken, t.NextAction = "", nil
+		if t.Status == statusRequiresAction {
+			t.ChallengeToken = newChallengeToken()
+			t.NextAction = nextAction(publicURL, t.ChallengeToken)
+		}
+	}
+	return nil
+}
+
+const paymentMethodColumns = `id, coalesce(customer_id, 0), type, brand, last4, exp_month, exp_year, fingerprint,
+	wallet_provider, bank_code, outcome, created_at`
+
+func scanPaymentMethod(row pgx.Row, pm *PaymentMethod) error {
+	var (
+		brand, l4, fp, provider, bankCode string
+		expMonth, expYear                 int
+	)
+	err := row.Scan(&pm.ID, &pm.CustomerID, &pm.Type, &brand, &l4, &expMonth, &expYear, &fp, &provider, &bankCode, &pm.outcome, &pm.Created_at)
+	if err != nil {
+		return err
+	}
+	switch pm.Type {
+	case methodCard:
+		pm.Card = &CardDetails{Brand: brand, Last4: l4, ExpMonth: expMonth, ExpYear: expYear, Fingerprint: fp}
+	case methodWallet:
+		pm.Wallet = &WalletDetails{Provider: provider}
+	case methodBankTransfer:
+		pm.BankTransfer = &BankTransferDetails{Last4: l4, BankCode: bankCode, Fingerprint: fp}
+	}
+	return nil
+}
+
+type queryRower interface {
+	QueryRow(context.Context, string, ...interface{}) pgx.Row
+}
+
+func (s *ApiServer) CreatePaymentMethod(ctx context.Context, pm *PaymentMethod) error {
+	return insertPaymentMethod(ctx, s.database, pm)
+}
+
+func insertPaymentMethod(ctx context.Context, q queryRower, pm *PaymentMethod) error {
+	var (
+		brand, l4, fp, provider, bankCode string
+		expMonth, expYear                 int
+	)
+	switch {
+	case pm.Card != nil:
+		brand, l4, fp, expMonth, expYear = pm.Card.Brand, pm.Card.Last4, pm.Card.Fingerprint, pm.Card.ExpMonth, pm.Card.ExpYear
+	case pm.Wallet != nil:
+		provider = pm.Wallet.Provider
+	case pm.BankTransfer != nil:
+		l4, bankCode, fp = pm.BankTransfer.Last4, pm.BankTransfer.BankCode, pm.BankTransfer.Fingerprint
+	}
+	return q.QueryRow(
+		ctx,
+		`insert into payment_methods (type, brand, last4, exp_month, exp_year, fingerprint, wallet_provider, bank_code, outcome, created_at, customer_id)
+		values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,nullif($11::int, 0)) returning id, created_at`,
+		pm.Type,
+		brand,
+		l4,
+		expMonth,
+		expYear,
+		fp,
+		provider,
+		bankCode,
+		pm.outcome,
+		clock.Now(),
+		pm.CustomerID,
+	).Scan(&pm.ID, &pm.Created_at)
+}
+
+func (s *ApiServer) GetPaymentMethod(ctx context.Context, id int) (*PaymentMethod, error) {
+	pm := new(PaymentMethod)
+	err := scanPaymentMethod(s.database.QueryRow(ctx, "select "+paymentMethodColumns+" from payment_methods where id=$1", id), pm)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: payment method not found")}
+		}
+		return nil, err
+	}
+	return pm, nil
+}
+
+// CreatePaymentMethodHandler..
+func CreatePaymentMethodHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		req := new(PaymentMethodRequest)
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err := decoder.Decode(req)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		pm, err := newPaymentMethod(req, clock.Now())
+		if err != nil {
+			return err
+		}
+
+		err = api.CreatePaymentMethod(r.Context(), pm)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(pm)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// GetPaymentMethodHandler..
+func GetPaymentMethodHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: id is NaN")}
+		}
+		pm, err := api.GetPaymentMethod(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(pm)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,423 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+// Payout statuses
+const (
+	payoutPending   = "pending"
+	payoutInTransit = "in_transit"
+	payoutPaid      = "paid"
+	payoutFailed    = "failed"
+)
+
+// Payouts make one lifecycle step per interval of the clock: pending -> in_transit -> paid/failed
+const payoutStepInterval = 10 * time.Second
+
+// bankAccount receives paid out funds. Unfinished payouts are held
+// on merchant payouts account.
+func bankAccount(merchantID int) string {
+	return fmt.Sprintf("bank:merchant:%d", merchantID)
+}
+
+// PayoutFilter narrows down payouts list. Zero values match everything.
+type PayoutFilter struct {
+	MerchantID *int
+	Status     string
+}
+
+// payoutRule decides outcome of matching payouts, configured by PAYOUT_RULES
+// environment variable as JSON array. Payouts matching no rule are paid.
+type payoutRule struct {
+	MerchantID    *int     `json:"merchant_id"`
+	BankAccount   string   `json:"bank_account"`
+	MinAmount     *float64 `json:"min_amount"`
+	Outcome       string   `json:"outcome"`
+	FailureReason string   `json:"failure_reason"`
+}
+
+func parsePayoutRules(s string) ([]payoutRule, error) {
+	rules := make([]payoutRule, 0)
+	if s == "" {
+		return rules, nil
+	}
+	err := json.Unmarshal([]byte(s), &rules)
+	if err != nil {
+		return nil, fmt.Errorf("error: can't parse PAYOUT_RULES: %s", err)
+	}
+	for i, r := range rules {
+		switch r.Outcome {
+		case payoutPaid:
+		case payoutFailed:
+			if r.FailureReason == "" {
+				rules[i].FailureReason = "declined"
+			}
+		default:
+			return nil, fmt.Errorf("error: PAYOUT_RULES: there is no outcome like '%s'; available outcomes: paid,failed", r.Outcome)
+		}
+	}
+	return rules, nil
+}
+
+// payoutOutcome returns final status and failure reason of p from the first matching rule
+func payoutOutcome(rules []payoutRule, p *Payout) (string, string) {
+	for _, r := range rules {
+		if r.MerchantID != nil && *r.MerchantID != p.MerchantID ||
+			r.BankAccount != "" && r.BankAccount != p.BankAccount ||
+			r.MinAmount != nil && p.Amount < *r.MinAmount {
+			continue
+		}
+		return r.Outcome, r.FailureReason
+	}
+	return payoutPaid, ""
+}
+
+// payoutTransfer builds a posting moving payout amount between accounts
+func payoutTransfer(p *Payout, event, from, to string) *posting {
+	return &posting{
+		payoutID:   p.ID,
+		merchantID: p.MerchantID,
+		currency:   p.Currency,
+		event:      event,
+		lines: []ledgerLine{
+			{from, debit, p.Amount},
+			{to, credit, p.Amount},
+		},
+	}
+}
+
+const payoutColumns = "id, merchant_id, currency, amount, bank_account, status, failure_reason, created_at, changed_at"
+
+func scanPayout(row pgx.Row, p *Payout) error {
+	return row.Scan(
+		&p.ID,
+		&p.MerchantID,
+		&p.Currency,
+		&p.Amount,
+		&p.BankAccount,
+		&p.Status,
+		&p.FailureReason,
+		&p.Created_at,
+		&p.Changed_at,
+	)
+}
+
+// CreatePayout withdraws p.Amount from merchant available balance, the whole
+// balance if amount isn't set
+func (s *ApiServer) CreatePayout(ctx context.Context, p *Payout) error {
+	tx, err := s.database.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Serializes payouts of a merchant so balance can't be withdrawn twice
+	_, err = tx.Exec(ctx, "select pg_advisory_xact_lock($1)", p.MerchantID)
+	if err != nil {
+		return err
+	}
+	var balance float64
+	err = tx.QueryRow(
+		ctx,
+		`select coalesce(sum(case when direction='credit' then amount else -amount end), 0)
+		from ledger_entries where account=$1 and currency=$2`,
+		merchantAccount(p.MerchantID, "available"),
+		p.Currency,
+	).Scan(&balance)
+	if err != nil {
+		return err
+	}
+	balance = roundCents(balance)
+	if p.Amount == 0 {
+		p.Amount = balance
+	}
+	if p.Amount <= 0 || p.Amount > balance {
+		return &StatusError{http.StatusConflict, fmt.Errorf("error: available balance is %v %s", balance, p.Currency)}
+	}
+
+	err = scanPayout(tx.QueryRow(
+		ctx,
+		"insert into payouts (merchant_id, currency, amount, bank_account, created_at, changed_at) values ($1,$2,$3,$4,$5,$5) returning "+payoutColumns,
+		p.MerchantID,
+		p.Currency,
+		p.Amount,
+		p.BankAccount,
+		clock.Now(),
+	), p)
+	if err != nil {
+		return err
+	}
+	err = postLedger(ctx, tx, payoutTransfer(p, "payout", merchantAccount(p.MerchantID, "available"), merchantAccount(p.MerchantID, "payouts")))
+	if err != nil {
+		return err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	s.webhooks.Send(ctx, "payout.created", p)
+	return nil
+}
+
+// PayoutBalances creates a payout of every positive merchant available balance
+func (s *ApiServer) PayoutBalances(ctx context.Context) ([]Payout, error) {
+	rows, err := s.database.Query(
+		ctx,
+		`select p.merchant_id, e.currency from ledger_entries e join ledger_postings p on p.id=e.posting_id
+		where e.account='merchant:' || p.merchant_id || ':available'
+		group by p.merchant_id, e.currency
+		having sum(case when e.direction='credit' then e.amount else -e.amount end) >= 0.01
+		order by p.merchant_id, e.currency`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	balances := make([]Payout, 0)
+	for rows.Next() {
+		p := Payout{}
+		err = rows.Scan(&p.MerchantID, &p.Currency)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		balances = append(balances, p)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	payouts := make([]Payout, 0, len(balances))
+	for i := range balances {
+		err = s.CreatePayout(ctx, &balances[i])
+		if err != nil {
+			return payouts, err
+		}
+		payouts = append(payouts, balances[i])
+	}
+	return payouts, nil
+}
+
+// AdvancePayouts moves every unfinished payout which stayed in its status
+// for a step interval one step further, final status is decided by payout rules
+func (s *ApiServer) AdvancePayouts(ctx context.Context) ([]Payout, error) {
+	tx, err := s.database.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := clock.Now()
+	rows, err := tx.Query(
+		ctx,
+		`select `+payoutColumns+` from payouts where status in ('pending', 'in_transit') and changed_at<=$1
+		order by id for update skip locked`,
+		now.Add(-payoutStepInterval),
+	)
+	if err != nil {
+		return nil, err
+	}
+	payouts := make([]Payout, 0)
+	for rows.Next() {
+		p := Payout{}
+		err = scanPayout(rows, &p)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		payouts = append(payouts, p)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range payouts {
+		p := &payouts[i]
+		var pst *posting
+		if p.Status == payoutPending {
+			p.Status = payoutInTransit
+		} else {
+			p.Status, p.FailureReason = payoutOutcome(s.payoutRules, p)
+			if p.Status == payoutPaid {
+				pst = payoutTransfer(p, "payout_paid", merchantAccount(p.MerchantID, "payouts"), bankAccount(p.MerchantID))
+			} else {
+				pst = payoutTransfer(p, "payout_failed", merchantAccount(p.MerchantID, "payouts"), merchantAccount(p.MerchantID, "available"))
+			}
+		}
+		err = tx.QueryRow(
+			ctx,
+			"update payouts set status=$1, failure_reason=$2, changed_at=$3 where id=$4 returning changed_at",
+			p.Status,
+			p.FailureReason,
+			now,
+			p.ID,
+		).Scan(&p.Changed_at)
+		if err != nil {
+			return nil, err
+		}
+		err = postLedger(ctx, tx, pst)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range payouts {
+		s.webhooks.Send(ctx, "payout."+payouts[i].Status, payouts[i])
+	}
+	return payouts, nil
+}
+
+func (s *ApiServer) GetPayout(ctx context.Context, id int) (*Payout, error) {
+	p := new(Payout)
+	err := scanPayout(s.database.QueryRow(ctx, "select "+payoutColumns+" from payouts where id=$1", id), p)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: payout not found")}
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *ApiServer) GetPayouts(ctx context.Context, f PayoutFilter) ([]Payout, error) {
+	q := "select " + payoutColumns + " from payouts where true"
+	args := make([]interface{}, 0, 2)
+	if f.MerchantID != nil {
+		args = append(args, *f.MerchantID)
+		q += fmt.Sprintf(" and merchant_id=$%d", len(args))
+	}
+	if f.Status != "" {
+		args = append(args, f.Status)
+		q += fmt.Sprintf(" and status=$%d", len(args))
+	}
+	rows, err := s.database.Query(ctx, q+" order by id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payouts := make([]Payout, 0)
+	for rows.Next() {
+		p := Payout{}
+		err = scanPayout(rows, &p)
+		if err != nil {
+			return nil, err
+		}
+		payouts = append(payouts, p)
+	}
+	return payouts, rows.Err()
+}
+
+func validatePayout(p *Payout) error {
+	switch {
+	case p.Currency == "":
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: currency")}
+	case p.MerchantID < 0:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: merchant_id can't be negative")}
+	case p.Amount < 0:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: amount can't be negative")}
+	case len(p.BankAccount) > 34:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: maximum length of bank_account is 34")}
+	}
+	return nil
+}
+
+// CreatePayoutHandler..
+func CreatePayoutHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		p := new(Payout)
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err := decoder.Decode(p)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		p.ID, p.Status, p.FailureReason = 0, "", ""
+		err = validatePayout(p)
+		if err != nil {
+			return err
+		}
+
+		err = api.CreatePayout(r.Context(), p)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(p)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// GetPayoutsHandler..
+func GetPayoutsHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		query := r.URL.Query()
+		filter := PayoutFilter{Status: query.Get("status")}
+		if val := query.Get("merchant_id"); val != "" {
+			merchantID, err := strconv.Atoi(val)
+			if err != nil {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: 'merchant_id' is NaN")}
+			}
+			filter.MerchantID = &merchantID
+		}
+		switch filter.Status {
+		case "", payoutPending, payoutInTransit, payoutPaid, payoutFailed:
+		default:
+			return &StatusError{
+				http.StatusBadRequest,
+				fmt.Errorf("error: there is no status like '%s'; available statuses: pending,in_transit,paid,failed", filter.Status),
+			}
+		}
+		page, err := pageParam(query.Get("page"))
+		if err != nil {
+			return err
+		}
+
+		payouts, err := api.GetPayouts(r.Context(), filter)
+		if err != nil {
+			return err
+		}
+		start, end := Paginate(page, 10, len(payouts))
+		data, _ := json.Marshal(payouts[start:end])
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// GetPayoutHandler..
+func GetPayoutHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: id is NaN")}
+		}
+
+		p, err := api.GetPayout(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(p)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
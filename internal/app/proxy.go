@@ -0,0 +1,322 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Proxy modes
+const (
+	proxyRecord = "record"
+	proxyReplay = "replay"
+)
+
+// Requests under this prefix are proxied to the provider
+const proxyPrefix = "/proxy"
+
+// Interactions are matched by these request fields unless PROXY_MATCH is set
+const defaultProxyMatch = "method,path,query,body"
+
+// Headers kept out of cassettes, so provider credentials aren't written to disk
+var redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"}
+
+// Headers of a single connection, not forwarded
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length"}
+
+// cassette records provider interactions into JSONL file, or replays them.
+// Recordings with the same key are replayed in order, the last one repeats.
+type cassette struct {
+	mode   string
+	target *url.URL
+	match  []string
+	client *http.Client
+
+	mu           sync.Mutex
+	file         *os.File
+	interactions map[string][]Interaction
+	played       map[string]int
+}
+
+// newCassette is configured by PROXY_MODE, PROXY_TARGET, PROXY_CASSETTE and PROXY_MATCH,
+// proxy is disabled if mode is empty
+func newCassette(mode, target, path, match string) (*cassette, error) {
+	if mode == "" {
+		return nil, nil
+	}
+	if path == "" {
+		path = "cassette.jsonl"
+	}
+	if match == "" {
+		match = defaultProxyMatch
+	}
+	c := &cassette{mode: mode, client: &http.Client{Timeout: 30 * time.Second}}
+	for _, field := range strings.Split(match, ",") {
+		field = strings.TrimSpace(field)
+		switch {
+		case field == "method", field == "path", field == "query", field == "body":
+		case strings.HasPrefix(field, "header:") && len(field) > len("header:"):
+		case strings.HasPrefix(field, "json:") && len(field) > len("json:"):
+		default:
+			return nil, fmt.Errorf("error: PROXY_MATCH: there is no field like '%s'; available fields: method,path,query,body,header:<name>,json:<field>", field)
+		}
+		c.match = append(c.match, field)
+	}
+
+	var err error
+	switch mode {
+	case proxyRecord:
+		c.target, err = url.Parse(target)
+		if err != nil || c.target.Scheme == "" || c.target.Host == "" {
+			return nil, fmt.Errorf("error: PROXY_TARGET should be an absolute URL of the provider")
+		}
+		c.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, err
+		}
+	case proxyReplay:
+		err = c.load(path)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("error: there is no proxy mode like '%s'; available modes: record,replay", mode)
+	}
+	return c, nil
+}
+
+// load reads interactions recorded earlier
+func (c *cassette) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	c.interactions = make(map[string][]Interaction)
+	c.played = make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var in Interaction
+		err = json.Unmarshal(scanner.Bytes(), &in)
+		if err != nil {
+			return fmt.Errorf("error: cassette %s, line %d: %s", path, line, err)
+		}
+		key, err := c.key(&in.Request)
+		if err != nil {
+			return fmt.Errorf("error: cassette %s, line %d: %s", path, line, err)
+		}
+		c.interactions[key] = append(c.interactions[key], in)
+	}
+	return scanner.Err()
+}
+
+// key is made of request fields interactions are matched by
+func (c *cassette) key(r *ProxiedRequest) (string, error) {
+	body, err := decodeBody(r.Body, r.BodyEncoding)
+	if err != nil {
+		return "", err
+	}
+	var fields map[string]json.RawMessage
+	parts := make([]string, 0, len(c.match))
+	for _, field := range c.match {
+		var val string
+		switch {
+		case field == "method":
+			val = r.Method
+		case field == "path":
+			val = r.Path
+		case field == "query":
+			q, _ := url.ParseQuery(r.Query)
+			val = q.Encode()
+		case field == "body":
+			val = string(body)
+		case strings.HasPrefix(field, "header:"):
+			val = r.Header.Get(strings.TrimPrefix(field, "header:"))
+		case strings.HasPrefix(field, "json:"):
+			if fields == nil {
+				fields = make(map[string]json.RawMessage)
+				json.Unmarshal(body, &fields)
+			}
+			var buf bytes.Buffer
+			if raw, ok := fields[strings.TrimPrefix(field, "json:")]; ok && json.Compact(&buf, raw) == nil {
+				val = buf.String()
+			}
+		}
+		parts = append(parts, field+"="+val)
+	}
+	return strings.Join(parts, "\n"), nil
+}
+
+// Do answers proxied request, by the provider or from the cassette
+func (c *cassette) Do(ctx context.Context, r *ProxiedRequest) (*ProxiedResponse, error) {
+	if c.mode == proxyReplay {
+		return c.replay(r)
+	}
+	return c.record(ctx, r)
+}
+
+func (c *cassette) replay(r *ProxiedRequest) (*ProxiedResponse, error) {
+	key, err := c.key(r)
+	if err != nil {
+		return nil, &StatusError{http.StatusBadRequest, err}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	recorded := c.interactions[key]
+	if len(recorded) == 0 {
+		return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: no recorded interaction matches %s %s", r.Method, r.Path)}
+	}
+	i := c.played[key]
+	if i < len(recorded)-1 {
+		c.played[key]++
+	}
+	resp := recorded[i].Response
+	return &resp, nil
+}
+
+func (c *cassette) record(ctx context.Context, r *ProxiedRequest) (*ProxiedResponse, error) {
+	body, err := decodeBody(r.Body, r.BodyEncoding)
+	if err != nil {
+		return nil, &StatusError{http.StatusBadRequest, err}
+	}
+	u := *c.target
+	u.Path = strings.TrimSuffix(u.Path, "/") + r.Path
+	u.RawQuery = r.Query
+	ctx, s := startSpan(ctx, "proxy "+r.Method, spanClient)
+	defer s.End()
+	s.SetAttribute("http.method", r.Method)
+	s.SetAttribute("http.url", u.String())
+	req, err := http.NewRequestWithContext(ctx, r.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, &StatusError{http.StatusBadRequest, err}
+	}
+	req.Header = r.Header.Clone()
+	removeHeaders(req.Header, hopHeaders)
+	// Provider continues our trace rather than the caller's
+	injectTrace(ctx, req.Header)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		s.SetError(err)
+		return nil, &StatusError{http.StatusBadGateway, fmt.Errorf("error: provider is unavailable - %s", err)}
+	}
+	s.SetAttribute("http.status_code", resp.StatusCode)
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &StatusError{http.StatusBadGateway, fmt.Errorf("error: provider response is broken - %s", err)}
+	}
+	pr := &ProxiedResponse{Status: resp.StatusCode, Header: resp.Header.Clone()}
+	removeHeaders(pr.Header, hopHeaders)
+	pr.Body, pr.BodyEncoding = encodeBody(respBody)
+
+	in := Interaction{Request: *r, Response: *pr, Recorded_at: clock.Now()}
+	in.Request.Header = r.Header.Clone()
+	in.Response.Header = pr.Header.Clone()
+	removeHeaders(in.Request.Header, redactedHeaders)
+	removeHeaders(in.Response.Header, redactedHeaders)
+	line, _ := json.Marshal(in)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.file.Write(append(line, '\n'))
+	if err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+func removeHeaders(h http.Header, names []string) {
+	for _, name := range names {
+		h.Del(name)
+	}
+}
+
+// encodeBody keeps text bodies readable in cassette, binary ones are base64
+func encodeBody(b []byte) (string, string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+func decodeBody(s, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(s), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return nil, fmt.Errorf("error: there is no body encoding like '%s'", encoding)
+}
+
+func (s *ApiServer) checkProxy() error {
+	if s.proxy == nil {
+		return &StatusError{http.StatusServiceUnavailable, fmt.Errorf("error: proxy is not configured, set PROXY_MODE")}
+	}
+	return nil
+}
+
+// ProxyRequest forwards request to the provider recording the interaction,
+// or replays recorded response
+func (s *ApiServer) ProxyRequest(ctx context.Context, r *ProxiedRequest) (*ProxiedResponse, error) {
+	if err := s.checkProxy(); err != nil {
+		return nil, err
+	}
+	return s.proxy.Do(ctx, r)
+}
+
+// ProxyHandler..
+func ProxyHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		defer r.Body.Close()
+		body, err := io.ReadAll(io.LimitReader(r.Body, 16<<20))
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		pr := &ProxiedRequest{
+			Method: r.Method,
+			Path:   strings.TrimPrefix(r.URL.Path, proxyPrefix),
+			Query:  r.URL.RawQuery,
+			Header: r.Header.Clone(),
+		}
+		pr.Body, pr.BodyEncoding = encodeBody(body)
+
+		resp, err := api.ProxyRequest(r.Context(), pr)
+		if err != nil {
+			var se *StatusError
+			if errors.As(err, &se) {
+				return err
+			}
+			return &StatusError{http.StatusBadGateway, err}
+		}
+		respBody, err := decodeBody(resp.Body, resp.BodyEncoding)
+		if err != nil {
+			return err
+		}
+		for name, vals := range resp.Header {
+			for _, val := range vals {
+				rw.Header().Add(name, val)
+			}
+		}
+		rw.WriteHeader(resp.Status)
+		rw.Write(respBody)
+		return nil
+	}
+}
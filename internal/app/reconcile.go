@@ -0,0 +1,333 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Reconciliation row results
+const (
+	reconMatched      = "matched"
+	reconMismatched   = "mismatched"
+	reconUnknown      = "unknown"
+	reconAlreadyFinal = "already_final"
+	reconInvalid      = "invalid"
+)
+
+// reconEntry is a single row of a settlement file
+type reconEntry struct {
+	Line     int
+	ID       int
+	Status   string
+	Amount   *float64
+	Currency string
+	Err      error
+}
+
+// ReconciliationRow is an outcome of a single settlement file row
+type ReconciliationRow struct {
+	Line    int    `json:"line"`
+	ID      int    `json:"id,omitempty"`
+	Status  string `json:"transaction_status,omitempty"`
+	Result  string `json:"result"`
+	Message string `json:"message,omitempty"`
+}
+
+// ReconciliationReport sums up applied settlement file
+type ReconciliationReport struct {
+	Total        int                 `json:"total"`
+	Matched      int                 `json:"matched"`
+	Mismatched   int                 `json:"mismatched"`
+	Unknown      int                 `json:"unknown"`
+	AlreadyFinal int                 `json:"already_final"`
+	Invalid      int                 `json:"invalid"`
+	Rows         []ReconciliationRow `json:"rows"`
+}
+
+func (rep *ReconciliationReport) add(row ReconciliationRow) {
+	rep.Total++
+	switch row.Result {
+	case reconMatched:
+		rep.Matched++
+	case reconMismatched:
+		rep.Mismatched++
+	case reconUnknown:
+		rep.Unknown++
+	case reconAlreadyFinal:
+		rep.AlreadyFinal++
+	case reconInvalid:
+		rep.Invalid++
+	}
+	rep.Rows = append(rep.Rows, row)
+}
+
+// normalizeStatus accepts both native and english final statuses
+func normalizeStatus(st string) string {
+	switch strings.ToLower(strings.TrimSpace(st)) {
+	case "success", "succeeded", "успех":
+		return "УСПЕХ"
+	case "failed", "failure", "неуспех":
+		return "НЕУСПЕХ"
+	}
+	return strings.TrimSpace(st)
+}
+
+// parseReconciliationCSV reads CSV with header; 'id' and 'transaction_status'
+// columns are required, 'amount' and 'currency' are checked when present
+func parseReconciliationCSV(r io.Reader) ([]reconEntry, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: can't read CSV header: %s", err)}
+	}
+	cols := make(map[string]int)
+	for i, h := range header {
+		cols[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	if _, ok := cols["status"]; ok {
+		cols["transaction_status"] = cols["status"]
+	}
+	for _, c := range []string{"id", "transaction_status"} {
+		if _, ok := cols[c]; !ok {
+			return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: CSV header should contain '%s' column", c)}
+		}
+	}
+	field := func(record []string, c string) string {
+		i, ok := cols[c]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	entries := make([]reconEntry, 0)
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: line %d: %s", line, err)}
+		}
+		e := reconEntry{Line: line, Status: normalizeStatus(field(record, "transaction_status")), Currency: field(record, "currency")}
+		e.ID, err = strconv.Atoi(field(record, "id"))
+		if err != nil {
+			e.Err = fmt.Errorf("error: id is NaN")
+		}
+		if val := field(record, "amount"); val != "" && e.Err == nil {
+			amount, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				e.Err = fmt.Errorf("error: amount is NaN")
+			}
+			e.Amount = &amount
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// camtDocument is a subset of ISO 20022 camt.053 bank statement.
+// Transaction id is expected in EndToEndId reference.
+type camtDocument struct {
+	Entries []struct {
+		Amount struct {
+			Value    string `xml:",chardata"`
+			Currency string `xml:"Ccy,attr"`
+		} `xml:"Amt"`
+		Reversal bool `xml:"RvslInd"`
+		Status   struct {
+			Value string `xml:",chardata"`
+			// Newer schema versions nest status code
+			Code string `xml:"Cd"`
+		} `xml:"Sts"`
+		EndToEndID string `xml:"NtryDtls>TxDtls>Refs>EndToEndId"`
+	} `xml:"BkToCstmrStmt>Stmt>Ntry"`
+}
+
+// parseCamt053 maps booked entries to "УСПЕХ" and reversed ones to "НЕУСПЕХ"
+func parseCamt053(r io.Reader) ([]reconEntry, error) {
+	doc := camtDocument{}
+	err := xml.NewDecoder(r).Decode(&doc)
+	if err != nil {
+		return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: can't parse camt.053: %s", err)}
+	}
+	entries := make([]reconEntry, 0, len(doc.Entries))
+	for i, ntry := range doc.Entries {
+		e := reconEntry{Line: i + 1, Currency: ntry.Amount.Currency}
+		e.ID, err = strconv.Atoi(strings.TrimSpace(ntry.EndToEndID))
+		if err != nil {
+			e.Err = fmt.Errorf("error: EndToEndId is not a transaction id")
+		}
+		if amount, err := strconv.ParseFloat(strings.TrimSpace(ntry.Amount.Value), 64); err == nil {
+			e.Amount = &amount
+		}
+		status := strings.TrimSpace(ntry.Status.Value)
+		if ntry.Status.Code != "" {
+			status = strings.TrimSpace(ntry.Status.Code)
+		}
+		switch {
+		case status != "BOOK":
+			e.Err = fmt.Errorf("error: entry status '%s' is not final", status)
+		case ntry.Reversal:
+			e.Status = "НЕУСПЕХ"
+		default:
+			e.Status = "УСПЕХ"
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// parseReconciliationFile picks parser by format, or by content if format is empty
+func parseReconciliationFile(r io.Reader, format string) ([]reconEntry, error) {
+	br := bufio.NewReader(r)
+	if format == "" {
+		format = "csv"
+		if b, err := br.Peek(64); len(b) > 0 && (err == nil || err == io.EOF) && strings.HasPrefix(strings.TrimSpace(string(b)), "<") {
+			format = "camt053"
+		}
+	}
+	switch format {
+	case "csv":
+		return parseReconciliationCSV(br)
+	case "camt053":
+		return parseCamt053(br)
+	}
+	return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: there is no format like '%s'; available formats: csv,camt053", format)}
+}
+
+// reconcile applies final statuses through the usual status rules
+func reconcile(ctx context.Context, entries []reconEntry) (*ReconciliationReport, error) {
+	rep := &ReconciliationReport{Rows: make([]ReconciliationRow, 0, len(entries))}
+	for _, e := range entries {
+		row := ReconciliationRow{Line: e.Line, ID: e.ID, Status: e.Status}
+		if e.Err == nil {
+			e.Err = validateStatusChange(&Transaction{ID: e.ID, Status: e.Status})
+		}
+		if e.Err != nil {
+			row.Result, row.Message = reconInvalid, e.Err.Error()
+			rep.add(row)
+			continue
+		}
+
+		t, err := api.GetTransaction(ctx, e.ID)
+		if err != nil {
+			var se Error
+			if errors.As(err, &se) && se.Status() == http.StatusNotFound {
+				row.Result, row.Message = reconUnknown, se.Error()
+				rep.add(row)
+				continue
+			}
+			return nil, err
+		}
+		switch {
+		case e.Amount != nil && math.Abs(*e.Amount-t.Amount) > 0.005:
+			row.Result = reconMismatched
+			row.Message = fmt.Sprintf("error: amount %v doesn't match %v", *e.Amount, t.Amount)
+		case e.Currency != "" && e.Currency != t.Currency:
+			row.Result = reconMismatched
+			row.Message = fmt.Sprintf("error: currency '%s' doesn't match '%s'", e.Currency, t.Currency)
+		case t.Status == e.Status:
+			row.Result = reconAlreadyFinal
+		default:
+			err = api.ChangeTransactionStatus(ctx, e.ID, e.Status)
+			var se Error
+			switch {
+			case err == nil:
+				row.Result = reconMatched
+			case errors.As(err, &se) && se.Status() == http.StatusConflict:
+				row.Result, row.Message = reconMismatched, se.Error()
+			default:
+				return nil, err
+			}
+		}
+		rep.add(row)
+	}
+	return rep, nil
+}
+
+// ImportReconciliationHandler..
+func ImportReconciliationHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		defer r.Body.Close()
+		var body io.Reader = r.Body
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			f, _, err := r.FormFile("file")
+			if err != nil {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: required form field: file")}
+			}
+			defer f.Close()
+			body = f
+		}
+
+		entries, err := parseReconciliationFile(body, r.URL.Query().Get("format"))
+		if err != nil {
+			return err
+		}
+		rep, err := reconcile(r.Context(), entries)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(rep)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// RunReconcile is 'reconcile' subcommand: applies settlement file
+// to the database and prints reconciliation report
+func RunReconcile(args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	file := fs.String("file", "", "settlement file, '-' for stdin")
+	format := fs.String("format", "", "csv or camt053, detected by content if empty")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("error: required flag: -file")
+	}
+
+	in := os.Stdin
+	if *file != "-" {
+		in, err = os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	entries, err := parseReconciliationFile(in, *format)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	api, err = NewApiServer(ctx)
+	if err != nil {
+		return err
+	}
+	rep, err := reconcile(ctx, entries)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rep)
+}
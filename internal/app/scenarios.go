@@ -0,0 +1,464 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario run statuses
+const (
+	scenarioRunning   = "running"
+	scenarioCompleted = "completed"
+	scenarioFailed    = "failed"
+)
+
+// Scenario is attached to a new transaction by this header, scenario field or metadata key
+const (
+	scenarioHeader      = "X-Paymulator-Scenario"
+	scenarioMetadataKey = "paymulator_scenario"
+)
+
+// Scenario steps are checked this often, so delays of seconds are kept
+const scenarioInterval = time.Second
+
+// Runs falling behind, e.g. after time travel, do one step per round
+const maxScenarioRounds = 100
+
+const maxScenarioSteps = 50
+
+var scenarioName = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,99}$`)
+
+// parseScenario reads scenario definition, YAML or JSON
+func parseScenario(b []byte) (*Scenario, error) {
+	sc := new(Scenario)
+	err := yaml.Unmarshal(b, sc)
+	if err != nil {
+		return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: can't parse scenario: %s", err)}
+	}
+	return sc, validateScenario(sc)
+}
+
+func validateScenario(sc *Scenario) error {
+	if !scenarioName.MatchString(sc.Name) {
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: name should be up to 100 lowercase letters, digits, '_', '-' or '.'")}
+	}
+	if len(sc.Steps) == 0 || len(sc.Steps) > maxScenarioSteps {
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: scenario should have 1 to %d steps", maxScenarioSteps)}
+	}
+	for i, step := range sc.Steps {
+		if _, err := step.delay(); err != nil {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: step %d: after should be a duration like '2s'", i)}
+		}
+		actions := 0
+		if step.Status != "" {
+			actions++
+			if !statusChangeAllowed(step.Status) {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: step %d: there is no status like '%s'", i, step.Status)}
+			}
+		}
+		if step.Dispute != "" {
+			actions++
+			if !validDisputeReason(step.Dispute) {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: step %d: there is no reason code like '%s'", i, step.Dispute)}
+			}
+		}
+		if step.ResolveDispute != "" {
+			actions++
+			if step.ResolveDispute != disputeWon && step.ResolveDispute != disputeLost {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: step %d: resolve_dispute should be won or lost", i)}
+			}
+		}
+		if actions != 1 {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: step %d should have one of status, dispute, resolve_dispute", i)}
+		}
+	}
+	return nil
+}
+
+// statusChangeAllowed tells whether scenario may move transaction to st
+func statusChangeAllowed(st string) bool {
+	switch st {
+	case "УСПЕХ", "НЕУСПЕХ", "ОШИБКА", "ОТМЕНЕН":
+		return true
+	}
+	return false
+}
+
+// delay is time since the previous step, or since transaction creation for the first one
+func (step ScenarioStep) delay() (time.Duration, error) {
+	if step.After == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(step.After)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("negative delay")
+	}
+	return d, err
+}
+
+// CreateScenario stores scenario definition under its name
+func (s *ApiServer) CreateScenario(ctx context.Context, sc *Scenario) error {
+	steps, _ := json.Marshal(sc.Steps)
+	err := s.database.QueryRow(
+		ctx,
+		"insert into scenarios (name, description, steps, created_at) values ($1,$2,$3,$4) returning created_at",
+		sc.Name,
+		sc.Description,
+		steps,
+		clock.Now(),
+	).Scan(&sc.Created_at)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return &StatusError{http.StatusConflict, fmt.Errorf("error: scenario '%s' already exists", sc.Name)}
+	}
+	return err
+}
+
+const scenarioColumns = "name, description, steps, created_at"
+
+func scanScenario(row pgx.Row, sc *Scenario) error {
+	return row.Scan(&sc.Name, &sc.Description, &sc.Steps, &sc.Created_at)
+}
+
+// GetScenarios lists scenario definitions
+func (s *ApiServer) GetScenarios(ctx context.Context) ([]Scenario, error) {
+	rows, err := s.database.Query(ctx, "select "+scenarioColumns+" from scenarios order by name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scenarios := make([]Scenario, 0)
+	for rows.Next() {
+		sc := Scenario{}
+		err = scanScenario(rows, &sc)
+		if err != nil {
+			return nil, err
+		}
+		scenarios = append(scenarios, sc)
+	}
+	return scenarios, rows.Err()
+}
+
+// attachScenarios starts scenario runs of new transactions, steps are copied
+// so later changes of definitions don't affect runs in progress
+func attachScenarios(ctx context.Context, tx pgx.Tx, ts []*Transaction) error {
+	scenarios := make(map[string]*Scenario)
+	for _, t := range ts {
+		if t.Scenario == "" {
+			t.Scenario = t.Metadata[scenarioMetadataKey]
+		}
+		if t.Scenario == "" {
+			continue
+		}
+		sc, ok := scenarios[t.Scenario]
+		if !ok {
+			sc = new(Scenario)
+			err := scanScenario(tx.QueryRow(ctx, "select "+scenarioColumns+" from scenarios where name=$1", t.Scenario), sc)
+			if err != nil {
+				if errors.Is(err, pgx.ErrNoRows) {
+					return &StatusError{http.StatusBadRequest, fmt.Errorf("error: scenario '%s' not found", t.Scenario)}
+				}
+				return err
+			}
+			scenarios[t.Scenario] = sc
+		}
+		d, _ := sc.Steps[0].delay()
+		steps, _ := json.Marshal(sc.Steps)
+		_, err := tx.Exec(
+			ctx,
+			`insert into scenario_runs (transaction_id, scenario, status, steps, next_at, created_at, changed_at)
+			values ($1,$2,$3,$4,$5,$6,$6)`,
+			t.ID,
+			sc.Name,
+			scenarioRunning,
+			steps,
+			t.Created_at.Add(d),
+			t.Created_at,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const scenarioRunColumns = "transaction_id, scenario, status, steps, next_step, next_at, results, created_at, changed_at"
+
+func scanScenarioRun(row pgx.Row, run *ScenarioRun) error {
+	return row.Scan(
+		&run.TransactionID,
+		&run.Scenario,
+		&run.Status,
+		&run.Steps,
+		&run.NextStep,
+		&run.NextAt,
+		&run.Results,
+		&run.Created_at,
+		&run.Changed_at,
+	)
+}
+
+// GetScenarioRun reports progress of scenario attached to transaction
+func (s *ApiServer) GetScenarioRun(ctx context.Context, transactionID int) (*ScenarioRun, error) {
+	run := new(ScenarioRun)
+	err := scanScenarioRun(s.database.QueryRow(
+		ctx,
+		"select "+scenarioRunColumns+" from scenario_runs where transaction_id=$1",
+		transactionID,
+	), run)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: transaction has no scenario")}
+		}
+		return nil, err
+	}
+	return run, nil
+}
+
+// applyScenarioStep does step action through the same rules as API requests
+func (s *ApiServer) applyScenarioStep(ctx context.Context, transactionID int, step ScenarioStep) error {
+	switch {
+	case step.Status != "":
+		return s.ChangeTransactionStatus(ctx, transactionID, step.Status)
+	case step.Dispute != "":
+		_, err := s.OpenDispute(ctx, transactionID, step.Dispute)
+		return err
+	case step.ResolveDispute != "":
+		disputes, err := s.GetDisputes(ctx, DisputeFilter{TransactionID: transactionID})
+		if err != nil {
+			return err
+		}
+		if len(disputes) == 0 {
+			return &StatusError{http.StatusConflict, fmt.Errorf("error: transaction has no dispute")}
+		}
+		_, err = s.ResolveDispute(ctx, disputes[len(disputes)-1].ID, step.ResolveDispute)
+		return err
+	}
+	return nil
+}
+
+// runScenarioStep does the next step of a due run, nil is returned if run isn't due anymore.
+// Step rejected by status rules fails the run. Step action commits on its own, so
+// its attempt is stored before it, and step attempted by a run that failed to store
+// the result is only recorded, not applied again.
+func (s *ApiServer) runScenarioStep(ctx context.Context, transactionID int, now time.Time) (*ScenarioStepResult, error) {
+	tx, err := s.database.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Run is locked while its step is done, concurrent runners skip it
+	run := new(ScenarioRun)
+	err = scanScenarioRun(tx.QueryRow(
+		ctx,
+		"select "+scenarioRunColumns+" from scenario_runs where transaction_id=$1 and status=$2 and next_at<=$3 for update skip locked",
+		transactionID,
+		scenarioRunning,
+		now,
+	), run)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	res := ScenarioStepResult{TransactionID: run.TransactionID, Step: run.NextStep, Action: run.Steps[run.NextStep].action(), DoneAt: now}
+	attempt, err := s.database.Exec(
+		ctx,
+		"insert into scenario_attempts (transaction_id, step, created_at) values ($1,$2,$3) on conflict do nothing",
+		run.TransactionID,
+		run.NextStep,
+		now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if attempt.RowsAffected() > 0 {
+		err = s.applyScenarioStep(ctx, run.TransactionID, run.Steps[run.NextStep])
+	}
+	if err != nil {
+		var se *StatusError
+		if !errors.As(err, &se) {
+			// Step isn't applied, so it's attempted again
+			_, derr := s.database.Exec(ctx, "delete from scenario_attempts where transaction_id=$1 and step=$2", run.TransactionID, run.NextStep)
+			if derr != nil {
+				log.Printf("Attempt of scenario step not cleared - %s", derr)
+			}
+			return nil, err
+		}
+		res.Error = se.Error()
+	}
+	run.Results = append(run.Results, res)
+	run.NextStep++
+	switch {
+	case res.Error != "":
+		run.Status, run.NextAt = scenarioFailed, nil
+	case run.NextStep == len(run.Steps):
+		run.Status, run.NextAt = scenarioCompleted, nil
+	default:
+		// Steps are timed from when the previous one was due, so time travel doesn't stretch them
+		d, _ := run.Steps[run.NextStep].delay()
+		next := run.NextAt.Add(d)
+		run.NextAt = &next
+	}
+	results, _ := json.Marshal(run.Results)
+	err = tx.QueryRow(
+		ctx,
+		`update scenario_runs set status=$2, next_step=$3, next_at=$4, results=$5, changed_at=$6
+		where transaction_id=$1 returning changed_at`,
+		run.TransactionID,
+		run.Status,
+		run.NextStep,
+		run.NextAt,
+		results,
+		now,
+	).Scan(&run.Changed_at)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, "delete from scenario_attempts where transaction_id=$1", run.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.webhooks.Send(ctx, "scenario.step_completed", res)
+	if run.Status != scenarioRunning {
+		s.webhooks.Send(ctx, "scenario."+run.Status, run)
+	}
+	return &res, nil
+}
+
+// AdvanceScenarios does every scenario step due by the clock
+func (s *ApiServer) AdvanceScenarios(ctx context.Context) ([]ScenarioStepResult, error) {
+	results := make([]ScenarioStepResult, 0)
+	for round := 0; round < maxScenarioRounds; round++ {
+		now := clock.Now()
+		rows, err := s.database.Query(
+			ctx,
+			"select transaction_id from scenario_runs where status=$1 and next_at<=$2 order by next_at, transaction_id",
+			scenarioRunning,
+			now,
+		)
+		if err != nil {
+			return results, err
+		}
+		ids := make([]int, 0)
+		for rows.Next() {
+			var id int
+			err = rows.Scan(&id)
+			if err != nil {
+				rows.Close()
+				return results, err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return results, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		for _, id := range ids {
+			res, err := s.runScenarioStep(ctx, id, now)
+			if err != nil {
+				return results, err
+			}
+			if res != nil {
+				results = append(results, *res)
+			}
+		}
+	}
+	return results, nil
+}
+
+// action describes what step does, like "status УСПЕХ"
+func (step ScenarioStep) action() string {
+	switch {
+	case step.Status != "":
+		return "status " + step.Status
+	case step.Dispute != "":
+		return "dispute " + step.Dispute
+	}
+	return "resolve_dispute " + step.ResolveDispute
+}
+
+// CreateScenarioHandler..
+func CreateScenarioHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		defer r.Body.Close()
+		b, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		sc, err := parseScenario(b)
+		if err != nil {
+			return err
+		}
+
+		err = api.CreateScenario(r.Context(), sc)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(sc)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// GetScenariosHandler..
+func GetScenariosHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		scenarios, err := api.GetScenarios(r.Context())
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(scenarios)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// GetScenarioRunHandler..
+func GetScenarioRunHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: id is NaN")}
+		}
+		run, err := api.GetScenarioRun(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(run)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,378 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+// Business days are closed in UTC
+const businessDateLayout = "2006-01-02"
+
+// SettlementFilter narrows down settlements list. Zero values match everything.
+type SettlementFilter struct {
+	MerchantID   *int
+	Currency     string
+	BusinessDate string
+}
+
+type settlementKey struct {
+	merchantID int
+	currency   string
+}
+
+// Kinds of settlement lines
+const (
+	linePayment = "payment"
+	lineRefund  = "refund"
+)
+
+// feePaidQuery sums fee of transaction t moved to provider by postings of event,
+// fee stored in transaction is reduced when refunded so the ledger is asked
+const feePaidQuery = `coalesce((select sum(e.amount) from ledger_postings p join ledger_entries e on e.posting_id=p.id
+	where p.transaction_id=t.id and p.event=$2 and e.account='` + feesAccount + `'), 0)`
+
+// settle computes net amount of line from fee paid, or reversed by refund
+func (l *SettlementLine) settle() {
+	switch {
+	case l.Type == lineRefund:
+		// Refund takes back amount less the fee returned to merchant
+		l.Fee = -l.Fee
+		l.NetAmount = roundCents(-l.Amount - l.Fee)
+	case l.Status == "УСПЕХ":
+		l.NetAmount = roundCents(l.Amount - l.Fee)
+	default:
+		// Fees are charged on success only
+		l.Fee, l.NetAmount = 0, 0
+	}
+}
+
+// add counts line into settlement totals
+func (st *Settlement) add(l SettlementLine) {
+	switch {
+	case l.Type == lineRefund:
+		st.RefundedCount++
+		st.RefundedAmount += l.Amount
+	case l.Status == "УСПЕХ":
+		st.SuccessCount++
+		st.SuccessAmount += l.Amount
+	case l.Status == "НЕУСПЕХ", l.Status == "ОШИБКА":
+		st.FailedCount++
+		st.FailedAmount += l.Amount
+	case l.Status == "ОТМЕНЕН":
+		st.CancelledCount++
+		st.CancelledAmount += l.Amount
+	}
+	st.FeeAmount = roundCents(st.FeeAmount + l.Fee)
+	st.NetAmount = roundCents(st.NetAmount + l.NetAmount)
+}
+
+// CloseSettlements settles transactions that reached a final status during
+// day and disputes lost during day, which weren't settled yet,
+// one batch per merchant and currency
+func (s *ApiServer) CloseSettlements(ctx context.Context, day time.Time) ([]Settlement, error) {
+	date := day.UTC().Format(businessDateLayout)
+	tx, err := s.database.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	keys := make([]settlementKey, 0)
+	groups := make(map[settlementKey][]SettlementLine)
+	group := func(rows pgx.Rows, kind string) error {
+		defer rows.Close()
+		for rows.Next() {
+			key := settlementKey{}
+			l := SettlementLine{Type: kind}
+			err := rows.Scan(&l.TransactionID, &l.DisputeID, &key.merchantID, &key.currency, &l.Status, &l.Amount, &l.Fee)
+			if err != nil {
+				return err
+			}
+			l.settle()
+			if _, ok := groups[key]; !ok {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], l)
+		}
+		return rows.Err()
+	}
+
+	rows, err := tx.Query(
+		ctx,
+		`select id, 0, merchant_id, currency, transaction_status, amount, `+feePaidQuery+` from transactions t
+		where changed_at::date=$1::date
+		and transaction_status in ('УСПЕХ', 'НЕУСПЕХ', 'ОШИБКА', 'ОТМЕНЕН')
+		and not exists (select 1 from settlement_lines l where l.transaction_id=t.id and l.dispute_id is null)
+		order by id for update`,
+		date,
+		"fee",
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err = group(rows, linePayment); err != nil {
+		return nil, err
+	}
+	rows, err = tx.Query(
+		ctx,
+		`select t.id, d.id, d.merchant_id, d.currency, t.transaction_status, d.amount, `+feePaidQuery+`
+		from disputes d join transactions t on t.id=d.transaction_id
+		where d.status='lost' and d.changed_at::date=$1::date
+		and not exists (select 1 from settlement_lines l where l.dispute_id=d.id)
+		order by d.id for update of d`,
+		date,
+		"fee_reversal",
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err = group(rows, lineRefund); err != nil {
+		return nil, err
+	}
+
+	settlements := make([]Settlement, 0, len(keys))
+	for _, key := range keys {
+		st := Settlement{MerchantID: key.merchantID, Currency: key.currency, BusinessDate: date}
+		for _, l := range groups[key] {
+			st.add(l)
+		}
+		err = tx.QueryRow(
+			ctx,
+			`insert into settlements (merchant_id, currency, business_date, success_count, success_amount,
+			failed_count, failed_amount, cancelled_count, cancelled_amount, refunded_count, refunded_amount,
+			fee_amount, net_amount, created_at)
+			values ($1,$2,$3::date,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14) returning id, created_at`,
+			st.MerchantID,
+			st.Currency,
+			st.BusinessDate,
+			st.SuccessCount,
+			st.SuccessAmount,
+			st.FailedCount,
+			st.FailedAmount,
+			st.CancelledCount,
+			st.CancelledAmount,
+			st.RefundedCount,
+			st.RefundedAmount,
+			st.FeeAmount,
+			st.NetAmount,
+			clock.Now(),
+		).Scan(&st.ID, &st.Created_at)
+		if err != nil {
+			return nil, err
+		}
+
+		batch := &pgx.Batch{}
+		for _, l := range groups[key] {
+			batch.Queue(
+				`insert into settlement_lines (settlement_id, type, transaction_id, dispute_id, transaction_status, amount, fee, net_amount)
+				values ($1,$2,$3,nullif($4::int,0),$5,$6,$7,$8)`,
+				st.ID,
+				l.Type,
+				l.TransactionID,
+				l.DisputeID,
+				l.Status,
+				l.Amount,
+				l.Fee,
+				l.NetAmount,
+			)
+		}
+		err = tx.SendBatch(ctx, batch).Close()
+		if err != nil {
+			return nil, err
+		}
+		settlements = append(settlements, st)
+	}
+	return settlements, tx.Commit(ctx)
+}
+
+const settlementColumns = `id, merchant_id, currency, business_date::text, success_count, success_amount,
+	failed_count, failed_amount, cancelled_count, cancelled_amount, refunded_count, refunded_amount,
+	fee_amount, net_amount, created_at`
+
+func (s *ApiServer) GetSettlements(ctx context.Context, f SettlementFilter) ([]Settlement, error) {
+	q := "select " + settlementColumns + " from settlements where true"
+	args := make([]interface{}, 0, 3)
+	if f.MerchantID != nil {
+		args = append(args, *f.MerchantID)
+		q += fmt.Sprintf(" and merchant_id=$%d", len(args))
+	}
+	if f.Currency != "" {
+		args = append(args, f.Currency)
+		q += fmt.Sprintf(" and currency=$%d", len(args))
+	}
+	if f.BusinessDate != "" {
+		args = append(args, f.BusinessDate)
+		q += fmt.Sprintf(" and business_date=$%d::date", len(args))
+	}
+	rows, err := s.database.Query(ctx, q+" order by id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settlements := make([]Settlement, 0)
+	for rows.Next() {
+		st := Settlement{}
+		err = rows.Scan(
+			&st.ID,
+			&st.MerchantID,
+			&st.Currency,
+			&st.BusinessDate,
+			&st.SuccessCount,
+			&st.SuccessAmount,
+			&st.FailedCount,
+			&st.FailedAmount,
+			&st.CancelledCount,
+			&st.CancelledAmount,
+			&st.RefundedCount,
+			&st.RefundedAmount,
+			&st.FeeAmount,
+			&st.NetAmount,
+			&st.Created_at,
+		)
+		if err != nil {
+			return nil, err
+		}
+		settlements = append(settlements, st)
+	}
+	return settlements, rows.Err()
+}
+
+func (s *ApiServer) GetSettlementLines(ctx context.Context, id int) ([]SettlementLine, error) {
+	var exists bool
+	err := s.database.QueryRow(ctx, "select exists(select 1 from settlements where id=$1)", id).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: settlement not found")}
+	}
+
+	rows, err := s.database.Query(
+		ctx,
+		`select id, settlement_id, type, transaction_id, coalesce(dispute_id, 0), transaction_status, amount, fee, net_amount
+		from settlement_lines where settlement_id=$1 order by id`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := make([]SettlementLine, 0)
+	for rows.Next() {
+		l := SettlementLine{}
+		err = rows.Scan(&l.ID, &l.SettlementID, &l.Type, &l.TransactionID, &l.DisputeID, &l.Status, &l.Amount, &l.Fee, &l.NetAmount)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, l)
+	}
+	return lines, rows.Err()
+}
+
+// CloseSettlementsHandler..
+func CloseSettlementsHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		req := struct {
+			Date string `json:"business_date"`
+		}{}
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err := decoder.Decode(&req)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		if req.Date == "" {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: business_date")}
+		}
+		day, err := time.Parse(businessDateLayout, req.Date)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: business_date should be like 2006-01-02, got '%s'", req.Date)}
+		}
+
+		settlements, err := api.CloseSettlements(r.Context(), day)
+		if err != nil {
+			return err
+		}
+		resp := map[string]interface{}{
+			"message":     "Business day " + req.Date + " closed",
+			"settlements": settlements,
+		}
+		data, _ := json.Marshal(resp)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// GetSettlementsHandler..
+func GetSettlementsHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		query := r.URL.Query()
+		filter := SettlementFilter{
+			Currency:     query.Get("currency"),
+			BusinessDate: query.Get("business_date"),
+		}
+		if val := query.Get("merchant_id"); val != "" {
+			merchantID, err := strconv.Atoi(val)
+			if err != nil {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: 'merchant_id' is NaN")}
+			}
+			filter.MerchantID = &merchantID
+		}
+		if filter.BusinessDate != "" {
+			if _, err := time.Parse(businessDateLayout, filter.BusinessDate); err != nil {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: business_date should be like 2006-01-02, got '%s'", filter.BusinessDate)}
+			}
+		}
+		page, err := pageParam(query.Get("page"))
+		if err != nil {
+			return err
+		}
+
+		settlements, err := api.GetSettlements(r.Context(), filter)
+		if err != nil {
+			return err
+		}
+		start, end := Paginate(page, 10, len(settlements))
+		data, _ := json.Marshal(settlements[start:end])
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// GetSettlementLinesHandler..
+func GetSettlementLinesHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: id is NaN")}
+		}
+		page, err := pageParam(r.URL.Query().Get("page"))
+		if err != nil {
+			return err
+		}
+
+		lines, err := api.GetSettlementLines(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		start, end := Paginate(page, 10, len(lines))
+		data, _ := json.Marshal(lines[start:end])
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,904 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+// Subscription statuses
+const (
+	subscriptionTrialing = "trialing"
+	subscriptionActive   = "active"
+	subscriptionPastDue  = "past_due"
+	subscriptionUnpaid   = "unpaid"
+	subscriptionCanceled = "canceled"
+)
+
+// Subscription charge statuses
+const (
+	chargePending = "pending"
+	chargePaid    = "paid"
+	chargeFailed  = "failed"
+)
+
+// Renewals are made without customer, so they can't pass 3-D Secure challenge
+const declineAuthenticationRequired = "authentication_required"
+
+// Renewals failed because transaction was rejected by the service itself
+const declineProcessingError = "processing_error"
+
+// billingLease keeps a claimed subscription from being billed twice while it's charged
+const billingLease = 5 * time.Minute
+
+// Renewals falling behind, e.g. after time travel, are billed one period per round
+const maxBillingRounds = 100
+
+// dunningSchedule is the delay of each retry after a failed renewal,
+// subscription becomes unpaid when all of them failed
+var dunningSchedule = []time.Duration{24 * time.Hour, 3 * 24 * time.Hour, 5 * 24 * time.Hour}
+
+var billingIntervals = []string{"day", "week", "month", "year"}
+
+// SubscriptionFilter narrows down subscriptions list. Zero values match everything.
+type SubscriptionFilter struct {
+	UserID *int
+	Status string
+}
+
+// SubscriptionUpdate changes plan or cancellation of a subscription, nil fields are kept
+type SubscriptionUpdate struct {
+	PlanID            *int  `json:"plan_id"`
+	CancelAtPeriodEnd *bool `json:"cancel_at_period_end"`
+}
+
+// addInterval moves t by count billing intervals, day of month is clamped
+// to the end of shorter months so Jan 31 renews on Feb 28
+func addInterval(t time.Time, interval string, count int) time.Time {
+	switch interval {
+	case "day":
+		return t.AddDate(0, 0, count)
+	case "week":
+		return t.AddDate(0, 0, 7*count)
+	case "year":
+		count *= 12
+	}
+	y, m, d := t.Date()
+	first := time.Date(y, m+time.Month(count), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	if last := first.AddDate(0, 1, -1).Day(); d > last {
+		d = last
+	}
+	return first.AddDate(0, 0, d-1)
+}
+
+// proration is price difference of plans for the rest of period, it's
+// added to the next renewal, negative one is a credit
+func proration(from, to *Plan, start, end, now time.Time) float64 {
+	total := end.Sub(start)
+	if total <= 0 || !now.Before(end) {
+		return 0
+	}
+	left := end.Sub(now)
+	if left > total {
+		left = total
+	}
+	return roundCents((to.Amount - from.Amount) * float64(left) / float64(total))
+}
+
+const planColumns = "id, name, merchant_id, amount, currency, billing_interval, interval_count, trial_days, created_at"
+
+func scanPlan(row pgx.Row, p *Plan) error {
+	return row.Scan(&p.ID, &p.Name, &p.MerchantID, &p.Amount, &p.Currency, &p.Interval, &p.IntervalCount, &p.TrialDays, &p.Created_at)
+}
+
+func getPlan(ctx context.Context, q queryRower, id int) (*Plan, error) {
+	p := new(Plan)
+	err := scanPlan(q.QueryRow(ctx, "select "+planColumns+" from plans where id=$1", id), p)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, &StatusError{http.StatusBadRequest, fmt.Errorf("error: plan %d not found", id)}
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+const subscriptionColumns = `id, plan_id, user_id, email, coalesce(payment_method_id, 0), status,
+	current_period_start, current_period_end, next_billing_at, cancel_at_period_end, canceled_at,
+	failed_attempts, proration_balance, created_at`
+
+func scanSubscription(row pgx.Row, sub *Subscription) error {
+	return row.Scan(
+		&sub.ID,
+		&sub.PlanID,
+		&sub.UserID,
+		&sub.Email,
+		&sub.PaymentMethodID,
+		&sub.Status,
+		&sub.CurrentPeriodStart,
+		&sub.CurrentPeriodEnd,
+		&sub.NextBillingAt,
+		&sub.CancelAtPeriodEnd,
+		&sub.CanceledAt,
+		&sub.FailedAttempts,
+		&sub.ProrationBalance,
+		&sub.Created_at,
+	)
+}
+
+const chargeColumns = "id, subscription_id, coalesce(transaction_id, 0), amount, period_start, period_end, status, decline_code, created_at"
+
+func scanCharge(row pgx.Row, c *SubscriptionCharge, dest ...interface{}) error {
+	return row.Scan(append([]interface{}{
+		&c.ID,
+		&c.SubscriptionID,
+		&c.TransactionID,
+		&c.Amount,
+		&c.PeriodStart,
+		&c.PeriodEnd,
+		&c.Status,
+		&c.DeclineCode,
+		&c.Created_at,
+	}, dest...)...)
+}
+
+// chargeStatus is status and decline code of renewal paid by transaction t.
+// Transaction the payment system hasn't processed yet keeps renewal pending.
+func chargeStatus(t *Transaction) (string, string) {
+	switch t.Status {
+	case "НОВЫЙ":
+		return chargePending, ""
+	case "УСПЕХ":
+		return chargePaid, ""
+	case statusRequiresAction:
+		return chargeFailed, declineAuthenticationRequired
+	}
+	return chargeFailed, t.DeclineCode
+}
+
+func (s *ApiServer) CreatePlan(ctx context.Context, p *Plan) error {
+	return s.database.QueryRow(
+		ctx,
+		`insert into plans (name, merchant_id, amount, currency, billing_interval, interval_count, trial_days, created_at)
+		values ($1,$2,$3,$4,$5,$6,$7,$8) returning id, created_at`,
+		p.Name,
+		p.MerchantID,
+		p.Amount,
+		p.Currency,
+		p.Interval,
+		p.IntervalCount,
+		p.TrialDays,
+		clock.Now(),
+	).Scan(&p.ID, &p.Created_at)
+}
+
+func (s *ApiServer) GetPlans(ctx context.Context) ([]Plan, error) {
+	rows, err := s.database.Query(ctx, "select "+planColumns+" from plans order by id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans := make([]Plan, 0)
+	for rows.Next() {
+		p := Plan{}
+		err = scanPlan(rows, &p)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, p)
+	}
+	return plans, rows.Err()
+}
+
+// CreateSubscription starts trial of the plan, or bills the first period right away
+func (s *ApiServer) CreateSubscription(ctx context.Context, sub *Subscription) error {
+	tx, err := s.database.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	p, err := getPlan(ctx, tx, sub.PlanID)
+	if err != nil {
+		return err
+	}
+	c, err := ensureCustomer(ctx, tx, sub.UserID, sub.Email)
+	if err != nil {
+		return err
+	}
+	if sub.PaymentMethodID != 0 {
+		var owner int
+		err = tx.QueryRow(ctx, "select coalesce(customer_id, 0) from payment_methods where id=$1", sub.PaymentMethodID).Scan(&owner)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: payment method %d not found", sub.PaymentMethodID)}
+		}
+		if err != nil {
+			return err
+		}
+		if owner != 0 && owner != c.ID {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: payment method %d is saved by another customer", sub.PaymentMethodID)}
+		}
+	}
+	now := clock.Now()
+	sub.Status, sub.CurrentPeriodStart, sub.CurrentPeriodEnd = subscriptionActive, now, now
+	if p.TrialDays > 0 {
+		sub.Status, sub.CurrentPeriodEnd = subscriptionTrialing, now.AddDate(0, 0, p.TrialDays)
+	}
+	err = scanSubscription(tx.QueryRow(
+		ctx,
+		`insert into subscriptions (plan_id, user_id, email, payment_method_id, status, current_period_start, current_period_end, next_billing_at, created_at)
+		values ($1,$2,$3,nullif($4::int, 0),$5,$6,$7,$7,$6) returning `+subscriptionColumns,
+		sub.PlanID,
+		sub.UserID,
+		sub.Email,
+		sub.PaymentMethodID,
+		sub.Status,
+		sub.CurrentPeriodStart,
+		sub.CurrentPeriodEnd,
+	), sub)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	s.webhooks.Send(ctx, "subscription.created", sub)
+
+	if sub.Status == subscriptionTrialing {
+		return nil
+	}
+	_, err = s.billSubscription(ctx, sub.ID, now)
+	if err != nil {
+		return err
+	}
+	billed, err := s.GetSubscription(ctx, sub.ID)
+	if err != nil {
+		return err
+	}
+	*sub = *billed
+	return nil
+}
+
+// billSubscription renews subscription due at now through the same path
+// transactions are created by, failed renewals are retried by dunning
+// schedule. Renewal stays pending until the payment system processes its
+// transaction. Nil charge is returned if subscription isn't due anymore.
+func (s *ApiServer) billSubscription(ctx context.Context, id int, now time.Time) (*SubscriptionCharge, error) {
+	// Claims subscription, concurrent billers skip it until lease expires
+	sub := new(Subscription)
+	err := scanSubscription(s.database.QueryRow(
+		ctx,
+		`update subscriptions set next_billing_at=$2 where id=$1 and next_billing_at<=$3
+		and status in ('trialing', 'active', 'past_due') returning `+subscriptionColumns,
+		id,
+		now.Add(billingLease),
+		now,
+	), sub)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if sub.CancelAtPeriodEnd {
+		err = scanSubscription(s.database.QueryRow(
+			ctx,
+			`update subscriptions set status='canceled', canceled_at=current_period_end, next_billing_at=null
+			where id=$1 returning `+subscriptionColumns,
+			sub.ID,
+		), sub)
+		if err != nil {
+			return nil, err
+		}
+		s.webhooks.Send(ctx, "subscription.canceled", sub)
+		return nil, nil
+	}
+
+	p, err := getPlan(ctx, s.database, sub.PlanID)
+	if err != nil {
+		return nil, err
+	}
+	c := &SubscriptionCharge{SubscriptionID: sub.ID, PeriodStart: sub.CurrentPeriodEnd, Status: chargePaid}
+	c.PeriodEnd = addInterval(c.PeriodStart, p.Interval, p.IntervalCount)
+	c.Amount = roundCents(p.Amount + sub.ProrationBalance)
+	carry := 0.0
+	if c.Amount < 0 {
+		carry, c.Amount = c.Amount, 0
+	}
+	if c.Amount > 0 {
+		t := &Transaction{
+			UserID:          sub.UserID,
+			Email:           sub.Email,
+			Amount:          c.Amount,
+			Currency:        p.Currency,
+			MerchantID:      p.MerchantID,
+			PaymentMethodID: sub.PaymentMethodID,
+		}
+		var se *StatusError
+		err = s.CreateTransaction(ctx, t)
+		switch {
+		case errors.As(err, &se) && se.Code < http.StatusInternalServerError:
+			c.Status, c.DeclineCode = chargeFailed, declineProcessingError
+		case err != nil:
+			return nil, err
+		default:
+			c.TransactionID = t.ID
+			c.Status, c.DeclineCode = chargeStatus(t)
+		}
+	}
+
+	tx, err := s.database.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if c.Status == chargePending {
+		// Locked transaction can't be processed before its charge is stored,
+		// otherwise the charge would never be settled
+		t := new(Transaction)
+		err = scanTransaction(tx.QueryRow(ctx, "select "+transactionColumns+" from transactions where id=$1 for update", c.TransactionID), t)
+		if err != nil {
+			return nil, err
+		}
+		c.Status, c.DeclineCode = chargeStatus(t)
+	}
+	// Proration changed meanwhile is kept for the next renewal
+	prorated := roundCents(sub.ProrationBalance - carry)
+	err = tx.QueryRow(
+		ctx,
+		`insert into subscription_charges (subscription_id, transaction_id, amount, period_start, period_end, status, decline_code, proration, created_at)
+		values ($1,nullif($2::int, 0),$3,$4,$5,$6,$7,$8,$9) returning id, created_at`,
+		c.SubscriptionID,
+		c.TransactionID,
+		c.Amount,
+		c.PeriodStart,
+		c.PeriodEnd,
+		c.Status,
+		c.DeclineCode,
+		prorated,
+		now,
+	).Scan(&c.ID, &c.Created_at)
+	if err != nil {
+		return nil, err
+	}
+	event, err := chargeSubscription(ctx, tx, sub, c, prorated, now)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if event != "" {
+		s.webhooks.Send(ctx, event, sub)
+	}
+	return c, nil
+}
+
+// chargeSubscription moves subscription to the period paid by charge c, or
+// to the dunning schedule if it failed. Subscription with pending charge isn't
+// billed until the charge is settled, no webhook event is returned for it.
+func chargeSubscription(ctx context.Context, tx pgx.Tx, sub *Subscription, c *SubscriptionCharge, prorated float64, now time.Time) (string, error) {
+	switch c.Status {
+	case chargePending:
+		return "", scanSubscription(tx.QueryRow(
+			ctx,
+			"update subscriptions set next_billing_at=null where id=$1 returning "+subscriptionColumns,
+			sub.ID,
+		), sub)
+	case chargePaid:
+		return "subscription.renewed", scanSubscription(tx.QueryRow(
+			ctx,
+			`update subscriptions set status='active', current_period_start=$2, current_period_end=$3, next_billing_at=$3,
+			failed_attempts=0, proration_balance=proration_balance-$4 where id=$1 returning `+subscriptionColumns,
+			sub.ID,
+			c.PeriodStart,
+			c.PeriodEnd,
+			prorated,
+		), sub)
+	}
+	event, status, next := "subscription.payment_failed", subscriptionPastDue, (*time.Time)(nil)
+	if sub.FailedAttempts < len(dunningSchedule) {
+		retry := now.Add(dunningSchedule[sub.FailedAttempts])
+		next = &retry
+	} else {
+		status, event = subscriptionUnpaid, "subscription.unpaid"
+	}
+	return event, scanSubscription(tx.QueryRow(
+		ctx,
+		`update subscriptions set status=$2, failed_attempts=failed_attempts+1, next_billing_at=$3
+		where id=$1 returning `+subscriptionColumns,
+		sub.ID,
+		status,
+		next,
+	), sub)
+}
+
+// settleCharge completes renewal pending on transaction t, which the payment
+// system changed to status st. Subscription is renewed or goes to dunning the
+// same way as right after billing. Nil subscription is returned if transaction
+// doesn't pay a pending renewal or subscription has been canceled meanwhile.
+func settleCharge(ctx context.Context, tx pgx.Tx, t *Transaction, st string) (*Subscription, string, error) {
+	c := new(SubscriptionCharge)
+	c.Status, c.DeclineCode = chargeStatus(&Transaction{Status: st, DeclineCode: t.DeclineCode})
+	var prorated float64
+	err := scanCharge(tx.QueryRow(
+		ctx,
+		`update subscription_charges set status=$3, decline_code=$4 where transaction_id=$1 and status=$2
+		returning `+chargeColumns+", proration",
+		t.ID,
+		chargePending,
+		c.Status,
+		c.DeclineCode,
+	), c, &prorated)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	sub := new(Subscription)
+	err = scanSubscription(tx.QueryRow(ctx, "select "+subscriptionColumns+" from subscriptions where id=$1 for update", c.SubscriptionID), sub)
+	if err != nil || sub.Status == subscriptionCanceled {
+		return nil, "", err
+	}
+	event, err := chargeSubscription(ctx, tx, sub, c, prorated, clock.Now())
+	if err != nil {
+		return nil, "", err
+	}
+	return sub, event, nil
+}
+
+// BillSubscriptions renews every subscription due by the clock
+func (s *ApiServer) BillSubscriptions(ctx context.Context) ([]SubscriptionCharge, error) {
+	charges := make([]SubscriptionCharge, 0)
+	for round := 0; round < maxBillingRounds; round++ {
+		now := clock.Now()
+		rows, err := s.database.Query(
+			ctx,
+			`select id from subscriptions where next_billing_at<=$1
+			and status in ('trialing', 'active', 'past_due') order by next_billing_at, id`,
+			now,
+		)
+		if err != nil {
+			return charges, err
+		}
+		ids := make([]int, 0)
+		for rows.Next() {
+			var id int
+			err = rows.Scan(&id)
+			if err != nil {
+				rows.Close()
+				return charges, err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return charges, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		for _, id := range ids {
+			c, err := s.billSubscription(ctx, id, now)
+			if err != nil {
+				return charges, err
+			}
+			if c != nil {
+				charges = append(charges, *c)
+			}
+		}
+	}
+	return charges, nil
+}
+
+// updateSubscription applies fn to locked subscription and stores the result
+func (s *ApiServer) updateSubscription(ctx context.Context, id int, fn func(pgx.Tx, *Subscription) error) (*Subscription, error) {
+	tx, err := s.database.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	sub := new(Subscription)
+	err = scanSubscription(tx.QueryRow(ctx, "select "+subscriptionColumns+" from subscriptions where id=$1 for update", id), sub)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: subscription not found")}
+		}
+		return nil, err
+	}
+	if sub.Status == subscriptionCanceled {
+		return nil, &StatusError{http.StatusConflict, fmt.Errorf("error: subscription is already canceled")}
+	}
+
+	err = fn(tx, sub)
+	if err != nil {
+		return nil, err
+	}
+	err = scanSubscription(tx.QueryRow(
+		ctx,
+		`update subscriptions set plan_id=$2, status=$3, cancel_at_period_end=$4, canceled_at=$5,
+		next_billing_at=$6, proration_balance=$7 where id=$1 returning `+subscriptionColumns,
+		sub.ID,
+		sub.PlanID,
+		sub.Status,
+		sub.CancelAtPeriodEnd,
+		sub.CanceledAt,
+		sub.NextBillingAt,
+		sub.ProrationBalance,
+	), sub)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// UpdateSubscription switches plan with proration or schedules cancellation at period end
+func (s *ApiServer) UpdateSubscription(ctx context.Context, id int, u SubscriptionUpdate) (*Subscription, error) {
+	sub, err := s.updateSubscription(ctx, id, func(tx pgx.Tx, sub *Subscription) error {
+		if sub.Status == subscriptionUnpaid {
+			return &StatusError{http.StatusConflict, fmt.Errorf("error: subscription is unpaid")}
+		}
+		if u.PlanID != nil && *u.PlanID != sub.PlanID {
+			from, err := getPlan(ctx, tx, sub.PlanID)
+			if err != nil {
+				return err
+			}
+			to, err := getPlan(ctx, tx, *u.PlanID)
+			if err != nil {
+				return err
+			}
+			if to.Currency != from.Currency {
+				return &StatusError{http.StatusConflict, fmt.Errorf("error: plan currency should stay %s", from.Currency)}
+			}
+			// Trial is free on any plan
+			if sub.Status != subscriptionTrialing {
+				p := proration(from, to, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, clock.Now())
+				sub.ProrationBalance = roundCents(sub.ProrationBalance + p)
+			}
+			sub.PlanID = to.ID
+		}
+		if u.CancelAtPeriodEnd != nil {
+			sub.CancelAtPeriodEnd = *u.CancelAtPeriodEnd
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.webhooks.Send(ctx, "subscription.updated", sub)
+	return sub, nil
+}
+
+// CancelSubscription stops subscription right away
+func (s *ApiServer) CancelSubscription(ctx context.Context, id int) (*Subscription, error) {
+	sub, err := s.updateSubscription(ctx, id, func(tx pgx.Tx, sub *Subscription) error {
+		now := clock.Now()
+		sub.Status, sub.CanceledAt, sub.NextBillingAt = subscriptionCanceled, &now, nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.webhooks.Send(ctx, "subscription.canceled", sub)
+	return sub, nil
+}
+
+func (s *ApiServer) GetSubscription(ctx context.Context, id int) (*Subscription, error) {
+	sub := new(Subscription)
+	err := scanSubscription(s.database.QueryRow(ctx, "select "+subscriptionColumns+" from subscriptions where id=$1", id), sub)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, &StatusError{http.StatusNotFound, fmt.Errorf("error: subscription not found")}
+		}
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (s *ApiServer) GetSubscriptions(ctx context.Context, f SubscriptionFilter) ([]Subscription, error) {
+	q := "select " + subscriptionColumns + " from subscriptions where true"
+	args := make([]interface{}, 0, 2)
+	if f.UserID != nil {
+		args = append(args, *f.UserID)
+		q += fmt.Sprintf(" and user_id=$%d", len(args))
+	}
+	if f.Status != "" {
+		args = append(args, f.Status)
+		q += fmt.Sprintf(" and status=$%d", len(args))
+	}
+	rows, err := s.database.Query(ctx, q+" order by id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := make([]Subscription, 0)
+	for rows.Next() {
+		sub := Subscription{}
+		err = scanSubscription(rows, &sub)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+func (s *ApiServer) GetSubscriptionCharges(ctx context.Context, id int) ([]SubscriptionCharge, error) {
+	_, err := s.GetSubscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.database.Query(ctx, "select "+chargeColumns+" from subscription_charges where subscription_id=$1 order by id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	charges := make([]SubscriptionCharge, 0)
+	for rows.Next() {
+		c := SubscriptionCharge{}
+		err = scanCharge(rows, &c)
+		if err != nil {
+			return nil, err
+		}
+		charges = append(charges, c)
+	}
+	return charges, rows.Err()
+}
+
+func validatePlan(p *Plan) error {
+	if p.IntervalCount == 0 {
+		p.IntervalCount = 1
+	}
+	switch {
+	case p.Name == "" || p.Amount == 0 || p.Currency == "" || p.Interval == "":
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: name, amount, currency, interval")}
+	case p.Amount < 0:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: amount can't be negative")}
+	case len([]rune(p.Currency)) > 20:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: maximum length of currency is 20")}
+	case !contains(billingIntervals, p.Interval):
+		return &StatusError{
+			http.StatusBadRequest,
+			fmt.Errorf("error: there is no interval like '%s'; available intervals: %s", p.Interval, strings.Join(billingIntervals, ",")),
+		}
+	case p.IntervalCount < 0 || p.IntervalCount > 365:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: interval_count should be within 1..365")}
+	case p.TrialDays < 0 || p.TrialDays > 730:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: trial_days should be within 0..730")}
+	case p.MerchantID < 0:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: merchant_id can't be negative")}
+	}
+	return nil
+}
+
+func validateSubscription(sub *Subscription) error {
+	switch {
+	case sub.PlanID == 0 || sub.UserID == 0 || sub.Email == "":
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: plan_id, user_id, email")}
+	case len([]rune(sub.Email)) > 50:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: email shouldn't be more than 50 characters")}
+	case sub.PaymentMethodID < 0:
+		return &StatusError{http.StatusBadRequest, fmt.Errorf("error: payment_method_id shouldn't be negative")}
+	}
+	return nil
+}
+
+// writeSubscription replies with a single subscription
+func writeSubscription(rw http.ResponseWriter, sub *Subscription, code int) {
+	data, _ := json.Marshal(sub)
+	rw.Header().Add("content-type", "application/json")
+	rw.WriteHeader(code)
+	rw.Write(data)
+}
+
+func subscriptionID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, &StatusError{http.StatusBadRequest, fmt.Errorf("error: id is NaN")}
+	}
+	return id, nil
+}
+
+// CreatePlanHandler..
+func CreatePlanHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		p := new(Plan)
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err := decoder.Decode(p)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		err = validatePlan(p)
+		if err != nil {
+			return err
+		}
+
+		err = api.CreatePlan(r.Context(), p)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(p)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// GetPlansHandler..
+func GetPlansHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		plans, err := api.GetPlans(r.Context())
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(plans)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// CreateSubscriptionHandler..
+func CreateSubscriptionHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		sub := new(Subscription)
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err := decoder.Decode(sub)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		err = validateSubscription(sub)
+		if err != nil {
+			return err
+		}
+
+		err = api.CreateSubscription(r.Context(), sub)
+		if err != nil {
+			return err
+		}
+		writeSubscription(rw, sub, http.StatusCreated)
+		return nil
+	}
+}
+
+// GetSubscriptionsHandler..
+func GetSubscriptionsHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		query := r.URL.Query()
+		filter := SubscriptionFilter{Status: query.Get("status")}
+		if val := query.Get("user_id"); val != "" {
+			userID, err := strconv.Atoi(val)
+			if err != nil {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: 'user_id' is NaN")}
+			}
+			filter.UserID = &userID
+		}
+		switch filter.Status {
+		case "", subscriptionTrialing, subscriptionActive, subscriptionPastDue, subscriptionUnpaid, subscriptionCanceled:
+		default:
+			return &StatusError{
+				http.StatusBadRequest,
+				fmt.Errorf("error: there is no status like '%s'; available statuses: trialing,active,past_due,unpaid,canceled", filter.Status),
+			}
+		}
+		page, err := pageParam(query.Get("page"))
+		if err != nil {
+			return err
+		}
+
+		subs, err := api.GetSubscriptions(r.Context(), filter)
+		if err != nil {
+			return err
+		}
+		start, end := Paginate(page, 10, len(subs))
+		data, _ := json.Marshal(subs[start:end])
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// GetSubscriptionHandler..
+func GetSubscriptionHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := subscriptionID(r)
+		if err != nil {
+			return err
+		}
+		sub, err := api.GetSubscription(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		writeSubscription(rw, sub, http.StatusFound)
+		return nil
+	}
+}
+
+// UpdateSubscriptionHandler..
+func UpdateSubscriptionHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := subscriptionID(r)
+		if err != nil {
+			return err
+		}
+		u := SubscriptionUpdate{}
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err = decoder.Decode(&u)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		if u.PlanID == nil && u.CancelAtPeriodEnd == nil {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: required parameters: plan_id or cancel_at_period_end")}
+		}
+
+		sub, err := api.UpdateSubscription(r.Context(), id, u)
+		if err != nil {
+			return err
+		}
+		writeSubscription(rw, sub, http.StatusOK)
+		return nil
+	}
+}
+
+// CancelSubscriptionHandler..
+func CancelSubscriptionHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := subscriptionID(r)
+		if err != nil {
+			return err
+		}
+		sub, err := api.CancelSubscription(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		writeSubscription(rw, sub, http.StatusOK)
+		return nil
+	}
+}
+
+// GetSubscriptionChargesHandler..
+func GetSubscriptionChargesHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		id, err := subscriptionID(r)
+		if err != nil {
+			return err
+		}
+		charges, err := api.GetSubscriptionCharges(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(charges)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
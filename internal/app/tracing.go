@@ -0,0 +1,490 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Span kinds, numbered as in OTLP
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+// Trace exporters, chosen by OTEL_TRACES_EXPORTER
+const (
+	exporterNone    = "none"
+	exporterOTLP    = "otlp"
+	exporterConsole = "console"
+)
+
+const (
+	traceparentHeader = "traceparent"
+	// Spans are exported in batches of this size, or when flush interval passes
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+	// Spans finished while the queue is full are dropped
+	traceQueueSize = 2048
+)
+
+// Tracer exporting spans, nil if tracing is disabled
+var tracer *spanTracer
+
+// traceContext identifies a span across process boundaries, as in W3C traceparent
+type traceContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// parseTraceparent reads header of version 00, unknown versions are read as 00 if they fit
+func parseTraceparent(h string) (traceContext, bool) {
+	var tc traceContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return tc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return tc, false
+	}
+	// Only lowercase hex is valid
+	for _, p := range parts[:4] {
+		if strings.ToLower(p) != p {
+			return tc, false
+		}
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(tc.traceID[:], []byte(parts[1])); err != nil {
+		return tc, false
+	}
+	if _, err := hex.Decode(tc.spanID[:], []byte(parts[2])); err != nil {
+		return tc, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return tc, false
+	}
+	if tc.traceID == [16]byte{} || tc.spanID == [8]byte{} {
+		return tc, false
+	}
+	tc.sampled = flags[0]&1 == 1
+	return tc, true
+}
+
+func (tc traceContext) String() string {
+	flags := "00"
+	if tc.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(tc.traceID[:]) + "-" + hex.EncodeToString(tc.spanID[:]) + "-" + flags
+}
+
+type traceContextKey struct{}
+type spanKey struct{}
+
+// withRemoteParent keeps trace context of incoming request, spans started later continue its trace
+func withRemoteParent(ctx context.Context, tc traceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// currentTrace is trace context of span in ctx, or of the remote parent
+func currentTrace(ctx context.Context) (traceContext, bool) {
+	if s, ok := ctx.Value(spanKey{}).(*span); ok {
+		return s.traceContext, true
+	}
+	tc, ok := ctx.Value(traceContextKey{}).(traceContext)
+	return tc, ok
+}
+
+// spanFromContext is the span started last in ctx, nil if there is none
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// injectTrace sets traceparent of outgoing request, so the receiver continues the trace
+func injectTrace(ctx context.Context, h http.Header) {
+	if tc, ok := currentTrace(ctx); ok {
+		h.Set(traceparentHeader, tc.String())
+	}
+}
+
+type spanAttribute struct {
+	key   string
+	value interface{}
+}
+
+// span is a timed operation of a trace. Nil span does nothing,
+// so callers don't check whether tracing is enabled.
+type span struct {
+	traceContext
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []spanAttribute
+	err      string
+}
+
+// startSpan starts a child of span in ctx, or a root span,
+// returned context carries the new span
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now()}
+	if parent, ok := currentTrace(ctx); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+		s.sampled = parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = true
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetAttribute adds attribute of string, int, float64 or bool value
+func (s *span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, spanAttribute{key, value})
+}
+
+// SetError marks span as failed
+func (s *span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.err = err.Error()
+}
+
+// End finishes span and queues it for export
+func (s *span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if s.sampled {
+		tracer.queue(s)
+	}
+}
+
+// spanExporter ships finished spans
+type spanExporter interface {
+	export([]*span) error
+}
+
+type spanTracer struct {
+	exporter spanExporter
+	spans    chan *span
+
+	mu      sync.Mutex
+	dropped int
+}
+
+// newTracer configures tracing from OTEL_* environment variables,
+// tracer is nil when exporter is 'none' or not set
+func newTracer(exporter, endpoint, tracesEndpoint, service string) (*spanTracer, error) {
+	if service == "" {
+		service = "paymulator"
+	}
+	var e spanExporter
+	switch exporter {
+	case "", exporterNone:
+		return nil, nil
+	case exporterConsole, "stdout":
+		e = &consoleExporter{w: os.Stdout}
+	case exporterOTLP:
+		if tracesEndpoint == "" {
+			if endpoint == "" {
+				endpoint = "http://localhost:4318"
+			}
+			tracesEndpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+		}
+		if !strings.HasPrefix(tracesEndpoint, "http://") && !strings.HasPrefix(tracesEndpoint, "https://") {
+			return nil, fmt.Errorf("error: OTLP endpoint '%s' should be http(s) URL", tracesEndpoint)
+		}
+		e = &otlpExporter{url: tracesEndpoint, service: service, client: &http.Client{Timeout: 10 * time.Second}}
+	default:
+		return nil, fmt.Errorf("error: there is no traces exporter like '%s'; available exporters: otlp,console,none", exporter)
+	}
+	return &spanTracer{exporter: e, spans: make(chan *span, traceQueueSize)}, nil
+}
+
+func (t *spanTracer) queue(s *span) {
+	select {
+	case t.spans <- s:
+	default:
+		t.mu.Lock()
+		t.dropped++
+		t.mu.Unlock()
+	}
+}
+
+// run exports queued spans in batches until ctx is done
+func (t *spanTracer) run(ctx context.Context) {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, traceBatchSize)
+	flush := func() {
+		t.mu.Lock()
+		if t.dropped > 0 {
+			log.Printf("Tracing dropped %d spans, export queue is full", t.dropped)
+			t.dropped = 0
+		}
+		t.mu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.export(batch); err != nil {
+			log.Printf("Spans not exported - %s", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) == traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// consoleExporter writes a JSON line per span, for local use
+type consoleExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (e *consoleExporter) export(spans []*span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range spans {
+		attrs := make(map[string]interface{}, len(s.attrs))
+		for _, a := range s.attrs {
+			attrs[a.key] = a.value
+		}
+		line := map[string]interface{}{
+			"trace_id":   hex.EncodeToString(s.traceID[:]),
+			"span_id":    hex.EncodeToString(s.spanID[:]),
+			"name":       s.name,
+			"kind":       spanKindNames[s.kind],
+			"start":      s.start.UTC().Format(time.RFC3339Nano),
+			"duration":   s.end.Sub(s.start).String(),
+			"attributes": attrs,
+		}
+		if s.parentID != [8]byte{} {
+			line["parent_span_id"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != "" {
+			line["error"] = s.err
+		}
+		data, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		if _, err = e.w.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var spanKindNames = map[int]string{spanInternal: "internal", spanServer: "server", spanClient: "client"}
+
+// otlpExporter posts spans to OTLP/HTTP endpoint in JSON encoding
+type otlpExporter struct {
+	url     string
+	service string
+	client  *http.Client
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Message string `json:"message,omitempty"`
+	// 2 is error
+	Code int `json:"code"`
+}
+
+func otlpAttributes(attrs []spanAttribute) []otlpAttribute {
+	res := make([]otlpAttribute, 0, len(attrs))
+	for _, a := range attrs {
+		var v otlpValue
+		switch x := a.value.(type) {
+		case int:
+			s := strconv.Itoa(x)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(x, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &x
+		case bool:
+			v.BoolValue = &x
+		default:
+			s := fmt.Sprint(x)
+			v.StringValue = &s
+		}
+		res = append(res, otlpAttribute{a.key, v})
+	}
+	return res
+}
+
+func (e *otlpExporter) export(spans []*span) error {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != "" {
+			o.Status = &otlpStatus{Message: s.err, Code: 2}
+		}
+		out = append(out, o)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes([]spanAttribute{{"service.name", e.service}}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "paymulator"},
+				"spans": out,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("error: OTLP endpoint replied %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// tracing continues trace of traceparent header, or starts a new one,
+// with a server span per API request
+func tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if tc, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+			ctx = withRemoteParent(ctx, tc)
+		}
+		route := routeTemplate(r)
+		ctx, s := startSpan(ctx, r.Method+" "+route, spanServer)
+		if s == nil {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		s.SetAttribute("http.method", r.Method)
+		s.SetAttribute("http.route", route)
+		s.SetAttribute("http.target", r.URL.RequestURI())
+		sw := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if p != nil {
+				s.SetError(fmt.Errorf("panic: %v", p))
+			} else {
+				s.SetAttribute("http.status_code", status)
+				// Handler errors are already set by errorHandler, they tell more than status text
+				if status >= 500 && s.err == "" {
+					s.SetError(fmt.Errorf("%s", http.StatusText(status)))
+				}
+			}
+			s.End()
+			if p != nil {
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(sw, r.WithContext(ctx))
+	})
+}
+
+// queryTracer is a pgx logger turning logged queries into client spans.
+// pgx logs a query when it's done, so the span is dated back by its duration.
+type queryTracer struct{}
+
+func (queryTracer) Log(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	sql, ok := data["sql"].(string)
+	if !ok || tracer == nil {
+		return
+	}
+	_, s := startSpan(ctx, "db "+msg, spanClient)
+	if d, ok := data["time"].(time.Duration); ok {
+		s.start = s.start.Add(-d)
+	}
+	s.SetAttribute("db.system", "postgresql")
+	s.SetAttribute("db.statement", strings.Join(strings.Fields(sql), " "))
+	if n, ok := data["rowCount"].(int); ok {
+		s.SetAttribute("db.rows", n)
+	}
+	if err, ok := data["err"].(error); ok {
+		s.SetError(err)
+	}
+	s.End()
+}
@@ -0,0 +1,255 @@
+package app
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+// vault encrypts card data at rest with AES-256-GCM,
+// token is bound to ciphertext as additional data
+type vault struct {
+	aead cipher.AEAD
+}
+
+// newVault takes 64 hex characters key, vault is disabled if key is empty
+func newVault(key string) (*vault, error) {
+	if key == "" {
+		return nil, nil
+	}
+	b, err := hex.DecodeString(key)
+	if err != nil || len(b) != 32 {
+		return nil, fmt.Errorf("error: VAULT_KEY should be 64 hex characters")
+	}
+	block, err := aes.NewCipher(b)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &vault{aead}, nil
+}
+
+func (v *vault) seal(token string, data *CardData) ([]byte, error) {
+	plain, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return v.aead.Seal(nonce, nonce, plain, []byte(token)), nil
+}
+
+func (v *vault) open(token string, ciphertext []byte) (*CardData, error) {
+	n := v.aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, fmt.Errorf("error: card data of token '%s' is corrupted", token)
+	}
+	plain, err := v.aead.Open(nil, ciphertext[:n], ciphertext[n:], []byte(token))
+	if err != nil {
+		return nil, fmt.Errorf("error: card data of token '%s' can't be decrypted", token)
+	}
+	data := new(CardData)
+	return data, json.Unmarshal(plain, data)
+}
+
+func newCardToken() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "tok_" + hex.EncodeToString(b)
+}
+
+func (s *ApiServer) checkVault() error {
+	if s.vault == nil {
+		return &StatusError{http.StatusServiceUnavailable, fmt.Errorf("error: card vault is not configured, set VAULT_KEY")}
+	}
+	return nil
+}
+
+// TokenizeCard encrypts card data and stores it under a new token
+func (s *ApiServer) TokenizeCard(ctx context.Context, ct *CardToken, data *CardData) error {
+	if err := s.checkVault(); err != nil {
+		return err
+	}
+	ct.Token = newCardToken()
+	ciphertext, err := s.vault.seal(ct.Token, data)
+	if err != nil {
+		return err
+	}
+	return s.database.QueryRow(
+		ctx,
+		`insert into card_vault (token, ciphertext, brand, last4, exp_month, exp_year, fingerprint, created_at)
+		values ($1,$2,$3,$4,$5,$6,$7,$8) returning created_at`,
+		ct.Token,
+		ciphertext,
+		ct.Card.Brand,
+		ct.Card.Last4,
+		ct.Card.ExpMonth,
+		ct.Card.ExpYear,
+		ct.Card.Fingerprint,
+		clock.Now(),
+	).Scan(&ct.Created_at)
+}
+
+const cardTokenColumns = "token, brand, last4, exp_month, exp_year, fingerprint, created_at, ciphertext"
+
+func scanCardToken(row pgx.Row, ct *CardToken, ciphertext *[]byte) error {
+	err := row.Scan(
+		&ct.Token,
+		&ct.Card.Brand,
+		&ct.Card.Last4,
+		&ct.Card.ExpMonth,
+		&ct.Card.ExpYear,
+		&ct.Card.Fingerprint,
+		&ct.Created_at,
+		ciphertext,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &StatusError{http.StatusNotFound, fmt.Errorf("error: card token not found")}
+	}
+	return err
+}
+
+// GetCardToken returns non-sensitive details of tokenized card
+func (s *ApiServer) GetCardToken(ctx context.Context, token string) (*CardToken, error) {
+	ct := new(CardToken)
+	var ciphertext []byte
+	err := scanCardToken(s.database.QueryRow(ctx, "select "+cardTokenColumns+" from card_vault where token=$1", token), ct, &ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return ct, nil
+}
+
+// DetokenizeCard decrypts card data of token
+func (s *ApiServer) DetokenizeCard(ctx context.Context, token string) (*CardData, error) {
+	if err := s.checkVault(); err != nil {
+		return nil, err
+	}
+	ct := new(CardToken)
+	var ciphertext []byte
+	err := scanCardToken(s.database.QueryRow(ctx, "select "+cardTokenColumns+" from card_vault where token=$1", token), ct, &ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return s.vault.open(token, ciphertext)
+}
+
+// redeemCardTokens turns card tokens of new transactions into
+// stored payment methods, so raw card data never reaches transactions
+func (s *ApiServer) redeemCardTokens(ctx context.Context, tx pgx.Tx, ts []*Transaction) error {
+	methods := make(map[string]int)
+	for _, t := range ts {
+		if t.CardToken == "" {
+			continue
+		}
+		if id, ok := methods[t.CardToken]; ok {
+			t.PaymentMethodID = id
+			continue
+		}
+		if err := s.checkVault(); err != nil {
+			return err
+		}
+		ct := new(CardToken)
+		var ciphertext []byte
+		err := scanCardToken(tx.QueryRow(ctx, "select "+cardTokenColumns+" from card_vault where token=$1", t.CardToken), ct, &ciphertext)
+		if err != nil {
+			var se *StatusError
+			if errors.As(err, &se) {
+				return &StatusError{http.StatusBadRequest, fmt.Errorf("error: card token '%s' not found", t.CardToken)}
+			}
+			return err
+		}
+		data, err := s.vault.open(ct.Token, ciphertext)
+		if err != nil {
+			return err
+		}
+		card := ct.Card
+		pm := &PaymentMethod{Type: methodCard, Card: &card, outcome: testCards[data.Number]}
+		err = insertPaymentMethod(ctx, tx, pm)
+		if err != nil {
+			return err
+		}
+		methods[t.CardToken] = pm.ID
+		t.PaymentMethodID = pm.ID
+	}
+	return nil
+}
+
+// TokenizeCardHandler..
+func TokenizeCardHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		card := new(CardData)
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err := decoder.Decode(card)
+		if err != nil {
+			return &StatusError{http.StatusBadRequest, err}
+		}
+		card.Number = strings.ReplaceAll(card.Number, " ", "")
+		details, err := newCardDetails(card.Number, card.ExpMonth, card.ExpYear, clock.Now())
+		if err != nil {
+			return err
+		}
+		if len([]rune(card.HolderName)) > 100 {
+			return &StatusError{http.StatusBadRequest, fmt.Errorf("error: maximum length of holder_name is 100")}
+		}
+
+		ct := &CardToken{Card: *details}
+		err = api.TokenizeCard(r.Context(), ct, card)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(ct)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// GetCardTokenHandler..
+func GetCardTokenHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		ct, err := api.GetCardToken(r.Context(), mux.Vars(r)["token"])
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(ct)
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(http.StatusFound)
+		rw.Write(data)
+		return nil
+	}
+}
+
+// DetokenizeCardHandler..
+func DetokenizeCardHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		token := mux.Vars(r)["token"]
+		card, err := api.DetokenizeCard(r.Context(), token)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(map[string]interface{}{"token": token, "card": card})
+		rw.Header().Add("content-type", "application/json")
+		rw.Header().Add("cache-control", "no-store")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,114 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Webhook deliveries are retried with doubling delay
+const webhookAttempts = 4
+
+// WebhookEvent is a body of webhook request
+type WebhookEvent struct {
+	Type       string      `json:"type"`
+	Created_at time.Time   `json:"created_at"`
+	Data       interface{} `json:"data"`
+}
+
+// webhookSender posts events to WEBHOOK_URL. When WEBHOOK_SECRET is set,
+// body is signed with HMAC-SHA256 in 'X-Paymulator-Signature' header.
+type webhookSender struct {
+	url     string
+	secret  string
+	client  *http.Client
+	backoff time.Duration
+}
+
+func newWebhookSender(url, secret string) *webhookSender {
+	if url == "" {
+		return nil
+	}
+	return &webhookSender{url: url, secret: secret, client: &http.Client{Timeout: 10 * time.Second}, backoff: time.Second}
+}
+
+func (ws *webhookSender) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(ws.secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send delivers event in background, nil sender sends nothing.
+// Deliveries are traced as children of span in ctx.
+func (ws *webhookSender) Send(ctx context.Context, event string, data interface{}) {
+	if ws == nil {
+		return
+	}
+	body, err := json.Marshal(WebhookEvent{event, clock.Now(), data})
+	if err != nil {
+		log.Printf("Webhook %s not sent - %s", event, err)
+		return
+	}
+	// Request context is done soon after Send, only its trace is kept
+	parent := context.Background()
+	if tc, ok := currentTrace(ctx); ok {
+		parent = withRemoteParent(parent, tc)
+	}
+	go func() {
+		delay := ws.backoff
+		for attempt := 1; ; attempt++ {
+			err := ws.deliver(parent, event, attempt, body)
+			if err == nil {
+				webhookDeliveries.Inc(event, webhookDelivered)
+				return
+			}
+			if attempt == webhookAttempts {
+				webhookDeliveries.Inc(event, webhookDropped)
+				log.Printf("Webhook %s not delivered - %s", event, err)
+				return
+			}
+			webhookDeliveries.Inc(event, webhookRetried)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}()
+}
+
+func (ws *webhookSender) deliver(ctx context.Context, event string, attempt int, body []byte) (err error) {
+	ctx, s := startSpan(ctx, "webhook "+event, spanClient)
+	s.SetAttribute("http.method", "POST")
+	s.SetAttribute("http.url", ws.url)
+	s.SetAttribute("webhook.event", event)
+	s.SetAttribute("webhook.attempt", attempt)
+	defer func() {
+		s.SetError(err)
+		s.End()
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", ws.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	if ws.secret != "" {
+		req.Header.Set("X-Paymulator-Signature", ws.sign(body))
+	}
+	injectTrace(ctx, req.Header)
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	s.SetAttribute("http.status_code", resp.StatusCode)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("error: webhook endpoint replied %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package app
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to write a message to the peer
+	wsWriteWait = 10 * time.Second
+	// Time allowed to read the next pong message from the peer
+	wsPongWait = 60 * time.Second
+	// Send pings to peer with this period. Must be less than wsPongWait
+	wsPingPeriod = (wsPongWait * 9) / 10
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// wsRequest is a message sent by client
+type wsRequest struct {
+	Action string `json:"action"`
+	IDs    []int  `json:"ids"`
+}
+
+// wsResponse is a message sent to client
+type wsResponse struct {
+	Type    string       `json:"type"`
+	IDs     []int        `json:"ids,omitempty"`
+	Event   *StatusEvent `json:"event,omitempty"`
+	Message string       `json:"message,omitempty"`
+}
+
+// tokenAuth checks access token passed either in 'Authorization: Bearer' header
+// or in 'token' query parameter (browsers can't set headers on websockets)
+func tokenAuth(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	if token == "" || api.AuthToken() == "" {
+		return false
+	}
+	tokenHash := sha256.Sum256([]byte(token))
+	expectedTokenHash := sha256.Sum256([]byte(api.AuthToken()))
+	return subtle.ConstantTimeCompare(tokenHash[:], expectedTokenHash[:]) == 1
+}
+
+// SubscribeTransactionsHandler..
+func SubscribeTransactionsHandler() errorHandler {
+	return func(rw http.ResponseWriter, r *http.Request) error {
+		if !tokenAuth(r) {
+			return &StatusError{http.StatusUnauthorized, fmt.Errorf("error: invalid or missing access token")}
+		}
+		conn, err := upgrader.Upgrade(rw, r, nil)
+		if err != nil {
+			// Upgrader already replied with an error
+			log.Printf("WS upgrade failed - %s", err)
+			return nil
+		}
+		serveWS(conn, hub)
+		return nil
+	}
+}
+
+// serveWS runs connection until client disconnects or falls behind
+func serveWS(conn *websocket.Conn, h *Hub) {
+	sub := newSubscriber(subscriberBuffer)
+	defer func() {
+		h.UnsubscribeAll(sub)
+		sub.drop()
+		conn.Close()
+	}()
+
+	// Writes must come from a single goroutine, reader hands replies over
+	replies := make(chan wsResponse, 8)
+	go wsReader(conn, h, sub, replies)
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-sub.done:
+			conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "slow consumer"),
+				time.Now().Add(wsWriteWait),
+			)
+			return
+		case ev := <-sub.events:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err = conn.WriteJSON(wsResponse{Type: "status", Event: &ev})
+		case resp, ok := <-replies:
+			if !ok {
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err = conn.WriteJSON(resp)
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err = conn.WriteMessage(websocket.PingMessage, nil)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func wsReader(conn *websocket.Conn, h *Hub, sub *subscriber, replies chan<- wsResponse) {
+	defer close(replies)
+	conn.SetReadLimit(4096)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		req := wsRequest{}
+		if err := json.Unmarshal(msg, &req); err != nil {
+			// Malformed message, connection itself is still fine
+			select {
+			case replies <- wsResponse{Type: "error", Message: "error: invalid message"}:
+			case <-sub.done:
+				return
+			}
+			continue
+		}
+
+		resp := wsResponse{IDs: req.IDs}
+		switch req.Action {
+		case "subscribe":
+			for _, id := range req.IDs {
+				h.Subscribe(id, sub)
+			}
+			resp.Type = "subscribed"
+		case "unsubscribe":
+			for _, id := range req.IDs {
+				h.Unsubscribe(id, sub)
+			}
+			resp.Type = "unsubscribed"
+		default:
+			resp = wsResponse{
+				Type:    "error",
+				Message: fmt.Sprintf("error: there is no action like '%s'; available actions: subscribe,unsubscribe", req.Action),
+			}
+		}
+		select {
+		case replies <- resp:
+		case <-sub.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: paymulator.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Paymulator_CreateTransaction_FullMethodName = "/paymulator.v1.Paymulator/CreateTransaction"
+	Paymulator_GetTransaction_FullMethodName    = "/paymulator.v1.Paymulator/GetTransaction"
+	Paymulator_ListTransactions_FullMethodName  = "/paymulator.v1.Paymulator/ListTransactions"
+	Paymulator_ChangeStatus_FullMethodName      = "/paymulator.v1.Paymulator/ChangeStatus"
+	Paymulator_Cancel_FullMethodName            = "/paymulator.v1.Paymulator/Cancel"
+	Paymulator_WatchTransaction_FullMethodName  = "/paymulator.v1.Paymulator/WatchTransaction"
+)
+
+// PaymulatorClient is the client API for Paymulator service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PaymulatorClient interface {
+	CreateTransaction(ctx context.Context, in *CreateTransactionRequest, opts ...grpc.CallOption) (*Transaction, error)
+	GetTransaction(ctx context.Context, in *GetTransactionRequest, opts ...grpc.CallOption) (*Transaction, error)
+	ListTransactions(ctx context.Context, in *ListTransactionsRequest, opts ...grpc.CallOption) (*ListTransactionsResponse, error)
+	ChangeStatus(ctx context.Context, in *ChangeStatusRequest, opts ...grpc.CallOption) (*ChangeStatusResponse, error)
+	Cancel(ctx context.Context, in *CancelRequest, opts ...grpc.CallOption) (*ChangeStatusResponse, error)
+	// WatchTransaction sends current status and then every committed change
+	WatchTransaction(ctx context.Context, in *WatchTransactionRequest, opts ...grpc.CallOption) (Paymulator_WatchTransactionClient, error)
+}
+
+type paymulatorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPaymulatorClient(cc grpc.ClientConnInterface) PaymulatorClient {
+	return &paymulatorClient{cc}
+}
+
+func (c *paymulatorClient) CreateTransaction(ctx context.Context, in *CreateTransactionRequest, opts ...grpc.CallOption) (*Transaction, error) {
+	out := new(Transaction)
+	err := c.cc.Invoke(ctx, Paymulator_CreateTransaction_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *paymulatorClient) GetTransaction(ctx context.Context, in *GetTransactionRequest, opts ...grpc.CallOption) (*Transaction, error) {
+	out := new(Transaction)
+	err := c.cc.Invoke(ctx, Paymulator_GetTransaction_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *paymulatorClient) ListTransactions(ctx context.Context, in *ListTransactionsRequest, opts ...grpc.CallOption) (*ListTransactionsResponse, error) {
+	out := new(ListTransactionsResponse)
+	err := c.cc.Invoke(ctx, Paymulator_ListTransactions_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *paymulatorClient) ChangeStatus(ctx context.Context, in *ChangeStatusRequest, opts ...grpc.CallOption) (*ChangeStatusResponse, error) {
+	out := new(ChangeStatusResponse)
+	err := c.cc.Invoke(ctx, Paymulator_ChangeStatus_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *paymulatorClient) Cancel(ctx context.Context, in *CancelRequest, opts ...grpc.CallOption) (*ChangeStatusResponse, error) {
+	out := new(ChangeStatusResponse)
+	err := c.cc.Invoke(ctx, Paymulator_Cancel_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *paymulatorClient) WatchTransaction(ctx context.Context, in *WatchTransactionRequest, opts ...grpc.CallOption) (Paymulator_WatchTransactionClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Paymulator_ServiceDesc.Streams[0], Paymulator_WatchTransaction_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &paymulatorWatchTransactionClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Paymulator_WatchTransactionClient interface {
+	Recv() (*StatusEvent, error)
+	grpc.ClientStream
+}
+
+type paymulatorWatchTransactionClient struct {
+	grpc.ClientStream
+}
+
+func (x *paymulatorWatchTransactionClient) Recv() (*StatusEvent, error) {
+	m := new(StatusEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PaymulatorServer is the server API for Paymulator service.
+// All implementations must embed UnimplementedPaymulatorServer
+// for forward compatibility
+type PaymulatorServer interface {
+	CreateTransaction(context.Context, *CreateTransactionRequest) (*Transaction, error)
+	GetTransaction(context.Context, *GetTransactionRequest) (*Transaction, error)
+	ListTransactions(context.Context, *ListTransactionsRequest) (*ListTransactionsResponse, error)
+	ChangeStatus(context.Context, *ChangeStatusRequest) (*ChangeStatusResponse, error)
+	Cancel(context.Context, *CancelRequest) (*ChangeStatusResponse, error)
+	// WatchTransaction sends current status and then every committed change
+	WatchTransaction(*WatchTransactionRequest, Paymulator_WatchTransactionServer) error
+	mustEmbedUnimplementedPaymulatorServer()
+}
+
+// UnimplementedPaymulatorServer must be embedded to have forward compatible implementations.
+type UnimplementedPaymulatorServer struct {
+}
+
+func (UnimplementedPaymulatorServer) CreateTransaction(context.Context, *CreateTransactionRequest) (*Transaction, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateTransaction not implemented")
+}
+func (UnimplementedPaymulatorServer) GetTransaction(context.Context, *GetTransactionRequest) (*Transaction, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTransaction not implemented")
+}
+func (UnimplementedPaymulatorServer) ListTransactions(context.Context, *ListTransactionsRequest) (*ListTransactionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListTransactions not implemented")
+}
+func (UnimplementedPaymulatorServer) ChangeStatus(context.Context, *ChangeStatusRequest) (*ChangeStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ChangeStatus not implemented")
+}
+func (UnimplementedPaymulatorServer) Cancel(context.Context, *CancelRequest) (*ChangeStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Cancel not implemented")
+}
+func (UnimplementedPaymulatorServer) WatchTransaction(*WatchTransactionRequest, Paymulator_WatchTransactionServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchTransaction not implemented")
+}
+func (UnimplementedPaymulatorServer) mustEmbedUnimplementedPaymulatorServer() {}
+
+// UnsafePaymulatorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PaymulatorServer will
+// result in compilation errors.
+type UnsafePaymulatorServer interface {
+	mustEmbedUnimplementedPaymulatorServer()
+}
+
+func RegisterPaymulatorServer(s grpc.ServiceRegistrar, srv PaymulatorServer) {
+	s.RegisterService(&Paymulator_ServiceDesc, srv)
+}
+
+func _Paymulator_CreateTransaction_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateTransactionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PaymulatorServer).CreateTransaction(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Paymulator_CreateTransaction_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PaymulatorServer).CreateTransaction(ctx, req.(*CreateTransactionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Paymulator_GetTransaction_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTransactionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PaymulatorServer).GetTransaction(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Paymulator_GetTransaction_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PaymulatorServer).GetTransaction(ctx, req.(*GetTransactionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Paymulator_ListTransactions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListTransactionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PaymulatorServer).ListTransactions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Paymulator_ListTransactions_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PaymulatorServer).ListTransactions(ctx, req.(*ListTransactionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Paymulator_ChangeStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ChangeStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PaymulatorServer).ChangeStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Paymulator_ChangeStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PaymulatorServer).ChangeStatus(ctx, req.(*ChangeStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Paymulator_Cancel_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PaymulatorServer).Cancel(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Paymulator_Cancel_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PaymulatorServer).Cancel(ctx, req.(*CancelRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Paymulator_WatchTransaction_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchTransactionRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PaymulatorServer).WatchTransaction(m, &paymulatorWatchTransactionServer{stream})
+}
+
+type Paymulator_WatchTransactionServer interface {
+	Send(*StatusEvent) error
+	grpc.ServerStream
+}
+
+type paymulatorWatchTransactionServer struct {
+	grpc.ServerStream
+}
+
+func (x *paymulatorWatchTransactionServer) Send(m *StatusEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Paymulator_ServiceDesc is the grpc.ServiceDesc for Paymulator service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Paymulator_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "paymulator.v1.Paymulator",
+	HandlerType: (*PaymulatorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateTransaction",
+			Handler:    _Paymulator_CreateTransaction_Handler,
+		},
+		{
+			MethodName: "GetTransaction",
+			Handler:    _Paymulator_GetTransaction_Handler,
+		},
+		{
+			MethodName: "ListTransactions",
+			Handler:    _Paymulator_ListTransactions_Handler,
+		},
+		{
+			MethodName: "ChangeStatus",
+			Handler:    _Paymulator_ChangeStatus_Handler,
+		},
+		{
+			MethodName: "Cancel",
+			Handler:    _Paymulator_Cancel_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchTransaction",
+			Handler:       _Paymulator_WatchTransaction_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "paymulator.proto",
+}
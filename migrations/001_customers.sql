@@ -0,0 +1,35 @@
+-- Customers replace user_id and email repeated on every transaction.
+-- Back-fills a customer per user_id with its latest email, run once on databases
+-- created by init.sql before customers were introduced:
+--   psql -d test_db -f migrations/001_customers.sql
+
+BEGIN;
+
+CREATE TABLE customers (
+    id SERIAL NOT NULL PRIMARY KEY,
+    user_id INT NOT NULL UNIQUE,
+    email VARCHAR NOT NULL,
+    name VARCHAR NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX customers_email_idx ON customers (email);
+
+ALTER TABLE payment_methods ADD COLUMN customer_id INT REFERENCES customers (id) ON DELETE SET NULL;
+ALTER TABLE transactions ADD COLUMN customer_id INT REFERENCES customers (id);
+
+INSERT INTO customers (user_id, email, created_at, changed_at)
+SELECT user_id, (array_agg(email ORDER BY created_at DESC))[1], min(created_at), max(created_at)
+FROM (
+    SELECT user_id, coalesce(email, '') AS email, created_at FROM transactions WHERE user_id IS NOT NULL
+    UNION ALL
+    SELECT user_id, email, created_at FROM subscriptions
+) AS payers
+GROUP BY user_id;
+
+UPDATE transactions t SET customer_id = c.id FROM customers c WHERE c.user_id = t.user_id;
+UPDATE subscriptions s SET email = c.email FROM customers c WHERE c.user_id = s.user_id;
+
+CREATE INDEX transactions_customer_id_idx ON transactions (customer_id);
+
+COMMIT;
@@ -0,0 +1,44 @@
+-- Settlements total refunds of lost disputes, fees and net amounts.
+-- Run once on databases created by init.sql before settlement fees were introduced,
+-- fees of batches closed before are back-filled from the ledger:
+--   psql -d test_db -f migrations/002_settlement_fees.sql
+
+BEGIN;
+
+ALTER TABLE settlements
+    ADD COLUMN refunded_count INT NOT NULL DEFAULT 0,
+    ADD COLUMN refunded_amount FLOAT NOT NULL DEFAULT 0,
+    ADD COLUMN fee_amount FLOAT NOT NULL DEFAULT 0,
+    ADD COLUMN net_amount FLOAT NOT NULL DEFAULT 0;
+
+ALTER TABLE settlement_lines
+    ADD COLUMN type VARCHAR NOT NULL DEFAULT 'payment',
+    ADD COLUMN dispute_id INT UNIQUE REFERENCES disputes (id),
+    ADD COLUMN fee FLOAT NOT NULL DEFAULT 0,
+    ADD COLUMN net_amount FLOAT NOT NULL DEFAULT 0;
+
+-- A transaction is settled once, its refund once more
+ALTER TABLE settlement_lines DROP CONSTRAINT settlement_lines_transaction_id_key;
+CREATE UNIQUE INDEX settlement_lines_transaction_id_key ON settlement_lines (transaction_id) WHERE dispute_id IS NULL;
+
+UPDATE settlement_lines l SET
+    fee = f.fee,
+    net_amount = l.amount - f.fee
+FROM (
+    SELECT l.id, coalesce((
+        SELECT sum(e.amount) FROM ledger_postings p JOIN ledger_entries e ON e.posting_id = p.id
+        WHERE p.transaction_id = l.transaction_id AND p.event = 'fee' AND e.account = 'provider:fees'
+    ), 0) AS fee
+    FROM settlement_lines l
+) f
+WHERE f.id = l.id AND l.transaction_status = 'УСПЕХ';
+
+UPDATE settlements s SET
+    fee_amount = t.fee,
+    net_amount = t.net
+FROM (
+    SELECT settlement_id, sum(fee) AS fee, sum(net_amount) AS net FROM settlement_lines GROUP BY settlement_id
+) t
+WHERE t.settlement_id = s.id;
+
+COMMIT;
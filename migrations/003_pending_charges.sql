@@ -0,0 +1,12 @@
+-- Renewals wait as pending charges until the payment system processes their transactions.
+-- Run once on databases created by init.sql before pending charges were introduced:
+--   psql -d test_db -f migrations/003_pending_charges.sql
+
+BEGIN;
+
+-- Proration billed by a charge, it's given back if the charge fails
+ALTER TABLE subscription_charges ADD COLUMN proration FLOAT NOT NULL DEFAULT 0;
+
+CREATE INDEX subscription_charges_transaction_id_idx ON subscription_charges (transaction_id);
+
+COMMIT;
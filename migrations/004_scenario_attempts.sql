@@ -0,0 +1,14 @@
+-- Scenario steps are recorded as attempted before their actions, so they aren't applied twice.
+-- Run once on databases created by init.sql before scenario attempts were introduced:
+--   psql -d test_db -f migrations/004_scenario_attempts.sql
+
+BEGIN;
+
+CREATE TABLE scenario_attempts (
+    transaction_id INT NOT NULL REFERENCES transactions (id),
+    step INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (transaction_id, step)
+);
+
+COMMIT;